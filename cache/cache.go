@@ -2,6 +2,7 @@ package cache
 
 import (
 	"github.com/patrickmn/go-cache"
+	"strings"
 )
 
 var c = cache.New(cache.NoExpiration, cache.NoExpiration)
@@ -17,3 +18,11 @@ func Get(prefix string, k string) (interface{}, bool) {
 func Remove(prefix string, k string) {
 	c.Delete(prefix + k)
 }
+
+func RemovePrefix(prefix string) {
+	for k := range c.Items() {
+		if strings.HasPrefix(k, prefix) {
+			c.Delete(k)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"github.com/mpetavy/tresor/service/database"
+	"github.com/mpetavy/tresor/service/storage"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -28,6 +30,14 @@ var (
 	server *http.Server
 
 	codegen = flag.Bool("codegen", false, "code generation")
+
+	export     = flag.String("export", "", "comma separated bucket uids to export as BagIt packages")
+	exportDir  = flag.String("export.dir", ".", "directory the BagIt packages are written to")
+	exportZip  = flag.Bool("export.zip", false, "write the BagIt packages as zip files")
+	exportHash = flag.String("export.hash", "", "recompute the payload manifests with this hash algorithm")
+
+	importPath   = flag.String("import", "", "BagIt bag, zipped bag or directory tree to import into the sha driver")
+	importVolume = flag.String("import.volume", "", "volume the imported buckets are stored on")
 )
 
 func init() {
@@ -43,6 +53,40 @@ func run() error {
 		return common.ExitOrError(database.Codegen())
 	}
 
+	if *export != "" {
+		return common.ExitOrError(storage.Exec(func(handle storage.Handle) error {
+			paths, err := storage.Export(handle, strings.Split(*export, ","), *exportDir, &storage.ExportOptions{Zip: *exportZip, Hash: *exportHash})
+			for _, path := range paths {
+				common.Info("exported %s", path)
+			}
+
+			return err
+		}))
+	}
+
+	if *importPath != "" {
+		return common.ExitOrError(storage.Exec(func(handle storage.Handle) error {
+			report, err := storage.Import(handle, *importPath, &storage.Options{VolumeName: *importVolume})
+			if common.Error(err) {
+				return err
+			}
+
+			common.Info("imported %d, failed %d", report.Imported, report.Failed)
+
+			for _, item := range report.Items {
+				if item.Error != "" {
+					common.Error(fmt.Errorf("%s: %s", item.Source, item.Error))
+				}
+			}
+
+			if report.Failed > 0 {
+				return fmt.Errorf("import of %d items failed", report.Failed)
+			}
+
+			return nil
+		}))
+	}
+
 	return nil
 }
 
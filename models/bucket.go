@@ -8,6 +8,7 @@ import (
 
 //go:generate templater -sr Class=Bucket;class=bucket -i ../service/database/mongo_class.go -o ../service/database/mongo_bucket.go
 //go:generate templater -sr Class=Bucket;class=bucket -i ../service/database/pgsql_class.go -o ../service/database/pgsql_bucket.go
+//go:generate templater -sr Class=Bucket;class=bucket -i ../service/database/memory_class.go -o ../service/database/memory_bucket.go
 
 type Bucket struct {
 	Base            `storm:"inline"`
@@ -19,6 +20,11 @@ type Bucket struct {
 	FileHashes      []string          `sql:",array"`
 	FileFulltext    []string          `sql:",array"`
 	FileOrientation []int             `sql:",array"`
+	// RetainUntil and LegalHold protect the bucket against deletion and modification
+	RetainUntil time.Time
+	LegalHold   bool
+	// DeletedAt is set while the bucket is in the trash
+	DeletedAt time.Time
 }
 
 func NewBucket() Bucket {
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+//go:generate templater -sr Class=Fixity;class=fixity -i ../service/database/mongo_class.go -o ../service/database/mongo_fixity.go
+//go:generate templater -sr Class=Fixity;class=fixity -i ../service/database/pgsql_class.go -o ../service/database/pgsql_fixity.go
+//go:generate templater -sr Class=Fixity;class=fixity -i ../service/database/memory_class.go -o ../service/database/memory_fixity.go
+
+// Fixity records the result of the last integrity check of a bucket
+type Fixity struct {
+	Base       `storm:"inline"`
+	Uid        string    `sql:",unique" storm:",unique"`
+	VerifiedAt time.Time `sql:",notnull,default:now()"`
+	Objects    int
+	Mismatches []string `sql:",array"`
+	Missing    []string `sql:",array"`
+	Errors     []string `sql:",array"`
+}
+
+func NewFixity() Fixity {
+	f := Fixity{}
+
+	return f
+}
+
+func (f *Fixity) Valid() bool {
+	return len(f.Mismatches) == 0 && len(f.Missing) == 0 && len(f.Errors) == 0
+}
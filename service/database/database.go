@@ -7,7 +7,7 @@ import (
 	"github.com/mpetavy/common"
 	"github.com/mpetavy/tresor/cache"
 	"github.com/mpetavy/tresor/models"
-	"github.com/mpetavy/tresor/service/errors"
+	"github.com/mpetavy/tresor/service/registry"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -20,6 +20,7 @@ import (
 const (
 	TYPE_MONGODB = "mongodb"
 	TYPE_PGSQL   = "pgsql"
+	TYPE_MEMORY  = "memory"
 
 	QUERY = "query"
 )
@@ -35,6 +36,12 @@ type Cfg struct {
 	Rebuild  bool   `json:"rebuild" html:"Rebuild"`
 }
 
+// driverCfg holds the settings of Cfg which the database service reads for every driver
+type driverCfg struct {
+	Driver  string `json:"driver" html:"Driver"`
+	Rebuild bool   `json:"rebuild" html:"Rebuild"`
+}
+
 type Options struct {
 }
 
@@ -50,10 +57,16 @@ type Handle interface {
 	SaveBucket(doc *models.Bucket, options *Options) error
 	LoadBucket(field string, value interface{}, doc *models.Bucket, options *Options) error
 	DeleteBucket(field string, value interface{}, id int, options *Options) error
+	ListBucket(fn func(doc *models.Bucket) error, options *Options) error
 
 	SaveUser(user *models.User, options *Options) error
 	LoadUser(field string, value interface{}, user *models.User, options *Options) error
 	DeleteUser(field string, value interface{}, id int, options *Options) error
+
+	SaveFixity(fixity *models.Fixity, options *Options) error
+	LoadFixity(field string, value interface{}, fixity *models.Fixity, options *Options) error
+	DeleteFixity(field string, value interface{}, id int, options *Options) error
+	ListFixity(fn func(fixity *models.Fixity) error, options *Options) error
 }
 
 var (
@@ -114,7 +127,7 @@ func Init(c *Cfg, router *mux.Router) error {
 		common.Info("Create Schema")
 
 		err := Exec(func(handle Handle) error {
-			err := handle.CreateSchema([]interface{}{&models.User{}, &models.Bucket{}})
+			err := handle.CreateSchema([]interface{}{&models.User{}, &models.Bucket{}, &models.Fixity{}})
 			if common.Error(err) {
 				return err
 			}
@@ -146,7 +159,7 @@ func createModel(modelPath string, modelFileInfo os.FileInfo) error {
 
 	model := common.FileNamePart(filepath.Base(modelPath))
 
-	for _, typ := range []string{"mongo", "pgsql"} {
+	for _, typ := range []string{"mongo", "pgsql", "memory"} {
 		outputFile := filepath.Join(databasePath, fmt.Sprintf("%s_%s.go", typ, model))
 
 		if !common.FileExists(outputFile) {
@@ -246,19 +259,35 @@ func Exec(fn func(handle Handle) error) error {
 	return fn(handle)
 }
 
+// Factory creates an uninitialized database handle of a driver
+type Factory func() (Handle, error)
+
+var drivers = registry.New[Factory]()
+
+func init() {
+	Register(TYPE_MONGODB, func() (Handle, error) { return NewMongoDB() }, mongoCfg{})
+	Register(TYPE_PGSQL, func() (Handle, error) { return NewPgsqlDB() }, pgsqlCfg{})
+	Register(TYPE_MEMORY, func() (Handle, error) { return NewMemoryDB() }, memoryCfg{})
+}
+
+// Register makes a database driver available by name, config is the configuration struct the driver reads.
+// It panics if the name is already registered
+func Register(name string, factory Factory, config interface{}) {
+	common.Panic(drivers.Register(name, factory, config))
+}
+
+// Drivers lists the registered database drivers with their configuration schema
+func Drivers() []registry.Driver {
+	return drivers.Drivers()
+}
+
 func create(cfg *Cfg) (Handle, error) {
-	var handle Handle
-	var err error
-
-	switch cfg.Driver {
-	case TYPE_MONGODB:
-		handle, err = NewMongoDB()
-	case TYPE_PGSQL:
-		handle, err = NewPgsqlDB()
-	default:
-		return nil, &errors.ErrUnknownDriver{Driver: cfg.Driver}
+	factory, err := drivers.Factory(cfg.Driver)
+	if common.Error(err) {
+		return nil, err
 	}
 
+	handle, err := factory()
 	if common.Error(err) {
 		return nil, err
 	}
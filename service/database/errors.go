@@ -0,0 +1,13 @@
+package database
+
+import "fmt"
+
+type ErrNotFound struct {
+	Model string
+	Field string
+	Value interface{}
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("%s not found: %s = %v", e.Model, e.Field, e.Value)
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mpetavy/common"
+)
+
+// memoryStore holds the json encoded documents of every collection by their id
+type memoryStore struct {
+	mu          sync.Mutex
+	ids         map[string]int
+	collections map[string]map[int][]byte
+}
+
+// memoryStores are shared by instance name between all handles of the pool and live as long as the process
+var (
+	memoryStores   = make(map[string]*memoryStore)
+	memoryStoresMu sync.Mutex
+)
+
+// memoryCfg is the part of Cfg MemoryDB reads, registered as its configuration schema
+type memoryCfg struct {
+	driverCfg
+	Instance string `json:"instance" html:"Instance"`
+}
+
+// MemoryDB keeps the models in memory only. It is meant for tests and throwaway instances which cannot
+// reach a database server.
+type MemoryDB struct {
+	Name  string
+	store *memoryStore
+}
+
+func NewMemoryDB() (*MemoryDB, error) {
+	return &MemoryDB{}, nil
+}
+
+func (db *MemoryDB) Init(cfg *Cfg) error {
+	db.Name = cfg.Instance
+
+	return nil
+}
+
+func (db *MemoryDB) Start() error {
+	memoryStoresMu.Lock()
+	defer memoryStoresMu.Unlock()
+
+	store, ok := memoryStores[db.Name]
+	if !ok {
+		store = &memoryStore{ids: make(map[string]int), collections: make(map[string]map[int][]byte)}
+
+		memoryStores[db.Name] = store
+	}
+
+	db.store = store
+
+	return nil
+}
+
+func (db *MemoryDB) Stop() error {
+	return nil
+}
+
+// CreateSchema drops all collections like MongoDB drops its database
+func (db *MemoryDB) CreateSchema([]interface{}) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	db.store.ids = make(map[string]int)
+	db.store.collections = make(map[string]map[int][]byte)
+
+	return nil
+}
+
+func (db *MemoryDB) EnableIndices(models []interface{}, enable bool) error {
+	return nil
+}
+
+func (db *MemoryDB) SQL(sql string) (string, error) {
+	return "", nil
+}
+
+// matches reports if the document has the value in the field. The field is compared case insensitive
+// without underscores and without the name of the embedded struct, so "uid", "base.id" and "created_at" match.
+func matches(doc map[string]interface{}, field string, value interface{}) bool {
+	if i := strings.LastIndex(field, "."); i != -1 {
+		field = field[i+1:]
+	}
+
+	field = strings.ReplaceAll(field, "_", "")
+
+	for k, v := range doc {
+		if strings.EqualFold(k, field) {
+			return fmt.Sprint(v) == fmt.Sprint(value)
+		}
+	}
+
+	return false
+}
+
+// sortedIds returns the ids of the documents of a collection in ascending order
+func (store *memoryStore) sortedIds(collection string) []int {
+	ids := make([]int, 0, len(store.collections[collection]))
+	for id := range store.collections[collection] {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	return ids
+}
+
+// find returns the ids of the documents with the value in the field or the document with the id if field is empty
+func (store *memoryStore) find(collection string, field string, value interface{}, id int) ([]int, error) {
+	if field == "" {
+		if _, ok := store.collections[collection][id]; ok {
+			return []int{id}, nil
+		}
+
+		return nil, nil
+	}
+
+	var found []int
+
+	for _, id := range store.sortedIds(collection) {
+		doc := make(map[string]interface{})
+
+		err := json.Unmarshal(store.collections[collection][id], &doc)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if matches(doc, field, value) {
+			found = append(found, id)
+		}
+	}
+
+	return found, nil
+}
+
+// save stores the document under its id and assigns the next id of the collection to a new document
+func (db *MemoryDB) save(collection string, id *int, doc interface{}) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	if *id == 0 {
+		db.store.ids[collection]++
+
+		*id = db.store.ids[collection]
+	}
+
+	ba, err := json.Marshal(doc)
+	if common.Error(err) {
+		return err
+	}
+
+	if db.store.collections[collection] == nil {
+		db.store.collections[collection] = make(map[int][]byte)
+	}
+
+	db.store.collections[collection][*id] = ba
+
+	return nil
+}
+
+// load decodes the first document with the value in the field
+func (db *MemoryDB) load(collection string, field string, value interface{}, doc interface{}) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	ids, err := db.store.find(collection, field, value, 0)
+	if common.Error(err) {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return &ErrNotFound{Model: collection, Field: field, Value: value}
+	}
+
+	return json.Unmarshal(db.store.collections[collection][ids[0]], doc)
+}
+
+// delete removes all documents with the value in the field or the document with the id if field is empty
+func (db *MemoryDB) delete(collection string, field string, value interface{}, id int) error {
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+
+	ids, err := db.store.find(collection, field, value, id)
+	if common.Error(err) {
+		return err
+	}
+
+	for _, id := range ids {
+		delete(db.store.collections[collection], id)
+	}
+
+	return nil
+}
+
+// list calls fn for every document of the collection in the order of their ids. The documents are copied
+// before, so fn may access the database itself.
+func (db *MemoryDB) list(collection string, fn func(ba []byte) error) error {
+	db.store.mu.Lock()
+
+	var docs [][]byte
+	for _, id := range db.store.sortedIds(collection) {
+		docs = append(docs, db.store.collections[collection][id])
+	}
+
+	db.store.mu.Unlock()
+
+	for _, ba := range docs {
+		err := fn(ba)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return nil
+}
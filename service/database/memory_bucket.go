@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/json"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"time"
+)
+
+func (db *MemoryDB) SaveBucket(bucket *models.Bucket, options *Options) error {
+	if bucket.CreatedAt.IsZero() {
+		bucket.CreatedAt = time.Now()
+	} else {
+		bucket.ModifiedAt = time.Now()
+	}
+
+	return db.save("bucket", &bucket.Id, bucket)
+}
+
+func (db *MemoryDB) LoadBucket(field string, value interface{}, bucket *models.Bucket, options *Options) error {
+	return db.load("bucket", field, value, bucket)
+}
+
+func (db *MemoryDB) DeleteBucket(field string, value interface{}, id int, options *Options) error {
+	return db.delete("bucket", field, value, id)
+}
+
+func (db *MemoryDB) ListBucket(fn func(bucket *models.Bucket) error, options *Options) error {
+	return db.list("bucket", func(ba []byte) error {
+		bucket := &models.Bucket{}
+
+		err := json.Unmarshal(ba, bucket)
+		if common.Error(err) {
+			return err
+		}
+
+		return fn(bucket)
+	})
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/json"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"time"
+)
+
+func (db *MemoryDB) SaveClass(class *models.Class, options *Options) error {
+	if class.CreatedAt.IsZero() {
+		class.CreatedAt = time.Now()
+	} else {
+		class.ModifiedAt = time.Now()
+	}
+
+	return db.save("class", &class.Id, class)
+}
+
+func (db *MemoryDB) LoadClass(field string, value interface{}, class *models.Class, options *Options) error {
+	return db.load("class", field, value, class)
+}
+
+func (db *MemoryDB) DeleteClass(field string, value interface{}, id int, options *Options) error {
+	return db.delete("class", field, value, id)
+}
+
+func (db *MemoryDB) ListClass(fn func(class *models.Class) error, options *Options) error {
+	return db.list("class", func(ba []byte) error {
+		class := &models.Class{}
+
+		err := json.Unmarshal(ba, class)
+		if common.Error(err) {
+			return err
+		}
+
+		return fn(class)
+	})
+}
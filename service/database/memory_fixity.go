@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/json"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"time"
+)
+
+func (db *MemoryDB) SaveFixity(fixity *models.Fixity, options *Options) error {
+	if fixity.CreatedAt.IsZero() {
+		fixity.CreatedAt = time.Now()
+	} else {
+		fixity.ModifiedAt = time.Now()
+	}
+
+	return db.save("fixity", &fixity.Id, fixity)
+}
+
+func (db *MemoryDB) LoadFixity(field string, value interface{}, fixity *models.Fixity, options *Options) error {
+	return db.load("fixity", field, value, fixity)
+}
+
+func (db *MemoryDB) DeleteFixity(field string, value interface{}, id int, options *Options) error {
+	return db.delete("fixity", field, value, id)
+}
+
+func (db *MemoryDB) ListFixity(fn func(fixity *models.Fixity) error, options *Options) error {
+	return db.list("fixity", func(ba []byte) error {
+		fixity := &models.Fixity{}
+
+		err := json.Unmarshal(ba, fixity)
+		if common.Error(err) {
+			return err
+		}
+
+		return fn(fixity)
+	})
+}
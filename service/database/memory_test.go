@@ -0,0 +1,114 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBucket(t *testing.T) {
+	db, err := NewMemoryDB()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = db.Init(&Cfg{Driver: TYPE_MEMORY, Instance: t.Name()})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = db.Start()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = db.CreateSchema([]interface{}{models.NewBucket()})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for _, uid := range []string{"a", "b", "c"} {
+		bucket := models.NewBucket()
+		bucket.Uid = uid
+		bucket.Props["Title"] = uid
+
+		err := db.SaveBucket(&bucket, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.NotZero(t, bucket.Id)
+		require.False(t, bucket.CreatedAt.IsZero())
+	}
+
+	bucket := models.NewBucket()
+
+	err = db.LoadBucket("uid", "b", &bucket, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, bucket.Id)
+	require.Equal(t, "b", bucket.Props["Title"])
+
+	bucket.Props["Title"] = "changed"
+
+	err = db.SaveBucket(&bucket, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.False(t, bucket.ModifiedAt.IsZero())
+
+	other, err := NewMemoryDB()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = other.Init(&Cfg{Driver: TYPE_MEMORY, Instance: t.Name()})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = other.Start()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	loaded := models.NewBucket()
+
+	err = other.LoadBucket("base.id", 2, &loaded, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "changed", loaded.Props["Title"], "handles of an instance share the data")
+
+	err = db.DeleteBucket("uid", "a", 0, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteBucket("", nil, 3, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = db.LoadBucket("uid", "a", &loaded, nil)
+	require.IsType(t, &ErrNotFound{}, err)
+
+	var uids []string
+
+	err = db.ListBucket(func(bucket *models.Bucket) error {
+		uids = append(uids, bucket.Uid)
+
+		return nil
+	}, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, []string{"b"}, uids)
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"encoding/json"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"time"
+)
+
+func (db *MemoryDB) SaveUser(user *models.User, options *Options) error {
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	} else {
+		user.ModifiedAt = time.Now()
+	}
+
+	return db.save("user", &user.Id, user)
+}
+
+func (db *MemoryDB) LoadUser(field string, value interface{}, user *models.User, options *Options) error {
+	return db.load("user", field, value, user)
+}
+
+func (db *MemoryDB) DeleteUser(field string, value interface{}, id int, options *Options) error {
+	return db.delete("user", field, value, id)
+}
+
+func (db *MemoryDB) ListUser(fn func(user *models.User) error, options *Options) error {
+	return db.list("user", func(ba []byte) error {
+		user := &models.User{}
+
+		err := json.Unmarshal(ba, user)
+		if common.Error(err) {
+			return err
+		}
+
+		return fn(user)
+	})
+}
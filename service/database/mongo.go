@@ -4,11 +4,21 @@ import (
 	"context"
 	"fmt"
 	"github.com/mpetavy/common"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
+// mongoCfg is the part of Cfg MongoDB reads, registered as its configuration schema
+type mongoCfg struct {
+	driverCfg
+	Hostname string `json:"hostname" html:"Host name"`
+	Port     int    `json:"port" html:"Port" html_min:"0" html_max:"65535"`
+	Instance string `json:"instance" html:"Instance"`
+	SSL      bool   `json:"ssl" html:"SSL"`
+}
+
 type MongoDB struct {
 	Name           string
 	URL            string
@@ -62,3 +72,22 @@ func (db *MongoDB) Start() error {
 func (db *MongoDB) Stop() error {
 	return db.Client.Disconnect(nil)
 }
+
+// nextId increments and returns the id counter of a collection
+func (db *MongoDB) nextId(collection string) (int, error) {
+	counter := struct {
+		Value int `bson:"value"`
+	}{}
+
+	err := db.Client.Database(db.Name).Collection("counters").FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": collection},
+		bson.M{"$inc": bson.M{"value": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	return counter.Value, nil
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/mpetavy/common"
 	"github.com/mpetavy/tresor/models"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -15,21 +17,84 @@ func (db *MongoDB) SaveBucket(bucket *models.Bucket, options *Options) error {
 		bucket.ModifiedAt = time.Now()
 	}
 
+	collection := db.Client.Database(db.Name).Collection("bucket")
+
+	if bucket.Id != 0 {
+		b, err := bson.Marshal(bucket)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = collection.ReplaceOne(context.Background(), bson.M{"base.id": bucket.Id}, b)
+
+		return err
+	}
+
+	id, err := db.nextId("bucket")
+	if common.Error(err) {
+		return err
+	}
+
+	bucket.Id = id
+
 	b, err := bson.Marshal(bucket)
 	if common.Error(err) {
 		return err
 	}
 
-	collection := db.Client.Database(db.Name).Collection("bucket")
 	_, err = collection.InsertOne(context.Background(), b)
 
 	return err
 }
 
 func (db *MongoDB) LoadBucket(field string, value interface{}, bucket *models.Bucket, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("bucket")
+
+	err := collection.FindOne(context.Background(), bson.M{field: value}).Decode(bucket)
+	if err == mongo.ErrNoDocuments {
+		return &ErrNotFound{Model: "bucket", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *MongoDB) DeleteBucket(field string, value interface{}, id int, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("bucket")
+
+	filter := bson.M{"base.id": id}
+	if field != "" {
+		filter = bson.M{field: value}
+	}
+
+	_, err := collection.DeleteMany(context.Background(), filter)
+
+	return err
+}
+
+func (db *MongoDB) ListBucket(fn func(bucket *models.Bucket) error, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("bucket")
+
+	cursor, err := collection.Find(context.Background(), bson.M{}, mongooptions.Find().SetSort(bson.M{"base.id": 1}))
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(cursor.Close(context.Background()))
+	}()
+
+	for cursor.Next(context.Background()) {
+		bucket := &models.Bucket{}
+
+		err := cursor.Decode(bucket)
+		if common.Error(err) {
+			return err
+		}
+
+		err = fn(bucket)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return cursor.Err()
 }
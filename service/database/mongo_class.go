@@ -5,6 +5,8 @@ import (
 	"github.com/mpetavy/common"
 	"github.com/mpetavy/tresor/models"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -15,21 +17,84 @@ func (db *MongoDB) SaveClass(class *models.Class, options *Options) error {
 		class.ModifiedAt = time.Now()
 	}
 
+	collection := db.Client.Database(db.Name).Collection("class")
+
+	if class.Id != 0 {
+		b, err := bson.Marshal(class)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = collection.ReplaceOne(context.Background(), bson.M{"base.id": class.Id}, b)
+
+		return err
+	}
+
+	id, err := db.nextId("class")
+	if common.Error(err) {
+		return err
+	}
+
+	class.Id = id
+
 	b, err := bson.Marshal(class)
 	if common.Error(err) {
 		return err
 	}
 
-	collection := db.Client.Database(db.Name).Collection("class")
 	_, err = collection.InsertOne(context.Background(), b)
 
 	return err
 }
 
 func (db *MongoDB) LoadClass(field string, value interface{}, class *models.Class, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("class")
+
+	err := collection.FindOne(context.Background(), bson.M{field: value}).Decode(class)
+	if err == mongo.ErrNoDocuments {
+		return &ErrNotFound{Model: "class", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *MongoDB) DeleteClass(field string, value interface{}, id int, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("class")
+
+	filter := bson.M{"base.id": id}
+	if field != "" {
+		filter = bson.M{field: value}
+	}
+
+	_, err := collection.DeleteMany(context.Background(), filter)
+
+	return err
+}
+
+func (db *MongoDB) ListClass(fn func(class *models.Class) error, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("class")
+
+	cursor, err := collection.Find(context.Background(), bson.M{}, mongooptions.Find().SetSort(bson.M{"base.id": 1}))
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(cursor.Close(context.Background()))
+	}()
+
+	for cursor.Next(context.Background()) {
+		class := &models.Class{}
+
+		err := cursor.Decode(class)
+		if common.Error(err) {
+			return err
+		}
+
+		err = fn(class)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return cursor.Err()
 }
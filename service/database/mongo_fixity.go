@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+func (db *MongoDB) SaveFixity(fixity *models.Fixity, options *Options) error {
+	if fixity.CreatedAt.IsZero() {
+		fixity.CreatedAt = time.Now()
+	} else {
+		fixity.ModifiedAt = time.Now()
+	}
+
+	collection := db.Client.Database(db.Name).Collection("fixity")
+
+	if fixity.Id != 0 {
+		b, err := bson.Marshal(fixity)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = collection.ReplaceOne(context.Background(), bson.M{"base.id": fixity.Id}, b)
+
+		return err
+	}
+
+	id, err := db.nextId("fixity")
+	if common.Error(err) {
+		return err
+	}
+
+	fixity.Id = id
+
+	b, err := bson.Marshal(fixity)
+	if common.Error(err) {
+		return err
+	}
+
+	_, err = collection.InsertOne(context.Background(), b)
+
+	return err
+}
+
+func (db *MongoDB) LoadFixity(field string, value interface{}, fixity *models.Fixity, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("fixity")
+
+	err := collection.FindOne(context.Background(), bson.M{field: value}).Decode(fixity)
+	if err == mongo.ErrNoDocuments {
+		return &ErrNotFound{Model: "fixity", Field: field, Value: value}
+	}
+
+	return err
+}
+
+func (db *MongoDB) DeleteFixity(field string, value interface{}, id int, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("fixity")
+
+	filter := bson.M{"base.id": id}
+	if field != "" {
+		filter = bson.M{field: value}
+	}
+
+	_, err := collection.DeleteMany(context.Background(), filter)
+
+	return err
+}
+
+func (db *MongoDB) ListFixity(fn func(fixity *models.Fixity) error, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("fixity")
+
+	cursor, err := collection.Find(context.Background(), bson.M{}, mongooptions.Find().SetSort(bson.M{"base.id": 1}))
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(cursor.Close(context.Background()))
+	}()
+
+	for cursor.Next(context.Background()) {
+		fixity := &models.Fixity{}
+
+		err := cursor.Decode(fixity)
+		if common.Error(err) {
+			return err
+		}
+
+		err = fn(fixity)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
@@ -5,6 +5,8 @@ import (
 	"github.com/mpetavy/common"
 	"github.com/mpetavy/tresor/models"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongooptions "go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -15,21 +17,84 @@ func (db *MongoDB) SaveUser(user *models.User, options *Options) error {
 		user.ModifiedAt = time.Now()
 	}
 
+	collection := db.Client.Database(db.Name).Collection("user")
+
+	if user.Id != 0 {
+		b, err := bson.Marshal(user)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = collection.ReplaceOne(context.Background(), bson.M{"base.id": user.Id}, b)
+
+		return err
+	}
+
+	id, err := db.nextId("user")
+	if common.Error(err) {
+		return err
+	}
+
+	user.Id = id
+
 	b, err := bson.Marshal(user)
 	if common.Error(err) {
 		return err
 	}
 
-	collection := db.Client.Database(db.Name).Collection("user")
 	_, err = collection.InsertOne(context.Background(), b)
 
 	return err
 }
 
 func (db *MongoDB) LoadUser(field string, value interface{}, user *models.User, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("user")
+
+	err := collection.FindOne(context.Background(), bson.M{field: value}).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return &ErrNotFound{Model: "user", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *MongoDB) DeleteUser(field string, value interface{}, id int, options *Options) error {
-	return nil
+	collection := db.Client.Database(db.Name).Collection("user")
+
+	filter := bson.M{"base.id": id}
+	if field != "" {
+		filter = bson.M{field: value}
+	}
+
+	_, err := collection.DeleteMany(context.Background(), filter)
+
+	return err
+}
+
+func (db *MongoDB) ListUser(fn func(user *models.User) error, options *Options) error {
+	collection := db.Client.Database(db.Name).Collection("user")
+
+	cursor, err := collection.Find(context.Background(), bson.M{}, mongooptions.Find().SetSort(bson.M{"base.id": 1}))
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(cursor.Close(context.Background()))
+	}()
+
+	for cursor.Next(context.Background()) {
+		user := &models.User{}
+
+		err := cursor.Decode(user)
+		if common.Error(err) {
+			return err
+		}
+
+		err = fn(user)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return cursor.Err()
 }
@@ -13,6 +13,16 @@ import (
 	"strings"
 )
 
+// pgsqlCfg is the part of Cfg PostgreSQL reads, registered as its configuration schema
+type pgsqlCfg struct {
+	driverCfg
+	Hostname string `json:"hostname" html:"Host name"`
+	Port     int    `json:"port" html:"Port" html_min:"0" html_max:"65535"`
+	Username string `json:"username" html:"Username"`
+	Password string `json:"password" html:"Password"`
+	Instance string `json:"instance" html:"Instance"`
+}
+
 type PgsqlDB struct {
 	cfg *Cfg
 	ORM *pg.DB
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"github.com/go-pg/pg"
 	"github.com/mpetavy/tresor/models"
 	"time"
 )
@@ -12,13 +13,36 @@ func (db *PgsqlDB) SaveBucket(bucket *models.Bucket, options *Options) error {
 		bucket.ModifiedAt = time.Now()
 	}
 
+	if bucket.Id != 0 {
+		return db.ORM.Update(bucket)
+	}
+
 	return db.ORM.Insert(bucket)
 }
 
 func (db *PgsqlDB) LoadBucket(field string, value interface{}, bucket *models.Bucket, options *Options) error {
-	return nil
+	err := db.ORM.Model(bucket).Where("? = ?", pg.F(field), value).Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return &ErrNotFound{Model: "bucket", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *PgsqlDB) DeleteBucket(field string, value interface{}, id int, options *Options) error {
-	return nil
+	q := db.ORM.Model(&models.Bucket{})
+
+	if field != "" {
+		q = q.Where("? = ?", pg.F(field), value)
+	} else {
+		q = q.Where("id = ?", id)
+	}
+
+	_, err := q.Delete()
+
+	return err
+}
+
+func (db *PgsqlDB) ListBucket(fn func(bucket *models.Bucket) error, options *Options) error {
+	return db.ORM.Model((*models.Bucket)(nil)).Order("id").ForEach(fn)
 }
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"github.com/go-pg/pg"
 	"github.com/mpetavy/tresor/models"
 	"time"
 )
@@ -12,13 +13,36 @@ func (db *PgsqlDB) SaveClass(class *models.Class, options *Options) error {
 		class.ModifiedAt = time.Now()
 	}
 
+	if class.Id != 0 {
+		return db.ORM.Update(class)
+	}
+
 	return db.ORM.Insert(class)
 }
 
 func (db *PgsqlDB) LoadClass(field string, value interface{}, class *models.Class, options *Options) error {
-	return nil
+	err := db.ORM.Model(class).Where("? = ?", pg.F(field), value).Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return &ErrNotFound{Model: "class", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *PgsqlDB) DeleteClass(field string, value interface{}, id int, options *Options) error {
-	return nil
+	q := db.ORM.Model(&models.Class{})
+
+	if field != "" {
+		q = q.Where("? = ?", pg.F(field), value)
+	} else {
+		q = q.Where("id = ?", id)
+	}
+
+	_, err := q.Delete()
+
+	return err
+}
+
+func (db *PgsqlDB) ListClass(fn func(class *models.Class) error, options *Options) error {
+	return db.ORM.Model((*models.Class)(nil)).Order("id").ForEach(fn)
 }
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/mpetavy/tresor/models"
+	"time"
+)
+
+func (db *PgsqlDB) SaveFixity(fixity *models.Fixity, options *Options) error {
+	if fixity.CreatedAt.IsZero() {
+		fixity.CreatedAt = time.Now()
+	} else {
+		fixity.ModifiedAt = time.Now()
+	}
+
+	if fixity.Id != 0 {
+		return db.ORM.Update(fixity)
+	}
+
+	return db.ORM.Insert(fixity)
+}
+
+func (db *PgsqlDB) LoadFixity(field string, value interface{}, fixity *models.Fixity, options *Options) error {
+	err := db.ORM.Model(fixity).Where("? = ?", pg.F(field), value).Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return &ErrNotFound{Model: "fixity", Field: field, Value: value}
+	}
+
+	return err
+}
+
+func (db *PgsqlDB) DeleteFixity(field string, value interface{}, id int, options *Options) error {
+	q := db.ORM.Model(&models.Fixity{})
+
+	if field != "" {
+		q = q.Where("? = ?", pg.F(field), value)
+	} else {
+		q = q.Where("id = ?", id)
+	}
+
+	_, err := q.Delete()
+
+	return err
+}
+
+func (db *PgsqlDB) ListFixity(fn func(fixity *models.Fixity) error, options *Options) error {
+	return db.ORM.Model((*models.Fixity)(nil)).Order("id").ForEach(fn)
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"github.com/go-pg/pg"
 	"github.com/mpetavy/tresor/models"
 	"time"
 )
@@ -12,13 +13,36 @@ func (db *PgsqlDB) SaveUser(user *models.User, options *Options) error {
 		user.ModifiedAt = time.Now()
 	}
 
+	if user.Id != 0 {
+		return db.ORM.Update(user)
+	}
+
 	return db.ORM.Insert(user)
 }
 
 func (db *PgsqlDB) LoadUser(field string, value interface{}, user *models.User, options *Options) error {
-	return nil
+	err := db.ORM.Model(user).Where("? = ?", pg.F(field), value).Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return &ErrNotFound{Model: "user", Field: field, Value: value}
+	}
+
+	return err
 }
 
 func (db *PgsqlDB) DeleteUser(field string, value interface{}, id int, options *Options) error {
-	return nil
+	q := db.ORM.Model(&models.User{})
+
+	if field != "" {
+		q = q.Where("? = ?", pg.F(field), value)
+	} else {
+		q = q.Where("id = ?", id)
+	}
+
+	_, err := q.Delete()
+
+	return err
+}
+
+func (db *PgsqlDB) ListUser(fn func(user *models.User) error, options *Options) error {
+	return db.ORM.Model((*models.User)(nil)).Order("id").ForEach(fn)
 }
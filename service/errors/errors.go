@@ -19,3 +19,11 @@ type ErrServiceCreate struct {
 }
 
 func (e *ErrServiceCreate) Error() string { return fmt.Sprintf("Cannot create service: %s", e.Service) }
+
+type ErrDriverRegistered struct {
+	Driver string
+}
+
+func (e *ErrDriverRegistered) Error() string {
+	return fmt.Sprintf("Driver already registered: %s", e.Driver)
+}
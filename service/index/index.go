@@ -5,7 +5,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/mpetavy/common"
-	"github.com/mpetavy/tresor/service/errors"
+	"github.com/mpetavy/tresor/service/registry"
 )
 
 type Cfg struct {
@@ -85,18 +85,36 @@ func Exec(fn func(handle Handle) error) error {
 	return fn(handle)
 }
 
+// Factory creates an uninitialized index handle of a driver
+type Factory func() (Handle, error)
+
+var drivers = registry.New[Factory]()
+
+func init() {
+	Register(DEFAULT_INDEXER, func() (Handle, error) { return NewDefaultIndexer() }, Cfg{})
+	Register(MEMORY_INDEXER, func() (Handle, error) { return NewMemoryIndexer() }, Cfg{})
+}
+
+// Register makes an index driver available by name, config is the configuration struct the driver reads.
+// It panics if the name is already registered
+func Register(name string, factory Factory, config interface{}) {
+	common.Panic(drivers.Register(name, factory, config))
+}
+
+// Drivers lists the registered index drivers with their configuration schema
+func Drivers() []registry.Driver {
+	return drivers.Drivers()
+}
+
 func create(cfg *Cfg) (Handle, error) {
-	var handle Handle
-	var err error
+	factory, err := drivers.Factory(cfg.Driver)
+	if common.Error(err) {
+		return nil, err
+	}
 
-	switch cfg.Driver {
-	case DEFAULT_INDEXER:
-		handle, err = NewDefaultIndexer()
-		if common.Error(err) {
-			return nil, err
-		}
-	default:
-		return nil, &errors.ErrUnknownDriver{Driver: cfg.Driver}
+	handle, err := factory()
+	if common.Error(err) {
+		return nil, err
 	}
 
 	err = handle.Init(cfg)
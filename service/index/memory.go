@@ -0,0 +1,70 @@
+package index
+
+import (
+	"os"
+
+	"github.com/mpetavy/tresor/utils"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	MEMORY_INDEXER = "memory"
+	MEMORY_LIMIT   = 1024 * 1024
+)
+
+// MemoryIndexer only detects the mime type and takes small text files as fulltext. It needs neither OCR
+// nor external tools and is meant for tests together with the memory storage and database drivers.
+type MemoryIndexer struct {
+}
+
+func NewMemoryIndexer() (*MemoryIndexer, error) {
+	return &MemoryIndexer{}, nil
+}
+
+func (memoryIndexer *MemoryIndexer) Init(cfg *Cfg) error {
+	return nil
+}
+
+func (memoryIndexer *MemoryIndexer) Start() error {
+	return nil
+}
+
+func (memoryIndexer *MemoryIndexer) Stop() error {
+	return nil
+}
+
+func (memoryIndexer *MemoryIndexer) Index(path string, options *Options) (string, Mapping, []byte, string, utils.Orientation, error) {
+	var orientation utils.Orientation
+
+	mapping := make(Mapping)
+
+	s, err := common.FileSize(path)
+	if common.Error(err) {
+		return "", mapping, nil, "", orientation, err
+	}
+
+	var buffer []byte
+
+	if s < MEMORY_LIMIT {
+		buffer, err = os.ReadFile(path)
+	} else {
+		buffer, err = common.ReadFileHeader(path)
+	}
+	if common.Error(err) {
+		return "", mapping, nil, "", orientation, err
+	}
+
+	mt, err := common.DetectMimeType(path, buffer)
+	if common.Error(err) {
+		return "", mapping, nil, "", orientation, err
+	}
+
+	var fulltext string
+
+	if s < MEMORY_LIMIT && common.IsTextMimeType(mt.MimeType) {
+		fulltext = string(buffer)
+	}
+
+	return mt.MimeType, mapping, nil, fulltext, orientation, nil
+}
@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mpetavy/tresor/service/errors"
+)
+
+// Field describes a configuration field of a driver by its json name, type and label
+type Field struct {
+	Name   string  `json:"name"`
+	Type   string  `json:"type"`
+	Label  string  `json:"label,omitempty"`
+	Fields []Field `json:"fields,omitempty"`
+}
+
+// Driver describes a registered driver and the schema of its configuration
+type Driver struct {
+	Name   string  `json:"name"`
+	Schema []Field `json:"schema"`
+}
+
+// Registry holds the factories of the drivers of a service by their name
+type Registry[F any] struct {
+	mu        sync.RWMutex
+	factories map[string]F
+	drivers   map[string]Driver
+}
+
+func New[F any]() *Registry[F] {
+	return &Registry[F]{factories: make(map[string]F), drivers: make(map[string]Driver)}
+}
+
+// Register adds the factory of a driver, config is a value of the configuration struct the driver reads
+func (r *Registry[F]) Register(name string, factory F, config interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.factories[name]; ok {
+		return &errors.ErrDriverRegistered{Driver: name}
+	}
+
+	r.factories[name] = factory
+	r.drivers[name] = Driver{Name: name, Schema: Schema(config)}
+
+	return nil
+}
+
+// Factory returns the factory of a driver or ErrUnknownDriver
+func (r *Registry[F]) Factory(name string) (F, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	factory, ok := r.factories[name]
+	if !ok {
+		return factory, &errors.ErrUnknownDriver{Driver: name}
+	}
+
+	return factory, nil
+}
+
+// Drivers returns the registered drivers ordered by name
+func (r *Registry[F]) Drivers() []Driver {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	drivers := make([]Driver, 0, len(r.drivers))
+	for _, driver := range r.drivers {
+		drivers = append(drivers, driver)
+	}
+
+	sort.Slice(drivers, func(i, j int) bool {
+		return drivers[i].Name < drivers[j].Name
+	})
+
+	return drivers
+}
+
+// Schema describes the exported fields of a configuration struct, nested structs and slices of structs included.
+// The fields of embedded structs are promoted, even if the embedded struct itself is unexported.
+func Schema(config interface{}) []Field {
+	if config == nil {
+		return nil
+	}
+
+	return schema(reflect.TypeOf(config))
+}
+
+func schema(t reflect.Type) []Field {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []Field
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		if !sf.IsExported() && !sf.Anonymous {
+			continue
+		}
+
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if sf.Anonymous && name == "" {
+			fields = append(fields, schema(sf.Type)...)
+
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+
+		field := Field{Name: name, Type: sf.Type.String(), Label: sf.Tag.Get("html")}
+
+		elem := sf.Type
+		if elem.Kind() == reflect.Slice {
+			elem = elem.Elem()
+		}
+
+		if elem.Kind() == reflect.Struct && elem.PkgPath() != "time" {
+			field.Fields = schema(elem)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mpetavy/tresor/service/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testVolumeCfg struct {
+	Name string `json:"name" html:"Name"`
+}
+
+type testBaseCfg struct {
+	Driver string `json:"driver" html:"Driver"`
+}
+
+type testOtherCfg struct {
+	testBaseCfg
+	Path string `json:"path" html:"Path"`
+}
+
+type testCfg struct {
+	Driver   string          `json:"driver" html:"Driver"`
+	Timeout  time.Time       `json:"timeout"`
+	Volumes  []testVolumeCfg `json:"volumes,omitempty" html:"Volumes"`
+	Ignored  string          `json:"-"`
+	internal string
+}
+
+func TestRegistry(t *testing.T) {
+	r := New[func() string]()
+
+	err := r.Register("b", func() string { return "b" }, testCfg{})
+	require.NoError(t, err)
+
+	err = r.Register("a", func() string { return "a" }, &testOtherCfg{})
+	require.NoError(t, err)
+
+	err = r.Register("a", func() string { return "again" }, nil)
+	require.IsType(t, &errors.ErrDriverRegistered{}, err)
+
+	factory, err := r.Factory("a")
+	require.NoError(t, err)
+	require.Equal(t, "a", factory())
+
+	_, err = r.Factory("unknown")
+	require.IsType(t, &errors.ErrUnknownDriver{}, err)
+
+	drivers := r.Drivers()
+	require.Len(t, drivers, 2)
+	require.Equal(t, "a", drivers[0].Name)
+	require.NotEqual(t, drivers[0].Schema, drivers[1].Schema, "every driver has its own schema")
+
+	require.Equal(t, []Field{
+		{Name: "driver", Type: "string", Label: "Driver"},
+		{Name: "path", Type: "string", Label: "Path"},
+	}, drivers[0].Schema, "fields of the embedded struct are promoted")
+
+	require.Equal(t, []Field{
+		{Name: "driver", Type: "string", Label: "Driver"},
+		{Name: "timeout", Type: "time.Time"},
+		{Name: "volumes", Type: "[]registry.testVolumeCfg", Label: "Volumes", Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name"},
+		}},
+	}, drivers[1].Schema)
+}
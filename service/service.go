@@ -1,10 +1,14 @@
 package service
 
 import (
+	"encoding/json"
+	"net/http"
+
 	"github.com/gorilla/mux"
 	"github.com/mpetavy/common"
 	"github.com/mpetavy/tresor/service/database"
 	"github.com/mpetavy/tresor/service/index"
+	"github.com/mpetavy/tresor/service/registry"
 	"github.com/mpetavy/tresor/service/storage"
 )
 
@@ -15,13 +19,45 @@ type TresorCfg struct {
 	Storage  storage.Cfg  `json:"storage" html:"Storage"`
 }
 
+const (
+	DRIVERS = "drivers"
+)
+
+// Drivers lists the registered drivers with their configuration schema by service
+func Drivers() map[string][]registry.Driver {
+	return map[string][]registry.Driver{
+		"database":   database.Drivers(),
+		"index":      index.Drivers(),
+		storage.TYPE: storage.Drivers(),
+	}
+}
+
+func driversHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	common.Error(json.NewEncoder(rw).Encode(Drivers()))
+}
+
 func StartServices(router *mux.Router) error {
 	cfg, err := common.LoadConfigurationFile[TresorCfg]()
 	if common.Error(err) {
 		return err
 	}
 
-	err = database.Init(&cfg.Database, router)
+	return InitServices(cfg, router)
+}
+
+// InitServices starts the services with the given configuration instead of the configuration file
+func InitServices(cfg *TresorCfg, router *mux.Router) error {
+	router.HandleFunc("/"+DRIVERS, driversHandler)
+
+	err := database.Init(&cfg.Database, router)
 	if common.Error(err) {
 		return err
 	}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/mpetavy/tresor/service/index"
+	"github.com/mpetavy/tresor/service/registry"
+	"github.com/mpetavy/tresor/service/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServices(t *testing.T) {
+	router := mux.NewRouter()
+
+	err := InitServices(&TresorCfg{
+		Database: database.Cfg{Driver: database.TYPE_MEMORY, Instance: t.Name()},
+		Index:    index.Cfg{Driver: index.MEMORY_INDEXER},
+		Storage:  storage.Cfg{Driver: storage.TYPE_MEMORY, Volumes: []storage.VolumeCfg{{Name: t.Name()}}},
+	}, router)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(StopServices())
+	}()
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	request := func(method string, path string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(resp.Body.Close())
+		}()
+
+		ba, err := io.ReadAll(resp.Body)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		return resp, string(ba)
+	}
+
+	loadBucket := func(uid string) (*models.Bucket, error) {
+		bucket := models.NewBucket()
+
+		err := database.Exec(func(db database.Handle) error {
+			return db.LoadBucket("uid", uid, &bucket, nil)
+		})
+
+		return &bucket, err
+	}
+
+	resp, body := request(http.MethodGet, "/"+DRIVERS, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	drivers := make(map[string][]registry.Driver)
+
+	err = json.Unmarshal([]byte(body), &drivers)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for _, service := range []string{"database", "index", storage.TYPE} {
+		var names []string
+		for _, driver := range drivers[service] {
+			names = append(names, driver.Name)
+		}
+
+		require.Contains(t, names, "memory", service)
+	}
+
+	resp, body = request(http.MethodPost, "/"+storage.TYPE+"/docs/hello.txt", "hello world")
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	result := storage.StoreResult{}
+
+	err = json.Unmarshal([]byte(body), &result)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Len(t, result.Objects, 1)
+
+	bucket, err := loadBucket(result.Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, []string{result.Objects[0].Digest}, bucket.FileHashes)
+	require.Equal(t, []int64{11}, bucket.FileSizes)
+	require.Equal(t, []string{"hello world"}, bucket.FileFulltext)
+	require.True(t, strings.HasPrefix(bucket.FileMimeTypes[0], "text/plain"), bucket.FileMimeTypes[0])
+
+	resp, body = request(http.MethodGet, "/"+storage.TYPE+"/docs/hello.txt?verify=true", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, "hello world", body)
+	require.Equal(t, strconv.Quote(result.Objects[0].Digest), resp.Header.Get("ETag"))
+
+	resp, body = request(http.MethodPost, "/"+storage.TYPE+"/docs/hello.txt", "hello again")
+	require.Equal(t, http.StatusConflict, resp.StatusCode, body)
+
+	unchanged, err := loadBucket(result.Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, bucket.Id, unchanged.Id)
+	require.Equal(t, []string{"hello world"}, unchanged.FileFulltext, "existing objects are not overwritten")
+
+	resp, body = request(http.MethodDelete, "/"+storage.TYPE+"/docs/hello.txt", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, body)
+
+	resp, _ = request(http.MethodGet, "/"+storage.TYPE+"/docs/hello.txt", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = loadBucket(result.Uid)
+	require.IsType(t, &database.ErrNotFound{}, err)
+}
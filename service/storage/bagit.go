@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/hash"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	EXPORT        = "export"
+	BAGIT_VERSION = "1.0"
+	BAGIT_DATA    = "data"
+)
+
+type ExportOptions struct {
+	// Zip writes every bag as a zip file instead of a directory
+	Zip bool
+	// Hash recomputes the payload manifest with this algorithm instead of taking Bucket.FileHashes
+	Hash string
+}
+
+// bagWriter creates the files of a bag by their slash separated path relative to the bag root
+type bagWriter interface {
+	Create(name string) (io.WriteCloser, error)
+}
+
+type dirBag struct {
+	root string
+}
+
+func (b *dirBag) Create(name string) (io.WriteCloser, error) {
+	p := filepath.Join(b.root, filepath.FromSlash(name))
+
+	err := os.MkdirAll(filepath.Dir(p), common.DefaultDirMode)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, common.DefaultFileMode)
+}
+
+type zipBag struct {
+	writer *zip.Writer
+	prefix string
+}
+
+func (b *zipBag) Create(name string) (io.WriteCloser, error) {
+	w, err := b.writer.CreateHeader(&zip.FileHeader{Name: b.prefix + "/" + name, Method: zip.Deflate, Modified: time.Now()})
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return nopWriteCloser{w}, nil
+}
+
+// bagName derives the directory name of a bag from the uid of its bucket
+func bagName(uid string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "|", "_", ":", "_").Replace(uid)
+}
+
+// payloadPath returns the path of a bucket file inside the payload directory of a bag
+func payloadPath(name string) string {
+	return BAGIT_DATA + "/" + strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// manifestPath encodes the characters a manifest line must not contain
+func manifestPath(p string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(p)
+}
+
+// hashByLength infers the algorithm of a hex encoded hash recorded in Bucket.FileHashes
+func hashByLength(h string) string {
+	switch len(h) {
+	case 32:
+		return hash.MD5
+	case 40:
+		return hash.SHA1
+	case 64:
+		return hash.SHA256
+	case 128:
+		return hash.SHA512
+	default:
+		return ""
+	}
+}
+
+// bagInfo renders the bucket properties as bag-info.txt lines, labels without colons and values on one line.
+// Props carrying a reserved label, like those of an imported bag, are left out.
+func bagInfo(bucket *models.Bucket, octets int64, count int) []byte {
+	buf := bytes.Buffer{}
+	written := make(map[string]bool)
+
+	line := func(label string, value string) {
+		label = strings.TrimSpace(strings.ReplaceAll(label, ":", "_"))
+		value = strings.Join(strings.Fields(value), " ")
+
+		if written[label] {
+			return
+		}
+
+		written[label] = true
+
+		buf.WriteString(fmt.Sprintf("%s: %s\n", label, value))
+	}
+
+	line("External-Identifier", bucket.Uid)
+	line("Bagging-Date", time.Now().Format("2006-01-02"))
+	line("Payload-Oxum", fmt.Sprintf("%d.%d", octets, count))
+
+	keys := make([]string, 0, len(bucket.Props))
+	for k := range bucket.Props {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		line(k, bucket.Props[k])
+	}
+
+	return buf.Bytes()
+}
+
+// exportUID returns the uid of the bucket to export, the latest version for a Sha uid without version
+func exportUID(handle Handle, uid string) (string, error) {
+	sha, ok := handle.(*Sha)
+	if !ok {
+		return uid, nil
+	}
+
+	suid, err := ParseShaUID(uid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	err = sha.latest(suid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	return suid.withoutObject().String(), nil
+}
+
+func loadExportBucket(handle Handle, uid string) (*models.Bucket, error) {
+	uid, err := exportUID(handle, uid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	bucket := models.NewBucket()
+
+	err = database.Exec(func(db database.Handle) error {
+		return db.LoadBucket("uid", uid, &bucket, nil)
+	})
+	if _, ok := err.(*database.ErrNotFound); ok || !bucket.DeletedAt.IsZero() {
+		return nil, &ErrObjectNotFound{Uid: uid}
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &bucket, nil
+}
+
+// writeBag writes the objects of a bucket with their manifests and bag-info as a BagIt package
+func writeBag(handle Handle, bucket *models.Bucket, bw bagWriter, alg string) error {
+	if alg == "" && len(bucket.FileHashes) > 0 {
+		alg = hashByLength(bucket.FileHashes[0])
+	}
+
+	alg = hashAlgorithm(alg)
+
+	recompute := len(bucket.FileHashes) != len(bucket.FileNames)
+	for _, h := range bucket.FileHashes {
+		recompute = recompute || hashByLength(h) != alg
+	}
+
+	write := func(name string, data []byte) (string, error) {
+		w, err := bw.Create(name)
+		if common.Error(err) {
+			return "", err
+		}
+
+		h, err := hash.New(alg)
+		if common.Error(err) {
+			return "", err
+		}
+
+		_, err = io.MultiWriter(w, h).Write(data)
+		if common.Error(err) {
+			common.DebugError(w.Close())
+
+			return "", err
+		}
+
+		return hex.EncodeToString(h.Sum(nil)), w.Close()
+	}
+
+	manifest := make(map[string]string)
+	octets := int64(0)
+
+	for i, name := range bucket.FileNames {
+		object, err := objectRef(handle, bucket.Uid, name)
+		if common.Error(err) {
+			return err
+		}
+
+		p := payloadPath(name)
+
+		w, err := bw.Create(p)
+		if common.Error(err) {
+			return err
+		}
+
+		h, err := hash.New(alg)
+		if common.Error(err) {
+			return err
+		}
+
+		_, loaded, n, err := handle.Load(object, io.MultiWriter(w, h), &Options{Verify: true})
+		if err == nil {
+			err = w.Close()
+		} else {
+			common.DebugError(w.Close())
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		octets += n
+
+		if recompute {
+			manifest[p] = hex.EncodeToString(h.Sum(nil))
+
+			continue
+		}
+
+		if loaded != nil && hex.EncodeToString(*loaded) != bucket.FileHashes[i] {
+			return &ErrObjectCorrupted{Uid: object, Expected: bucket.FileHashes[i], Actual: hex.EncodeToString(*loaded)}
+		}
+
+		manifest[p] = bucket.FileHashes[i]
+	}
+
+	paths := make([]string, 0, len(manifest))
+	for p := range manifest {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	lines := bytes.Buffer{}
+	for _, p := range paths {
+		lines.WriteString(fmt.Sprintf("%s  %s\n", manifest[p], manifestPath(p)))
+	}
+
+	tags := []struct {
+		name string
+		data []byte
+	}{
+		{"bagit.txt", []byte(fmt.Sprintf("BagIt-Version: %s\nTag-File-Character-Encoding: UTF-8\n", BAGIT_VERSION))},
+		{"bag-info.txt", bagInfo(bucket, octets, len(paths))},
+		{"manifest-" + alg + ".txt", lines.Bytes()},
+	}
+
+	tagManifest := bytes.Buffer{}
+
+	for _, tag := range tags {
+		h, err := write(tag.name, tag.data)
+		if common.Error(err) {
+			return err
+		}
+
+		tagManifest.WriteString(fmt.Sprintf("%s  %s\n", h, tag.name))
+	}
+
+	_, err := write("tagmanifest-"+alg+".txt", tagManifest.Bytes())
+
+	return err
+}
+
+// Export writes every bucket as a BagIt package into dir, either as directory or as zip file, and returns their paths
+func Export(handle Handle, uids []string, dir string, options *ExportOptions) ([]string, error) {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+
+	var paths []string
+
+	for _, uid := range uids {
+		bucket, err := loadExportBucket(handle, uid)
+		if common.Error(err) {
+			return paths, err
+		}
+
+		name := bagName(bucket.Uid)
+
+		if !options.Zip {
+			p := filepath.Join(dir, name)
+
+			if common.FileExists(p) {
+				return paths, &ErrObjectAlreadyExists{Uid: p}
+			}
+
+			err := writeBag(handle, bucket, &dirBag{root: p}, options.Hash)
+			if common.Error(err) {
+				common.DebugError(os.RemoveAll(p))
+
+				return paths, err
+			}
+
+			paths = append(paths, p)
+
+			continue
+		}
+
+		p := filepath.Join(dir, name+".zip")
+
+		if common.FileExists(p) {
+			return paths, &ErrObjectAlreadyExists{Uid: p}
+		}
+
+		temp, err := createTemp(p)
+		if common.Error(err) {
+			return paths, err
+		}
+
+		err = func() error {
+			defer discardTemp(temp)
+
+			w := zip.NewWriter(temp)
+
+			err := writeBag(handle, bucket, &zipBag{writer: w, prefix: name}, options.Hash)
+			if common.Error(err) {
+				return err
+			}
+
+			err = w.Close()
+			if common.Error(err) {
+				return err
+			}
+
+			return commitTemp(temp, p)
+		}()
+		if common.Error(err) {
+			return paths, err
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// exportHandler streams the buckets of the path or the uid query parameters as zip with one bag per bucket
+func exportHandler(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return nil
+	}
+
+	uids := r.URL.Query()["uid"]
+	if r.URL.Path != "" {
+		uids = append([]string{r.URL.Path}, uids...)
+	}
+
+	if len(uids) == 0 {
+		return &ErrInvalidUID{r.URL.Path}
+	}
+
+	alg := r.URL.Query().Get("hash")
+	if alg != "" {
+		_, err := hash.New(alg)
+		if err != nil {
+			return &ErrInvalidUID{alg}
+		}
+	}
+
+	return Exec(func(handle Handle) error {
+		var buckets []*models.Bucket
+
+		for _, uid := range uids {
+			bucket, err := loadExportBucket(handle, uid)
+			if common.Error(err) {
+				return err
+			}
+
+			buckets = append(buckets, bucket)
+		}
+
+		name := common.Eval(len(buckets) == 1, bagName(buckets[0].Uid), EXPORT)
+
+		rw.Header().Set("Content-Type", "application/zip")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+
+		w := zip.NewWriter(rw)
+
+		for _, bucket := range buckets {
+			err := writeBag(handle, bucket, &zipBag{writer: w, prefix: bagName(bucket.Uid)}, alg)
+			if common.Error(err) {
+				return err
+			}
+		}
+
+		return w.Close()
+	})
+}
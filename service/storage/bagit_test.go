@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/hash"
+	"github.com/mpetavy/tresor/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBagIt(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	volumePath := filepath.Join(path, "volume")
+
+	err = os.MkdirAll(volumePath, common.DefaultDirMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", volumePath, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha.AddVolume(v)
+
+	bucket := models.NewBucket()
+	bucket.Props["Title"] = "multi\nline"
+	// left over from an import of the bag
+	bucket.Props["Payload-Oxum"] = "1.1"
+
+	pages := []string{"first page", "second page"}
+
+	for i, content := range pages {
+		suid, h, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte(content)), nil)
+		if i > 0 {
+			suid, h, err = sha.Store(NewShaUID(1, 1, fmt.Sprintf("%s.%d", PAGE, i+1)).String(), bytes.NewReader([]byte(content)), nil)
+		}
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		bucket.Uid = uid.withoutObject().String()
+		bucket.FileNames = append(bucket.FileNames, uid.Object)
+		bucket.FileHashes = append(bucket.FileHashes, hex.EncodeToString(*h))
+	}
+
+	dir := filepath.Join(path, "bag")
+
+	err = writeBag(sha, &bucket, &dirBag{root: dir}, "")
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	read := func(name string) string {
+		ba, err := os.ReadFile(filepath.Join(dir, name))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		return string(ba)
+	}
+
+	require.Equal(t, pages[1], read("data/page.2"))
+	require.Equal(t, fmt.Sprintf("%s  data/page.1\n%s  data/page.2\n", bucket.FileHashes[0], bucket.FileHashes[1]), read("manifest-"+hash.MD5+".txt"))
+	require.Contains(t, read("bag-info.txt"), "Payload-Oxum: 21.2\n")
+	require.Equal(t, 1, strings.Count(read("bag-info.txt"), "Payload-Oxum:"), "reserved labels are written once")
+	require.Contains(t, read("bag-info.txt"), "Title: multi line\n")
+
+	for _, line := range strings.Split(strings.TrimSpace(read("tagmanifest-"+hash.MD5+".txt")), "\n") {
+		h, name, _ := strings.Cut(line, "  ")
+
+		digest, _, err := copyDigest(&bytes.Buffer{}, strings.NewReader(read(name)), hash.MD5, nil, false)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, h, hex.EncodeToString(digest.Value), "tag manifest of %s", name)
+	}
+
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+
+	err = writeBag(sha, &bucket, &zipBag{writer: w, prefix: bagName(bucket.Uid)}, hash.SHA256)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	var manifest string
+
+	for _, f := range r.File {
+		if f.Name != bagName(bucket.Uid)+"/manifest-"+hash.SHA256+".txt" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		b := bytes.Buffer{}
+		_, err = b.ReadFrom(rc)
+		common.Error(rc.Close())
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		manifest = b.String()
+	}
+
+	sum := sha256.Sum256([]byte(pages[0]))
+
+	require.Contains(t, manifest, hex.EncodeToString(sum[:])+"  data/page.1\n", "manifest recomputed with stronger hash")
+
+	bucket.FileHashes[0] = strings.Repeat("0", 32)
+
+	err = writeBag(sha, &bucket, &dirBag{root: filepath.Join(path, "corrupted")}, "")
+	require.IsType(t, &ErrObjectCorrupted{}, err, "recorded hash is verified")
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mpetavy/common"
+)
+
+const (
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+var (
+	// incompressibleMimeTypes are stored as they are since compressing them again saves nothing
+	incompressibleMimeTypes = []string{
+		"image/jpeg",
+		"image/png",
+		"image/gif",
+		"image/webp",
+		"image/jp2",
+		"video/*",
+		"audio/mpeg",
+		"application/zip",
+		"application/gzip",
+		"application/x-gzip",
+		"application/zstd",
+		"application/x-bzip2",
+		"application/x-xz",
+		"application/x-7z-compressed",
+		"application/vnd.rar",
+	}
+)
+
+func validateCompression(codec string) error {
+	switch codec {
+	case "", COMPRESSION_GZIP, COMPRESSION_ZSTD:
+		return nil
+	default:
+		return &ErrUnknownCompression{codec}
+	}
+}
+
+func compressible(mimeType string, skip []string) bool {
+	for _, patterns := range [][]string{incompressibleMimeTypes, skip} {
+		for _, pattern := range patterns {
+			if matchMimeType(pattern, mimeType) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// compressing returns a writer which compresses with codec, the reader which delivers the complete source
+// and the codec to record for the object. Content of an incompressible or skipped mime type is passed unchanged.
+func compressing(writer io.Writer, codec string, skip []string, source io.Reader) (io.WriteCloser, io.Reader, string, error) {
+	if codec == "" {
+		return nopWriteCloser{writer}, source, "", nil
+	}
+
+	mimeType, source, err := sniffMimeType(source, "")
+	if common.Error(err) {
+		return nil, nil, "", err
+	}
+
+	if !compressible(mimeType, skip) {
+		return nopWriteCloser{writer}, source, "", nil
+	}
+
+	switch codec {
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(writer), source, codec, nil
+	case COMPRESSION_ZSTD:
+		w, err := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+		if common.Error(err) {
+			return nil, nil, "", err
+		}
+
+		return w, source, codec, nil
+	default:
+		return nil, nil, "", &ErrUnknownCompression{codec}
+	}
+}
+
+// writer returns the writer which compresses and encrypts an object for the volume, the reader which
+// delivers the complete source and the format to record for the object. Closing the writer flushes both.
+func (volume *ShaVolume) writer(dest io.Writer, source io.Reader) (io.WriteCloser, io.Reader, Format, error) {
+	encrypted, encryption, err := encrypting(dest, volume.Encrypt, volume.keys)
+	if common.Error(err) {
+		return nil, nil, Format{}, err
+	}
+
+	compressed, source, codec, err := compressing(encrypted, volume.Compression, volume.CompressSkip, source)
+	if common.Error(err) {
+		return nil, nil, Format{}, err
+	}
+
+	return &chainWriteCloser{compressed, encrypted}, source, Format{Encryption: encryption, Compression: codec}, nil
+}
+
+// formatted tells if the volume encrypts or compresses, so every object on it is stored with a record
+func (volume *ShaVolume) formatted() bool {
+	return volume.Encrypt || volume.Compression != ""
+}
+
+// chainWriteCloser writes to the first writer and closes all writers in order
+type chainWriteCloser struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (w *chainWriteCloser) Close() error {
+	err := w.WriteCloser.Close()
+	if common.Error(err) {
+		return err
+	}
+
+	return w.next.Close()
+}
+
+// decompress returns a reader which delivers the original content of source stored with the recorded
+// codec. Sources which are not compressed are returned as they are.
+func decompress(source io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return io.NopCloser(source), nil
+	case COMPRESSION_GZIP:
+		r, err := gzip.NewReader(source)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		return r, nil
+	case COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(source, zstd.WithDecoderConcurrency(1))
+		if common.Error(err) {
+			return nil, err
+		}
+
+		return d.IOReadCloser(), nil
+	default:
+		return nil, &ErrUnknownCompression{codec}
+	}
+}
+
+// plainReader returns a reader which decrypts and decompresses source stored in format
+func plainReader(source io.Reader, format Format, keys *Keyring) (io.ReadCloser, error) {
+	reader, err := decrypt(source, format.Encryption, keys)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return decompress(reader, format.Compression)
+}
+
+// plainFile returns random access to the original content of file stored in format. Compressed content
+// cannot be accessed randomly, so it is extracted into the extraction cache under key. The extracted content
+// of encrypted objects is kept sealed with the in-memory cache key.
+func plainFile(file io.ReadSeekCloser, size int64, format Format, keys *Keyring, key string) (io.ReadSeekCloser, int64, error) {
+	reader, size, err := decryptSeekable(file, size, format.Encryption, keys)
+	if common.Error(err) {
+		common.DebugError(file.Close())
+
+		return nil, -1, err
+	}
+
+	if format.Compression == "" {
+		return &readSeekCloser{reader, file}, size, nil
+	}
+
+	defer func() {
+		common.DebugError(file.Close())
+	}()
+
+	var sealed *Keyring
+
+	if format.Encryption != "" {
+		sealed, err = cacheKeyring()
+		if common.Error(err) {
+			return nil, -1, err
+		}
+	}
+
+	extracted, err := unzips.open(key, func() (io.ReadCloser, error) {
+		plain, err := decompress(reader, format.Compression)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if sealed == nil {
+			return plain, nil
+		}
+
+		return sealing(plain, sealed), nil
+	})
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	fi, err := extracted.Stat()
+	if common.Error(err) {
+		common.DebugError(extracted.Close())
+
+		return nil, -1, err
+	}
+
+	if sealed == nil {
+		return extracted, fi.Size(), nil
+	}
+
+	unsealed, size, err := decryptSeekable(extracted, fi.Size(), ENCRYPTION_AES_GCM, sealed)
+	if common.Error(err) {
+		common.DebugError(extracted.Close())
+
+		return nil, -1, err
+	}
+
+	return &readSeekCloser{unsealed, extracted}, size, nil
+}
+
+// plainFileKey names the extracted content of a file in the extraction cache
+func plainFileKey(path string, fi os.FileInfo) string {
+	return path + "|" + fi.ModTime().String() + "|" + strconv.FormatInt(fi.Size(), 10)
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	text := []byte(strings.Repeat("DICOM and TIFF compress well. ", 10000))
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{0}, 1000)...)
+
+	unzips.acquire()
+	defer unzips.release()
+
+	for _, codec := range []string{COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		for _, zip := range []bool{false, true} {
+			path, err := common.CreateTempDir()
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+			defer func() {
+				common.Error(os.RemoveAll(path))
+			}()
+
+			sha, err := NewSha()
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			v, err := NewShaVolume("test", path, false, zip)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			v.Compression = codec
+
+			sha.AddVolume(v)
+
+			for _, content := range [][]byte{text, jpeg} {
+				suid, h, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(content), &Options{VolumeName: "test"})
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				sum := md5.Sum(content)
+
+				require.Equal(t, sum[:], *h, "digest of original content")
+
+				uid, err := ParseShaUID(suid)
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				if !zip {
+					p, err := locate(v, uid)
+					if common.Error(err) {
+						t.Fatal(err)
+					}
+
+					ba, err := os.ReadFile(p)
+					if common.Error(err) {
+						t.Fatal(err)
+					}
+
+					rec, err := readRecordFile(p+DIGEST_SUFFIX, true)
+					if common.Error(err) {
+						t.Fatal(err)
+					}
+
+					compressed := rec.format.Compression == codec
+
+					require.Equal(t, !bytes.Equal(content, jpeg), compressed, "%s compressed unless incompressible", codec)
+					require.True(t, !compressed || len(ba) < len(content)/10, "%s saves space", codec)
+				}
+
+				buf := bytes.Buffer{}
+
+				_, _, _, err = sha.Load(suid, &buf, &Options{Verify: true})
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				require.Equal(t, content, buf.Bytes(), "load decompresses")
+
+				f, info, err := sha.Open(suid, nil)
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				require.Equal(t, int64(len(content)), info.Size, "original size")
+
+				_, err = f.Seek(100, io.SeekStart)
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				ba, err := io.ReadAll(f)
+				if common.Error(err) {
+					t.Fatal(err)
+				}
+
+				common.Error(f.Close())
+
+				require.Equal(t, content[100:], ba, "open decompresses")
+			}
+		}
+	}
+}
+
+func TestIndexCompressed(t *testing.T) {
+	defer startMemoryServices(t)()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Compression = COMPRESSION_ZSTD
+
+	sha.AddVolume(v)
+
+	pdf := []byte("%PDF-1.4\n" + strings.Repeat("1 0 obj << /Type /Page >> endobj\n", 1000))
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(pdf), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	p, err := locate(v, uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := os.ReadFile(p)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Less(t, len(ba), len(pdf), "stored compressed")
+
+	_, n, ir, err := indexObject(sha, suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, int64(len(pdf)), n)
+	require.Equal(t, common.MimetypeApplicationPdf.MimeType, ir.MimeType, "mime type of the decompressed content")
+}
+
+func TestPlainMagic(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	for _, dir := range []string{"fs", "sha-false", "sha-true"} {
+		err = os.MkdirAll(filepath.Join(path, dir), common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := NewFs()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fv, err := NewFsVolume("test", filepath.Join(path, "fs"))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fs.AddVolume(fv)
+
+	for _, content := range [][]byte{[]byte(ENCRYPTION_MAGIC + "\x02k1 plain content"), []byte("TRESOR-COMPRESS1\x04zstd plain content")} {
+		storages := map[string]Handle{"fs": fs}
+
+		for _, zip := range []bool{false, true} {
+			sha, err := NewSha()
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			v, err := NewShaVolume("test", filepath.Join(path, fmt.Sprintf("sha-%v", zip)), false, zip)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			sha.AddVolume(v)
+
+			storages[fmt.Sprintf("sha zip=%v", zip)] = sha
+		}
+
+		for name, storage := range storages {
+			suid := NewShaUID(0, 0, PAGE+".1").String()
+			if name == "fs" {
+				suid = fmt.Sprintf("docs/%d.txt", len(content))
+			}
+
+			suid, _, err := storage.Store(suid, bytes.NewReader(content), nil)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			buf := bytes.Buffer{}
+
+			_, _, _, err = storage.Load(suid, &buf, &Options{Verify: true})
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, content, buf.Bytes(), "%s: plain content loads unchanged", name)
+
+			f, info, err := storage.Open(suid, nil)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			ba, err := io.ReadAll(f)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			common.Error(f.Close())
+
+			require.Equal(t, int64(len(content)), info.Size, "%s: plain size", name)
+			require.Equal(t, content, ba, "%s: plain content opens unchanged", name)
+		}
+	}
+}
+
+func TestMissingRecord(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Compression = COMPRESSION_ZSTD
+
+	sha.AddVolume(v)
+
+	content := []byte(strings.Repeat("compressible ", 1000))
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(content), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	p, err := locate(v, uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	// a crash after the record was written leaves a record without its object
+	err = os.Remove(p)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, err = sha.Store(suid, bytes.NewReader(content), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+
+	_, _, _, err = sha.Load(suid, &buf, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, content, buf.Bytes(), "store retried")
+
+	// an object without its record is never served as plain content
+	err = os.Remove(p + DIGEST_SUFFIX)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = sha.Load(suid, io.Discard, nil)
+	_, ok := err.(*ErrObjectCorrupted)
+	require.True(t, ok, "load of an object without record")
+
+	_, _, err = sha.Open(suid, nil)
+	_, ok = err.(*ErrObjectCorrupted)
+	require.True(t, ok, "open of an object without record")
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/hash"
+)
+
+const (
+	// DIGEST_SUFFIX names the record file of an object, the sidecar next to a Sha object or the file below META_DIR
+	// of a Fs object
+	DIGEST_SUFFIX = ".digest"
+	// ZIP_MANIFEST names the entry of a zip container which holds the records of all other entries
+	ZIP_MANIFEST = META_DIR + "/manifest"
+	DEFAULT_HASH  = hash.MD5
+)
+
+type Digest struct {
+	Algorithm string
+	Value     []byte
+}
+
+func (d *Digest) String() string {
+	return d.Algorithm + ":" + hex.EncodeToString(d.Value)
+}
+
+func ParseDigest(s string) (*Digest, error) {
+	alg, value, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return nil, &hash.ErrUnknownHash{Algorithm: s}
+	}
+
+	_, err := hash.New(alg)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	ba, err := hex.DecodeString(value)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &Digest{Algorithm: alg, Value: ba}, nil
+}
+
+func isDigestSidecar(path string) bool {
+	return strings.HasSuffix(path, DIGEST_SUFFIX)
+}
+
+func hashAlgorithm(alg string) string {
+	return common.Eval(alg != "", alg, DEFAULT_HASH)
+}
+
+// Format records how an object is stored. The zero value stands for the plain content.
+type Format struct {
+	Encryption  string
+	Compression string
+}
+
+// record is kept for every object in its digest sidecar or in the manifest of its zip container. It holds
+// the digest of the original content and the format, e.g. "md5:<hex> encryption=aes-gcm-1 compression=zstd".
+type record struct {
+	digest *Digest
+	format Format
+}
+
+func (r *record) String() string {
+	sb := strings.Builder{}
+
+	sb.WriteString(r.digest.String())
+
+	if r.format.Encryption != "" {
+		sb.WriteString(" encryption=")
+		sb.WriteString(r.format.Encryption)
+	}
+
+	if r.format.Compression != "" {
+		sb.WriteString(" compression=")
+		sb.WriteString(r.format.Compression)
+	}
+
+	return sb.String()
+}
+
+func parseRecord(s string) (*record, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, &hash.ErrUnknownHash{Algorithm: s}
+	}
+
+	digest, err := ParseDigest(fields[0])
+	if common.Error(err) {
+		return nil, err
+	}
+
+	r := &record{digest: digest}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+
+		switch key {
+		case "encryption":
+			r.format.Encryption = value
+		case "compression":
+			r.format.Compression = value
+		}
+	}
+
+	return r, nil
+}
+
+func writeRecordFile(file string, r *record) error {
+	return writeFileAtomic(file, []byte(r.String()))
+}
+
+// commitObject writes the record file of an object before it renames the temp file into place, so a crash never
+// leaves an object without its record. The record is removed again if the object cannot be committed.
+func commitObject(temp *os.File, path string, file string, r *record) error {
+	err := writeRecordFile(file, r)
+	if common.Error(err) {
+		return err
+	}
+
+	err = commitTemp(temp, path)
+	if common.Error(err) {
+		common.DebugError(os.Remove(file))
+
+		return err
+	}
+
+	return nil
+}
+
+// missingRecord returns the record of an object stored without one. Such objects are plain, unless the
+// volume encrypts or compresses and so writes a record for every object before the object itself.
+func missingRecord(formatted bool) (*record, error) {
+	if formatted {
+		return nil, &ErrObjectCorrupted{Expected: "record", Actual: "none"}
+	}
+
+	return &record{}, nil
+}
+
+// readRecordFile returns the record kept in file, formatted tells if the volume encrypts or compresses
+func readRecordFile(file string, formatted bool) (*record, error) {
+	ba, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return missingRecord(formatted)
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return parseRecord(string(ba))
+}
+
+// zipRecords holds the records of all entries of a zip container
+type zipRecords map[string]*record
+
+// get returns the record of the entry name, formatted tells if the volume encrypts or compresses
+func (records zipRecords) get(name string, formatted bool) (*record, error) {
+	if r, ok := records[name]; ok {
+		return r, nil
+	}
+
+	return missingRecord(formatted)
+}
+
+// formatZipManifest records all entries of a zip container, one "<entry> <record>" per line
+func formatZipManifest(records zipRecords) string {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteString(" ")
+		sb.WriteString(records[name].String())
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func parseZipManifest(manifest string) zipRecords {
+	records := make(zipRecords)
+
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		r, err := parseRecord(value)
+		if err != nil {
+			continue
+		}
+
+		records[name] = r
+	}
+
+	return records
+}
+
+// copyDigest copies source to dest and hashes the stream. If expected is given the stream is hashed
+// with its algorithm and verified against it if verify is set. The content has already been passed to
+// dest when a corruption is detected, so callers must discard dest on ErrObjectCorrupted.
+func copyDigest(dest io.Writer, source io.Reader, alg string, expected *Digest, verify bool) (*Digest, int64, error) {
+	if expected != nil {
+		alg = expected.Algorithm
+	}
+
+	h, err := hash.New(hashAlgorithm(alg))
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	n, err := io.Copy(io.MultiWriter(dest, h), source)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	digest := &Digest{Algorithm: hashAlgorithm(alg), Value: h.Sum(nil)}
+
+	if verify && expected != nil && !bytes.Equal(expected.Value, digest.Value) {
+		return digest, n, &ErrObjectCorrupted{Expected: expected.String(), Actual: digest.String()}
+	}
+
+	return digest, n, nil
+}
+
+// objectError completes the volume and uid of the errors raised while reading an object
+func objectError(err error, volume string, uid string) error {
+	switch e := err.(type) {
+	case *ErrObjectCorrupted:
+		e.Volume = volume
+		e.Uid = uid
+	case *ErrDecryptionFailed:
+		e.Volume = volume
+		e.Uid = uid
+	}
+
+	return err
+}
+
+func isCorrupted(err error) bool {
+	switch err.(type) {
+	case *ErrObjectCorrupted, *ErrDecryptionFailed:
+		return true
+	default:
+		return false
+	}
+}
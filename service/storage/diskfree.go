@@ -0,0 +1,19 @@
+//go:build !windows
+
+package storage
+
+import (
+	"syscall"
+)
+
+// diskFree returns the bytes available to unprivileged users on the file system of path
+func diskFree(path string) (int64, error) {
+	stat := syscall.Statfs_t{}
+
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return -1, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// diskFree returns the bytes available to the calling user on the volume of path
+func diskFree(path string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	var free uint64
+
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	return int64(free), nil
+}
@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	// ENCRYPTION_AES_GCM is recorded as the format of objects encrypted in frames with AES-GCM
+	ENCRYPTION_AES_GCM = "aes-gcm-1"
+	// ENCRYPTION_MAGIC starts every encrypted object, followed by the key id and the nonce prefix
+	ENCRYPTION_MAGIC = "TRESOR-AES-GCM-1"
+	// ENCRYPTION_CHUNK is the plaintext size of a frame, every frame is sealed on its own
+	ENCRYPTION_CHUNK = 64 * 1024
+
+	encryptionNoncePrefix = 8
+)
+
+var (
+	// cacheKeys seals the content of encrypted objects in the extraction cache. The key only lives in memory,
+	// so the cache never holds readable content of encrypted objects.
+	cacheKeys   *Keyring
+	cacheKeysMu sync.Mutex
+)
+
+type Key struct {
+	Id    string
+	Value []byte
+}
+
+// Keyring holds all keys of a key file. New objects are encrypted with the current key, objects
+// encrypted with a previous key remain readable as long as the key stays in the file.
+type Keyring struct {
+	keys    map[string]*Key
+	current *Key
+}
+
+// frameCipher seals and opens the frames of a single object. Every frame is bound to the object header,
+// to its position and to whether it is the final frame, so frames can be neither swapped nor cut off.
+type frameCipher struct {
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+}
+
+type encryptWriter struct {
+	writer io.Writer
+	cipher *frameCipher
+	buf    []byte
+	frame  int64
+}
+
+type decryptReader struct {
+	reader *bufio.Reader
+	cipher *frameCipher
+	buf    []byte
+	plain  []byte
+	frame  int64
+	done   bool
+}
+
+type decryptSeeker struct {
+	source io.ReadSeeker
+	cipher *frameCipher
+	offset int64
+	frames int64
+	size   int64
+	pos    int64
+	frame  int64
+	buf    []byte
+	plain  []byte
+}
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// LoadKeyring reads a key file with one "<key id> <hex encoded AES key>" per line. Empty lines and
+// lines starting with # are ignored. The last key becomes the current key.
+func LoadKeyring(path string) (*Keyring, error) {
+	ba, err := os.ReadFile(path)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	keyring := &Keyring{keys: make(map[string]*Key)}
+
+	for i, line := range strings.Split(string(ba), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > math.MaxUint8 {
+			return nil, &ErrInvalidKeyFile{Path: path, Line: i + 1}
+		}
+
+		value, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, &ErrInvalidKeyFile{Path: path, Line: i + 1}
+		}
+
+		_, err = aes.NewCipher(value)
+		if err != nil {
+			return nil, &ErrInvalidKeyFile{Path: path, Line: i + 1}
+		}
+
+		key := &Key{Id: fields[0], Value: value}
+
+		keyring.keys[key.Id] = key
+		keyring.current = key
+	}
+
+	if keyring.current == nil {
+		return nil, &ErrInvalidKeyFile{Path: path}
+	}
+
+	return keyring, nil
+}
+
+// loadKeys loads the key file of the configuration or returns nil if none is defined
+func loadKeys(cfg *Cfg) (*Keyring, error) {
+	if cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	return LoadKeyring(common.CleanPath(cfg.KeyFile))
+}
+
+func (keyring *Keyring) key(id string) (*Key, error) {
+	if keyring != nil {
+		if key, ok := keyring.keys[id]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, &ErrUnknownKey{id}
+}
+
+func newFrameCipher(key *Key, header []byte, prefix []byte) (*frameCipher, error) {
+	block, err := aes.NewCipher(key.Value)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &frameCipher{aead: aead, header: header, prefix: prefix}, nil
+}
+
+func (c *frameCipher) params(frame int64, final bool) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNoncePrefix:], uint32(frame))
+
+	ad := append(append(make([]byte, 0, len(c.header)+1), c.header...), common.Eval(final, byte(1), byte(0)))
+
+	return nonce, ad
+}
+
+func (c *frameCipher) seal(frame int64, final bool, plain []byte) ([]byte, error) {
+	if frame > math.MaxUint32 {
+		return nil, &ErrEncryptionFailed{Frame: frame}
+	}
+
+	nonce, ad := c.params(frame, final)
+
+	return c.aead.Seal(nil, nonce, plain, ad), nil
+}
+
+func (c *frameCipher) open(frame int64, final bool, sealed []byte) ([]byte, error) {
+	nonce, ad := c.params(frame, final)
+
+	plain, err := c.aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, &ErrDecryptionFailed{Frame: frame}
+	}
+
+	return plain, nil
+}
+
+func frameSize(c *frameCipher) int64 {
+	return int64(ENCRYPTION_CHUNK + c.aead.Overhead())
+}
+
+// newEncryptWriter writes the object header to writer and encrypts everything written afterwards with key.
+// Close must be called to write the final frame.
+func newEncryptWriter(writer io.Writer, key *Key) (*encryptWriter, error) {
+	prefix := make([]byte, encryptionNoncePrefix)
+
+	_, err := rand.Read(prefix)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	header := bytes.Buffer{}
+	header.WriteString(ENCRYPTION_MAGIC)
+	header.WriteByte(byte(len(key.Id)))
+	header.WriteString(key.Id)
+	header.Write(prefix)
+
+	c, err := newFrameCipher(key, header.Bytes(), prefix)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	_, err = writer.Write(header.Bytes())
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &encryptWriter{writer: writer, cipher: c}, nil
+}
+
+// encrypting returns a writer which encrypts with the current key if encrypt is set and the encryption
+// to record for the object
+func encrypting(writer io.Writer, encrypt bool, keys *Keyring) (io.WriteCloser, string, error) {
+	if !encrypt {
+		return nopWriteCloser{writer}, "", nil
+	}
+
+	if keys == nil {
+		return nil, "", &ErrNoEncryptionKey{}
+	}
+
+	w, err := newEncryptWriter(writer, keys.current)
+	if common.Error(err) {
+		return nil, "", err
+	}
+
+	return w, ENCRYPTION_AES_GCM, nil
+}
+
+// sealing returns a reader which delivers source encrypted with the current key, source is closed once read
+func sealing(source io.ReadCloser, keys *Keyring) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		defer func() {
+			common.DebugError(source.Close())
+		}()
+
+		w, err := newEncryptWriter(writer, keys.current)
+		if err == nil {
+			_, err = io.Copy(w, source)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+
+		common.DebugError(writer.CloseWithError(err))
+	}()
+
+	return reader
+}
+
+// cacheKeyring returns the keyring the extraction cache seals the content of encrypted objects with
+func cacheKeyring() (*Keyring, error) {
+	cacheKeysMu.Lock()
+	defer cacheKeysMu.Unlock()
+
+	if cacheKeys == nil {
+		value := make([]byte, 32)
+
+		_, err := rand.Read(value)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		key := &Key{Id: "cache", Value: value}
+
+		cacheKeys = &Keyring{keys: map[string]*Key{key.Id: key}, current: key}
+	}
+
+	return cacheKeys, nil
+}
+
+func (w *encryptWriter) seal(plain []byte, final bool) error {
+	sealed, err := w.cipher.seal(w.frame, final, plain)
+	if common.Error(err) {
+		return err
+	}
+
+	_, err = w.writer.Write(sealed)
+	if common.Error(err) {
+		return err
+	}
+
+	w.frame++
+
+	return nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	// a full chunk is kept back so the final frame is never empty unless the object is
+	for len(w.buf) > ENCRYPTION_CHUNK {
+		err := w.seal(w.buf[:ENCRYPTION_CHUNK], false)
+		if err != nil {
+			return 0, err
+		}
+
+		w.buf = append(w.buf[:0], w.buf[ENCRYPTION_CHUNK:]...)
+	}
+
+	return len(p), nil
+}
+
+// Close writes the final frame, the underlying writer is not closed
+func (w *encryptWriter) Close() error {
+	err := w.seal(w.buf, true)
+
+	w.buf = nil
+
+	return err
+}
+
+func validateEncryption(encryption string) error {
+	switch encryption {
+	case "", ENCRYPTION_AES_GCM:
+		return nil
+	default:
+		return &ErrUnknownEncryption{encryption}
+	}
+}
+
+// readEncryptionHeader reads the object header with the key id and the nonce prefix
+func readEncryptionHeader(reader io.Reader, keys *Keyring) (*frameCipher, error) {
+	magic := make([]byte, len(ENCRYPTION_MAGIC))
+
+	_, err := io.ReadFull(reader, magic)
+	if err != nil || string(magic) != ENCRYPTION_MAGIC {
+		return nil, &ErrDecryptionFailed{}
+	}
+
+	l := make([]byte, 1)
+
+	_, err = io.ReadFull(reader, l)
+	if err != nil {
+		return nil, &ErrDecryptionFailed{}
+	}
+
+	rest := make([]byte, int(l[0])+encryptionNoncePrefix)
+
+	_, err = io.ReadFull(reader, rest)
+	if err != nil {
+		return nil, &ErrDecryptionFailed{}
+	}
+
+	key, err := keys.key(string(rest[:l[0]]))
+	if common.Error(err) {
+		return nil, err
+	}
+
+	header := append(append([]byte(ENCRYPTION_MAGIC), l...), rest...)
+
+	return newFrameCipher(key, header, rest[l[0]:])
+}
+
+// decrypt returns a reader which delivers the plaintext of source stored with the recorded encryption.
+// Sources which are not encrypted are returned as they are.
+func decrypt(source io.Reader, encryption string, keys *Keyring) (io.Reader, error) {
+	err := validateEncryption(encryption)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if encryption == "" {
+		return source, nil
+	}
+
+	reader := bufio.NewReaderSize(source, ENCRYPTION_CHUNK)
+
+	c, err := readEncryptionHeader(reader, keys)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &decryptReader{reader: reader, cipher: c, buf: make([]byte, frameSize(c))}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.reader, r.buf)
+
+		final := false
+
+		switch err {
+		case nil:
+			_, err = r.reader.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+
+			final = err == io.EOF
+		case io.EOF, io.ErrUnexpectedEOF:
+			final = true
+		default:
+			return 0, err
+		}
+
+		r.plain, err = r.cipher.open(r.frame, final, r.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+
+		r.frame++
+		r.done = final
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+// decryptSeekable returns a reader with random access to the plaintext of source and the plaintext size.
+// Only the frame holding the current position is decrypted. Sources which are not encrypted are
+// returned as they are.
+func decryptSeekable(source io.ReadSeeker, size int64, encryption string, keys *Keyring) (io.ReadSeeker, int64, error) {
+	err := validateEncryption(encryption)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	if encryption == "" {
+		return source, size, nil
+	}
+
+	c, err := readEncryptionHeader(source, keys)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	offset := int64(len(c.header))
+	body := size - offset
+	frames := (body + frameSize(c) - 1) / frameSize(c)
+
+	if frames == 0 || body-(frames-1)*frameSize(c) < int64(c.aead.Overhead()) {
+		return nil, -1, &ErrDecryptionFailed{Frame: frames}
+	}
+
+	plain := body - frames*int64(c.aead.Overhead())
+
+	return &decryptSeeker{source: source, cipher: c, offset: offset, frames: frames, size: plain, frame: -1, buf: make([]byte, frameSize(c))}, plain, nil
+}
+
+func (r *decryptSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	frame := r.pos / ENCRYPTION_CHUNK
+
+	if frame != r.frame {
+		_, err := r.source.Seek(r.offset+frame*frameSize(r.cipher), io.SeekStart)
+		if common.Error(err) {
+			return 0, err
+		}
+
+		n, err := io.ReadFull(r.source, r.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			common.Error(err)
+
+			return 0, err
+		}
+
+		r.plain, err = r.cipher.open(frame, frame == r.frames-1, r.buf[:n])
+		if err != nil {
+			return 0, err
+		}
+
+		r.frame = frame
+	}
+
+	start := r.pos - frame*ENCRYPTION_CHUNK
+	if start >= int64(len(r.plain)) {
+		return 0, &ErrDecryptionFailed{Frame: frame}
+	}
+
+	n := copy(p, r.plain[start:])
+	r.pos += int64(n)
+
+	return n, nil
+}
+
+func (r *decryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+
+	if offset < 0 {
+		return r.pos, os.ErrInvalid
+	}
+
+	r.pos = offset
+
+	return r.pos, nil
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptBytes(t *testing.T, key *Key, plain []byte) []byte {
+	buf := bytes.Buffer{}
+
+	w, err := newEncryptWriter(&buf, key)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, err = io.Copy(w, bytes.NewReader(plain))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestEncryption(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	keyFile := filepath.Join(path, "keys")
+
+	err = os.WriteFile(keyFile, []byte("# keys\nk1 "+string(bytes.Repeat([]byte("01"), 32))+"\n"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	old, err := LoadKeyring(keyFile)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(keyFile, []byte("k1 "+string(bytes.Repeat([]byte("01"), 32))+"\nk2 "+string(bytes.Repeat([]byte("02"), 32))+"\n"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeyring(keyFile)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "k2", keys.current.Id, "last key is current")
+
+	for _, size := range []int{0, 1, ENCRYPTION_CHUNK, ENCRYPTION_CHUNK + 1, 3*ENCRYPTION_CHUNK + 5} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i)
+		}
+
+		sealed := encryptBytes(t, old.current, plain)
+
+		require.False(t, size > 16 && bytes.Contains(sealed, plain[:16]), "plaintext not visible")
+
+		reader, err := decrypt(bytes.NewReader(sealed), ENCRYPTION_AES_GCM, keys)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		ba, err := io.ReadAll(reader)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, plain, ba, "rotated key decrypts, size %d", size)
+
+		seeker, n, err := decryptSeekable(bytes.NewReader(sealed), int64(len(sealed)), ENCRYPTION_AES_GCM, keys)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, int64(size), n, "plaintext size")
+
+		if size > 1 {
+			_, err = seeker.Seek(int64(size/2), io.SeekStart)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			ba, err = io.ReadAll(seeker)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, plain[size/2:], ba, "random access")
+		}
+
+		tampered := bytes.Clone(sealed)
+		tampered[len(tampered)-1] ^= 1
+
+		reader, err = decrypt(bytes.NewReader(tampered), ENCRYPTION_AES_GCM, keys)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		_, err = io.ReadAll(reader)
+		_, ok := err.(*ErrDecryptionFailed)
+		require.True(t, ok, "tampered frame detected, size %d", size)
+
+		if size > ENCRYPTION_CHUNK {
+			header := len(ENCRYPTION_MAGIC) + 1 + len(old.current.Id) + encryptionNoncePrefix
+			last := (len(sealed) - header) % (ENCRYPTION_CHUNK + 16)
+
+			reader, err = decrypt(bytes.NewReader(sealed[:len(sealed)-last]), ENCRYPTION_AES_GCM, keys)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			_, err = io.ReadAll(reader)
+			_, ok = err.(*ErrDecryptionFailed)
+			require.True(t, ok, "truncation detected, size %d", size)
+		}
+	}
+
+	plain := []byte("plain object")
+
+	reader, err := decrypt(bytes.NewReader(plain), "", keys)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, plain, ba, "unencrypted objects pass")
+
+	_, err = decrypt(bytes.NewReader(encryptBytes(t, keys.current, plain)), ENCRYPTION_AES_GCM, old)
+	_, ok := err.(*ErrUnknownKey)
+	require.True(t, ok, "unknown key detected")
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Encrypt = true
+	v.keys = keys
+
+	sha.AddVolume(v)
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), &Options{VolumeName: "test"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, p, err := sha.find(NewShaUID(1, 1, PAGE+".1"), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err = os.ReadFile(p)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.False(t, bytes.Contains(ba, []byte("Hello world!")), "stored encrypted")
+
+	buf := bytes.Buffer{}
+
+	_, _, _, err = sha.Load(suid, &buf, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "Hello world!", buf.String(), "load decrypts")
+
+	f, info, err := sha.Open(suid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(f.Close())
+	}()
+
+	require.Equal(t, int64(12), info.Size, "plaintext size")
+
+	_, err = f.Seek(6, io.SeekStart)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err = io.ReadAll(f)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "world!", string(ba), "open decrypts")
+}
+
+func TestIndexEncrypted(t *testing.T) {
+	defer startMemoryServices(t)()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	keyFile := filepath.Join(path, "keys")
+
+	err = os.WriteFile(keyFile, []byte("k1 "+string(bytes.Repeat([]byte("01"), 32))+"\n"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeyring(keyFile)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	volumePath := filepath.Join(path, "volume")
+
+	err = os.MkdirAll(volumePath, common.DefaultDirMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sv, err := NewShaVolume("test", volumePath, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sv.Encrypt = true
+	sv.keys = keys
+
+	sha.AddVolume(sv)
+
+	fs, err := NewFs()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fv, err := NewFsVolume("test", volumePath)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fv.Encrypt = true
+	fv.keys = keys
+
+	fs.AddVolume(fv)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(png), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, ir, err := indexObject(sha, suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "image/png", ir.MimeType, "mime type of the decrypted content")
+
+	fuid, _, err := fs.Store("docs/hello.txt", bytes.NewReader([]byte("Hello world!")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, ir, err = indexObject(fs, fuid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "Hello world!", ir.Fulltext, "fulltext of the decrypted content")
+}
+
+func TestEncryptedCache(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	keyFile := filepath.Join(path, "keys")
+
+	err = os.WriteFile(keyFile, []byte("k1 "+string(bytes.Repeat([]byte("01"), 32))+"\n"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeyring(keyFile)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	content := []byte(strings.Repeat("confidential ", 10000))
+
+	for _, zip := range []bool{false, true} {
+		volumePath := filepath.Join(path, fmt.Sprintf("zip-%v", zip))
+
+		err = os.MkdirAll(volumePath, common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", volumePath, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v.Encrypt = true
+		v.Compression = COMPRESSION_ZSTD
+		v.keys = keys
+
+		sha.AddVolume(v)
+
+		suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(content), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		f, info, err := sha.Open(suid, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, int64(len(content)), info.Size, "plaintext size")
+
+		_, err = f.Seek(100, io.SeekStart)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		ba, err := io.ReadAll(f)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		common.Error(f.Close())
+
+		require.Equal(t, content[100:], ba, "open decrypts and decompresses")
+
+		err = filepath.WalkDir(unzips.dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			ba, err := os.ReadFile(p)
+			if common.Error(err) {
+				return err
+			}
+
+			require.False(t, bytes.Contains(ba, []byte("confidential")), "no plaintext cached in %s", p)
+
+			return nil
+		})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+}
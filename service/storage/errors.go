@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mpetavy/common"
 )
@@ -57,3 +58,222 @@ func (e *ErrObjectNotFound) Error() string {
 	uid := common.Eval(e.Uid != "", e.Uid, "??")
 	return fmt.Sprintf("Object not found: ShaVolume %s, Value %v", e.Volume, uid)
 }
+
+type ErrS3Request struct {
+	Volume  string
+	Key     string
+	Status  string
+	Message string
+}
+
+func (e *ErrS3Request) Error() string {
+	return fmt.Sprintf("S3 request failed: S3Volume %s, Key %s, Status %s: %s", e.Volume, e.Key, e.Status, e.Message)
+}
+
+type ErrVolumeLocked struct {
+	Volume string
+	Path   string
+}
+
+func (e *ErrVolumeLocked) Error() string {
+	return fmt.Sprintf("Volume lock could not be acquired: ShaVolume %s, Path %s", e.Volume, e.Path)
+}
+
+type ErrObjectCorrupted struct {
+	Volume   string
+	Uid      string
+	Expected string
+	Actual   string
+}
+
+func (e *ErrObjectCorrupted) Error() string {
+	return fmt.Sprintf("Object corrupted: ShaVolume %s, Value %v, expected digest %s, actual digest %s", e.Volume, e.Uid, e.Expected, e.Actual)
+}
+
+type ErrFixityRunning struct {
+}
+
+func (e *ErrFixityRunning) Error() string {
+	return fmt.Sprintf("Fixity check is already running")
+}
+
+type ErrRebuildRunning struct {
+}
+
+func (e *ErrRebuildRunning) Error() string {
+	return fmt.Sprintf("Rebuild is already running")
+}
+
+type ErrVolumeReadOnly struct {
+	Volume string
+}
+
+func (e *ErrVolumeReadOnly) Error() string {
+	return fmt.Sprintf("Volume is read-only: %s", e.Volume)
+}
+
+type ErrNoVolumeAvailable struct {
+	MimeType string
+}
+
+func (e *ErrNoVolumeAvailable) Error() string {
+	return fmt.Sprintf("No writable volume with free capacity available for mime type %s", e.MimeType)
+}
+
+type ErrInvalidPlacementStrategy struct {
+	Strategy string
+}
+
+func (e *ErrInvalidPlacementStrategy) Error() string {
+	return fmt.Sprintf("Invalid placement strategy: %s", e.Strategy)
+}
+
+type ErrInvalidQuorum struct {
+	Volume string
+	Quorum int
+}
+
+func (e *ErrInvalidQuorum) Error() string {
+	return fmt.Sprintf("Invalid quorum: ShaVolume %s, Quorum %d", e.Volume, e.Quorum)
+}
+
+type ErrQuorumNotReached struct {
+	Uid      string
+	Required int
+	Reached  int
+}
+
+func (e *ErrQuorumNotReached) Error() string {
+	return fmt.Sprintf("Quorum not reached: Value %s, required %d copies, reached %d", e.Uid, e.Required, e.Reached)
+}
+
+type ErrNotSupported struct {
+	Driver    string
+	Operation string
+}
+
+func (e *ErrNotSupported) Error() string {
+	return fmt.Sprintf("Operation %s is not supported by driver %s", e.Operation, e.Driver)
+}
+
+type ErrInvalidKeyFile struct {
+	Path string
+	Line int
+}
+
+func (e *ErrInvalidKeyFile) Error() string {
+	return fmt.Sprintf("Invalid key file: %s, line %d", e.Path, e.Line)
+}
+
+type ErrUnknownKey struct {
+	Id string
+}
+
+func (e *ErrUnknownKey) Error() string {
+	return fmt.Sprintf("Unknown encryption key: %s", e.Id)
+}
+
+type ErrNoEncryptionKey struct {
+	Volume string
+}
+
+func (e *ErrNoEncryptionKey) Error() string {
+	return fmt.Sprintf("Volume is encrypted but no key file is defined: %s", e.Volume)
+}
+
+type ErrEncryptionFailed struct {
+	Frame int64
+}
+
+func (e *ErrEncryptionFailed) Error() string {
+	return fmt.Sprintf("Encryption failed at frame %d", e.Frame)
+}
+
+type ErrDecryptionFailed struct {
+	Volume string
+	Uid    string
+	Frame  int64
+}
+
+func (e *ErrDecryptionFailed) Error() string {
+	return fmt.Sprintf("Decryption failed: ShaVolume %s, Value %v, frame %d", e.Volume, e.Uid, e.Frame)
+}
+
+type ErrUnknownCompression struct {
+	Codec string
+}
+
+func (e *ErrUnknownCompression) Error() string {
+	return fmt.Sprintf("Unknown compression codec: %s", e.Codec)
+}
+
+type ErrUnknownEncryption struct {
+	Encryption string
+}
+
+func (e *ErrUnknownEncryption) Error() string {
+	return fmt.Sprintf("Unknown encryption: %s", e.Encryption)
+}
+
+type ErrTransactionClosed struct {
+	Uid string
+}
+
+func (e *ErrTransactionClosed) Error() string {
+	return fmt.Sprintf("Transaction already committed or aborted: %s", e.Uid)
+}
+
+type ErrInvalidWatchMode struct {
+	Volume string
+	Mode   string
+}
+
+func (e *ErrInvalidWatchMode) Error() string {
+	return fmt.Sprintf("Invalid watch mode %s of volume %s", e.Mode, e.Volume)
+}
+
+type ErrRetentionActive struct {
+	Volume string
+	Uid    string
+	Until  time.Time
+}
+
+func (e *ErrRetentionActive) Error() string {
+	return fmt.Sprintf("Retention of %s on volume %s active until %s", e.Uid, e.Volume, e.Until.Format(time.RFC3339))
+}
+
+type ErrLegalHold struct {
+	Volume string
+	Uid    string
+}
+
+func (e *ErrLegalHold) Error() string {
+	return fmt.Sprintf("Legal hold on %s on volume %s", e.Uid, e.Volume)
+}
+
+type ErrRetentionShortened struct {
+	Uid   string
+	Until time.Time
+}
+
+func (e *ErrRetentionShortened) Error() string {
+	return fmt.Sprintf("Retention of %s cannot be shortened before %s", e.Uid, e.Until.Format(time.RFC3339))
+}
+
+type ErrUnsafePath struct {
+	Uid    string
+	Reason string
+}
+
+func (e *ErrUnsafePath) Error() string {
+	return fmt.Sprintf("Unsafe path %q: %s", e.Uid, e.Reason)
+}
+
+type ErrInvalidBag struct {
+	Bag    string
+	Reason string
+}
+
+func (e *ErrInvalidBag) Error() string {
+	return fmt.Sprintf("Invalid bag %s: %s", e.Bag, e.Reason)
+}
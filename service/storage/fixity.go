@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	FIXITY = "fixity"
+)
+
+type FixityCfg struct {
+	// Interval in minutes between two scheduled checks, 0 disables the schedule
+	Interval int `json:"interval" html:"Interval"`
+	// Throughput limits the bytes per second read by a check, 0 means unlimited
+	Throughput int `json:"throughput" html:"Throughput"`
+}
+
+type FixityStatus struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Buckets    int       `json:"buckets"`
+	Objects    int       `json:"objects"`
+	Mismatches int       `json:"mismatches"`
+	Missing    int       `json:"missing"`
+	Errors     int       `json:"errors"`
+}
+
+type FixityReport struct {
+	Status  FixityStatus    `json:"status"`
+	Invalid []models.Fixity `json:"invalid"`
+}
+
+var (
+	fixityStatus FixityStatus
+	fixityMu     sync.Mutex
+	fixityStop   chan struct{}
+)
+
+// throttle limits the average throughput over all reads to bytesPerSecond
+type throttle struct {
+	bytesPerSecond int
+	start          time.Time
+	n              int64
+}
+
+func newThrottle(bytesPerSecond int) *throttle {
+	return &throttle{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+// wait accounts n read bytes and sleeps until the average throughput is back within the limit
+func (t *throttle) wait(n int64) {
+	if t.bytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+
+	t.n += n
+
+	d := time.Duration(float64(t.n)/float64(t.bytesPerSecond)*float64(time.Second)) - time.Since(t.start)
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func startFixity(cfg *FixityCfg) {
+	if cfg.Interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+
+	fixityMu.Lock()
+	fixityStop = stop
+	fixityMu.Unlock()
+
+	go func(stop chan struct{}) {
+		defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+
+		ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, err := Fixity(cfg.Throughput)
+				if _, ok := err.(*ErrFixityRunning); !ok {
+					common.Error(err)
+				}
+			}
+		}
+	}(stop)
+}
+
+func stopFixity() {
+	fixityMu.Lock()
+	defer fixityMu.Unlock()
+
+	if fixityStop != nil {
+		close(fixityStop)
+		fixityStop = nil
+	}
+}
+
+func stopped(stop chan struct{}) bool {
+	if stop == nil {
+		return false
+	}
+
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkBucket re-reads every object of a bucket and compares it with the digests recorded in the bucket.
+// The throttle waits after each object so neither a storage handle nor the lock of the uid is held meanwhile.
+func checkBucket(bucket *models.Bucket, throttle *throttle) *models.Fixity {
+	fixity := models.NewFixity()
+	fixity.Uid = bucket.Uid
+	fixity.VerifiedAt = time.Now()
+	fixity.Objects = len(bucket.FileNames)
+
+	for i, name := range bucket.FileNames {
+		var n int64
+
+		err := Exec(func(handle Handle) error {
+			uid, err := objectRef(handle, bucket.Uid, name)
+			if common.Error(err) {
+				return err
+			}
+
+			var h *[]byte
+
+			_, h, n, err = handle.Load(uid, io.Discard, &Options{Verify: true})
+			if err != nil {
+				return err
+			}
+
+			if i < len(bucket.FileHashes) && bucket.FileHashes[i] != hex.EncodeToString(*h) {
+				return &ErrObjectCorrupted{Uid: uid, Expected: bucket.FileHashes[i], Actual: hex.EncodeToString(*h)}
+			}
+
+			return nil
+		})
+
+		throttle.wait(n)
+
+		switch err.(type) {
+		case nil:
+		case *ErrObjectNotFound:
+			fixity.Missing = append(fixity.Missing, name)
+		case *ErrObjectCorrupted, *ErrDecryptionFailed:
+			common.Warn(err.Error())
+
+			fixity.Mismatches = append(fixity.Mismatches, name)
+		default:
+			fixity.Errors = append(fixity.Errors, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	return &fixity
+}
+
+func saveFixity(fixity *models.Fixity) error {
+	return database.Exec(func(db database.Handle) error {
+		old := models.NewFixity()
+
+		err := db.LoadFixity("uid", fixity.Uid, &old, nil)
+		if _, ok := err.(*database.ErrNotFound); !ok {
+			if common.Error(err) {
+				return err
+			}
+
+			fixity.Id = old.Id
+			fixity.CreatedAt = old.CreatedAt
+		}
+
+		return db.SaveFixity(fixity, nil)
+	})
+}
+
+// Fixity checks the integrity of all stored objects and records the result per bucket
+func Fixity(throughput int) (*FixityStatus, error) {
+	fixityMu.Lock()
+
+	if fixityStatus.Running {
+		fixityMu.Unlock()
+
+		return nil, &ErrFixityRunning{}
+	}
+
+	fixityStatus = FixityStatus{Running: true, StartedAt: time.Now()}
+	stop := fixityStop
+
+	fixityMu.Unlock()
+
+	common.Info("Fixity check started ...")
+
+	throttle := newThrottle(throughput)
+
+	err := database.Exec(func(db database.Handle) error {
+		return db.ListBucket(func(bucket *models.Bucket) error {
+			if stopped(stop) {
+				return nil
+			}
+
+			// the objects of buckets in the trash are missing on purpose
+			if !bucket.DeletedAt.IsZero() {
+				return nil
+			}
+
+			fixity := checkBucket(bucket, throttle)
+
+			fixityMu.Lock()
+			fixityStatus.Buckets++
+			fixityStatus.Objects += fixity.Objects
+			fixityStatus.Mismatches += len(fixity.Mismatches)
+			fixityStatus.Missing += len(fixity.Missing)
+			fixityStatus.Errors += len(fixity.Errors)
+			fixityMu.Unlock()
+
+			return saveFixity(fixity)
+		}, nil)
+	})
+
+	fixityMu.Lock()
+	defer fixityMu.Unlock()
+
+	fixityStatus.Running = false
+	fixityStatus.FinishedAt = time.Now()
+
+	status := fixityStatus
+
+	if common.Error(err) {
+		return &status, err
+	}
+
+	common.Info("Fixity check completed. time needed %v, %d buckets, %d mismatches, %d missing", status.FinishedAt.Sub(status.StartedAt), status.Buckets, status.Mismatches, status.Missing)
+
+	return &status, nil
+}
+
+// fixityHandler starts a check with POST, reports the status and all invalid buckets with GET or the result of a single bucket with GET {uid}
+func fixityHandler(rw http.ResponseWriter, r *http.Request) error {
+	uid := r.URL.Path
+
+	if r.Method == http.MethodPost {
+		fixityMu.Lock()
+		running := fixityStatus.Running
+		fixityMu.Unlock()
+
+		if running {
+			return &ErrFixityRunning{}
+		}
+
+		go func() {
+			defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+
+			_, err := Fixity(cfg.Fixity.Throughput)
+			common.Error(err)
+		}()
+
+		rw.WriteHeader(http.StatusAccepted)
+
+		return nil
+	}
+
+	if uid != "" {
+		fixity := models.NewFixity()
+
+		err := database.Exec(func(db database.Handle) error {
+			return db.LoadFixity("uid", uid, &fixity, nil)
+		})
+		if _, ok := err.(*database.ErrNotFound); ok {
+			return &ErrObjectNotFound{Uid: uid}
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		return writeJson(rw, http.StatusOK, &fixity)
+	}
+
+	report := FixityReport{}
+
+	fixityMu.Lock()
+	report.Status = fixityStatus
+	fixityMu.Unlock()
+
+	err := database.Exec(func(db database.Handle) error {
+		return db.ListFixity(func(fixity *models.Fixity) error {
+			if !fixity.Valid() {
+				report.Invalid = append(report.Invalid, *fixity)
+			}
+
+			return nil
+		}, nil)
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeJson(rw, http.StatusOK, &report)
+}
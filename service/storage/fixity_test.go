@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := newThrottle(10000)
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		throttle.wait(1000)
+	}
+
+	require.True(t, time.Since(start) >= time.Millisecond*290, "Throughput limited")
+}
+
+func TestCheckBucket(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+	defer stop()
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/"+TYPE+"/", "hello", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	result := StoreResult{}
+
+	err = json.Unmarshal([]byte(body), &result)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	bucket := models.NewBucket()
+
+	err = database.Exec(func(db database.Handle) error {
+		return db.LoadBucket("uid", result.Uid, &bucket, nil)
+	})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(result.Objects[0].Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	p, err := createShaPath(path, uid, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fixity := checkBucket(&bucket, newThrottle(0))
+
+	require.True(t, fixity.Valid(), "intact object")
+
+	ba, err := os.ReadFile(p)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba[0] ^= 0xff
+
+	err = os.WriteFile(p, ba, common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fixity = checkBucket(&bucket, newThrottle(0))
+
+	require.Equal(t, []string{uid.Object}, fixity.Mismatches, "flipped byte is a mismatch")
+	require.Empty(t, fixity.Missing)
+
+	err = os.Remove(p)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fixity = checkBucket(&bucket, newThrottle(0))
+
+	require.Equal(t, []string{uid.Object}, fixity.Missing, "removed file is missing")
+	require.Empty(t, fixity.Mismatches)
+}
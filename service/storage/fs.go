@@ -1,14 +1,10 @@
 package storage
 
 import (
-	"bytes"
 	"container/list"
-	"encoding/hex"
 	"fmt"
-	"github.com/mpetavy/tresor/service/index"
-	"github.com/mpetavy/tresor/utils"
 	"io"
-	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/mpetavy/tresor/models"
@@ -16,8 +12,10 @@ import (
 
 	"github.com/mpetavy/tresor/service/cluster"
 
+	"path"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"os"
 
@@ -29,6 +27,10 @@ import (
 const (
 	TYPE_FS   = "fs"
 	FS_VOLUME = "FS_VOLUME_"
+	// RECORD_DIR holds the records of the objects of a Fs volume inside META_DIR, so the volume only shows the objects
+	RECORD_DIR = "records"
+	// TEMP_DIR holds the temp files of the objects of a Fs volume inside META_DIR
+	TEMP_DIR = "temp"
 )
 
 type FsUID struct {
@@ -41,25 +43,88 @@ func NewFsUID(path string) *FsUID {
 	return uid
 }
 
-func ParseFsUID(path string) (*FsUID, error) {
-	path = strings.Replace(path, "\\", "/", -1)
-	path = strings.Replace(path, "@", string(filepath.Separator), -1)
+// ParseFsUID maps "@" and "\\" to separators and canonicalises the path. Empty and absolute paths, ".."
+// segments and paths into META_DIR are rejected because they would leave the content of the volume, digest
+// sidecar and temp file names because they are reserved.
+func ParseFsUID(suid string) (*FsUID, error) {
+	p := strings.Replace(suid, "\\", "/", -1)
+	p = strings.Replace(p, "@", "/", -1)
+
+	switch {
+	case strings.ContainsRune(p, 0):
+		return nil, &ErrUnsafePath{Uid: suid, Reason: "NUL character"}
+	case strings.HasPrefix(p, "/") || filepath.VolumeName(p) != "" || (len(p) >= 2 && p[1] == ':'):
+		return nil, &ErrUnsafePath{Uid: suid, Reason: "absolute path"}
+	}
+
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return nil, &ErrUnsafePath{Uid: suid, Reason: "parent directory segment"}
+		}
+	}
+
+	p = path.Clean(p)
+
+	switch {
+	case p == ".":
+		return nil, &ErrUnsafePath{Uid: suid, Reason: "empty path"}
+	case p == META_DIR || strings.HasPrefix(p, META_DIR+"/"):
+		return nil, &ErrUnsafePath{Uid: suid, Reason: "administrative path"}
+	case isDigestSidecar(p) || isTemp(p):
+		return nil, &ErrUnsafePath{Uid: suid, Reason: "reserved name"}
+	}
 
-	return &FsUID{path}, nil
+	return &FsUID{filepath.FromSlash(p)}, nil
 }
 
 func (uid *FsUID) String() string {
 	return uid.Path
 }
 
+// fsCfg is the part of Cfg the Fs driver reads, registered as its configuration schema
+type fsCfg struct {
+	driverCfg
+	Volumes   []fsVolumeCfg `json:"volumes" html:"Volumes"`
+	Placement PlacementCfg  `json:"placement" html:"Placement"`
+	KeyFile   string        `json:"keyFile" html:"Key file"`
+}
+
+type fsVolumeCfg struct {
+	Name          string `json:"name" html:"Name"`
+	Path          string `json:"path" html:"path"`
+	Hash          string `json:"hash" html:"Hash"`
+	ReadOnly      bool   `json:"readOnly" html:"Read only"`
+	Capacity      int    `json:"capacity" html:"Capacity"`
+	Encrypt       bool   `json:"encrypt" html:"Encrypt"`
+	Watch         string `json:"watch" html:"Watch"`
+	WatchInterval int    `json:"watchInterval" html:"Watch interval"`
+	Retention     int    `json:"retention" html:"Retention"`
+}
+
 type Fs struct {
-	volumes map[string]*FsVolume
-	mu      *sync.Mutex
+	volumes   map[string]*FsVolume
+	placement *PlacementCfg
+	mu        *sync.Mutex
 }
 
 type FsVolume struct {
-	Name string
-	Path string
+	Name     string
+	Path     string
+	Hash     string
+	ReadOnly bool
+	Capacity int64
+	Encrypt  bool
+	keys     *Keyring
+	// Watch selects how changes made outside of tresor are detected, WatchInterval the time between two polls
+	Watch         string
+	WatchInterval time.Duration
+	// Retention is the number of days a file is protected against deletion
+	Retention int
+}
+
+// recordFile returns the file inside META_DIR which holds the record of the object
+func (volume *FsVolume) recordFile(uid *FsUID) string {
+	return metaPath(volume.Path, filepath.Join(RECORD_DIR, uid.Path+DIGEST_SUFFIX))
 }
 
 func NewFsVolume(name string, path string) (*FsVolume, error) {
@@ -79,6 +144,11 @@ func NewFs() (*Fs, error) {
 }
 
 func (fs *Fs) Init(cfg *Cfg) error {
+	keys, err := loadKeys(cfg)
+	if common.Error(err) {
+		return err
+	}
+
 	for i := 0; i < len(cfg.Volumes); i++ {
 		path := common.CleanPath(cfg.Volumes[i].Path)
 
@@ -91,17 +161,71 @@ func (fs *Fs) Init(cfg *Cfg) error {
 			return err
 		}
 
+		vol.Hash = hashAlgorithm(cfg.Volumes[i].Hash)
+		vol.ReadOnly = cfg.Volumes[i].ReadOnly
+		vol.Capacity = int64(cfg.Volumes[i].Capacity) * 1024 * 1024
+		vol.Encrypt = cfg.Volumes[i].Encrypt
+		vol.keys = keys
+
+		if vol.Encrypt && keys == nil {
+			return &ErrNoEncryptionKey{vol.Name}
+		}
+
+		vol.Retention = cfg.Volumes[i].Retention
+		vol.Watch = cfg.Volumes[i].Watch
+		vol.WatchInterval = time.Duration(cfg.Volumes[i].WatchInterval) * time.Second
+
+		err = validateWatch(vol.Name, vol.Watch)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = hash.New(vol.Hash)
+		if common.Error(err) {
+			return err
+		}
+
 		fs.AddVolume(vol)
 	}
 
+	err = cfg.Placement.validate()
+	if common.Error(err) {
+		return err
+	}
+
+	fs.placement = &cfg.Placement
+
 	return nil
 }
 
 func (fs *Fs) Start() error {
+	for _, volume := range fs.volumes {
+		if volume.ReadOnly {
+			continue
+		}
+
+		err := cleanTempOnce(volume.Path)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	for _, volume := range fs.volumes {
+		if volume.Watch != "" {
+			startWatch(fs, volume)
+		}
+	}
+
 	return nil
 }
 
 func (fs *Fs) Stop() error {
+	for _, volume := range fs.volumes {
+		if volume.Watch != "" {
+			stopWatch(volume)
+		}
+	}
+
 	return nil
 }
 
@@ -127,19 +251,65 @@ func (fs *Fs) RemoveVolume(v *FsVolume) {
 	delete(fs.volumes, v.Name)
 }
 
+func (fs *Fs) placementVolumes() []placementVolume {
+	l := make([]placementVolume, 0)
+
+	for _, v := range fs.volumes {
+		l = append(l, placementVolume{Name: v.Name, Path: v.Path, ReadOnly: v.ReadOnly, Capacity: v.Capacity})
+	}
+
+	return l
+}
+
 func (fs *Fs) CurrentVersion(uid *FsUID) (int, error) {
 	return 1, nil
 }
 
+// createFsPath joins the uid with the volume root and refuses paths which leave the root, also through symlinks
 func createFsPath(rootDir string, uid *FsUID) (string, error) {
-	var path string
+	p := filepath.Join(rootDir, uid.Path)
 
-	if rootDir != "" {
-		path = strings.Join([]string{rootDir, uid.Path}, string(filepath.Separator))
-	} else {
-		path = uid.Path
+	if !within(rootDir, p) {
+		return "", &ErrUnsafePath{Uid: uid.String(), Reason: "outside of volume"}
+	}
+
+	err := confine(rootDir, p)
+	if err != nil {
+		return "", &ErrUnsafePath{Uid: uid.String(), Reason: err.Error()}
 	}
-	return common.CleanPath(path), nil
+
+	return p, nil
+}
+
+// within reports whether path is root or lies below it
+func within(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// confine resolves the symlinks of the longest existing part of path and checks that it stays below root
+func confine(root string, p string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	existing := p
+	for existing != root && !common.FileExists(existing) {
+		existing = filepath.Dir(existing)
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+
+	if !within(realRoot, real) {
+		return fmt.Errorf("symlink leaves the volume")
+	}
+
+	return nil
 }
 
 func (fs *Fs) find(uid *FsUID, options *Options) (*FsVolume, string, error) {
@@ -201,14 +371,23 @@ func (fs *Fs) Store(suid string, source io.Reader, options *Options) (string, *[
 			return "", nil, &ErrInvalidVolumeName{options.VolumeName}
 		}
 	} else {
-		if len(fs.volumes) > 0 {
-			volume = fs.volumes[reflect.ValueOf(fs.Volumes).MapKeys()[0].String()]
-		} else {
+		if len(fs.volumes) == 0 {
 			return "", nil, &ErrNoVolumesDefined{}
 		}
+
+		var name string
+
+		name, source, err = placeObject(fs.placement, fs.placementVolumes(), source, uid.Path, options.expectedSize())
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		volume = fs.volumes[name]
 	}
 
-	uid.Path = suid
+	if volume.ReadOnly {
+		return "", nil, &ErrVolumeReadOnly{volume.Name}
+	}
 
 	cluster.Lock(cluster.ByStorageVolume(volume.Name))
 	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
@@ -218,45 +397,41 @@ func (fs *Fs) Store(suid string, source io.Reader, options *Options) (string, *[
 		return "", nil, err
 	}
 
-	if common.FileExists(path) {
-		fs, err := common.FileSize(path)
-		if common.Error(err) {
-			return "", nil, err
-		}
+	if isRegularFile(path) {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
 
-		if fs > 0 {
-			return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
-		}
+	dest, err := createTempIn(metaPath(volume.Path, TEMP_DIR), path)
+	if common.Error(err) {
+		return "", nil, err
 	}
+	defer discardTemp(dest)
 
-	err = os.MkdirAll(filepath.Dir(path), common.DefaultDirMode)
+	writer, encryption, err := encrypting(dest, volume.Encrypt, volume.keys)
 	if common.Error(err) {
 		return "", nil, err
 	}
 
-	dest, err := os.Create(path)
+	digest, _, err := copyDigest(writer, source, volume.Hash, nil, false)
 	if common.Error(err) {
 		return "", nil, err
 	}
-	defer func() {
-		common.Error(dest.Close())
-	}()
 
-	h, err := hash.New(hash.MD5)
+	err = writer.Close()
 	if common.Error(err) {
 		return "", nil, err
 	}
 
-	_, err = io.Copy(io.MultiWriter(dest, h), source)
+	err = commitObject(dest, path, volume.recordFile(uid), &record{digest: digest, format: Format{Encryption: encryption}})
 	if common.Error(err) {
 		return "", nil, err
 	}
 
-	digest := h.Sum(nil)
+	addUsage(volume.Path, diskUsage(path, ""))
 
 	cache.Put(FS_VOLUME, uid.Path, volume.Name)
 
-	return uid.String(), &digest, nil
+	return uid.String(), &digest.Value, nil
 }
 
 func (fs *Fs) Load(suid string, dest io.Writer, options *Options) (string, *[]byte, int64, error) {
@@ -268,11 +443,16 @@ func (fs *Fs) Load(suid string, dest io.Writer, options *Options) (string, *[]by
 	cluster.Lock(cluster.ByStorageUid(uid.Path))
 	defer cluster.Unlock(cluster.ByStorageUid(uid.Path))
 
-	_, path, err := fs.find(uid, options)
+	volume, path, err := fs.find(uid, options)
 	if common.Error(err) {
 		return "", nil, -1, err
 	}
 
+	expected, err := readRecordFile(volume.recordFile(uid), volume.Encrypt)
+	if common.Error(err) {
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
+	}
+
 	source, err := os.Open(path)
 	if common.Error(err) {
 		return "", nil, -1, err
@@ -281,19 +461,38 @@ func (fs *Fs) Load(suid string, dest io.Writer, options *Options) (string, *[]by
 		common.Error(source.Close())
 	}()
 
-	h, err := hash.New(hash.MD5)
+	reader, err := plainReader(source, expected.format, volume.keys)
 	if common.Error(err) {
-		return "", nil, -1, err
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
 	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
 
-	n, err := io.Copy(io.MultiWriter(dest, h), source)
+	digest, n, err := copyDigest(dest, reader, volume.Hash, expected.digest, options != nil && options.Verify)
+	err = objectError(err, volume.Name, uid.String())
 	if common.Error(err) {
 		return "", nil, -1, err
 	}
 
-	digest := h.Sum(nil)
+	return path, &digest.Value, n, nil
+}
+
+func (fs *Fs) Open(suid string, options *Options) (io.ReadSeekCloser, *ObjectInfo, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(uid.Path))
+	defer cluster.Unlock(cluster.ByStorageUid(uid.Path))
+
+	volume, path, err := fs.find(uid, options)
+	if common.Error(err) {
+		return nil, nil, err
+	}
 
-	return path, &digest, n, nil
+	return openFile(volume.Name, uid.String(), path, volume.recordFile(uid), volume.Encrypt, volume.keys)
 }
 
 func (fs *Fs) Delete(suid string, options *Options) error {
@@ -310,23 +509,58 @@ func (fs *Fs) Delete(suid string, options *Options) error {
 		return err
 	}
 
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
+
 	cluster.Lock(cluster.ByStorageUid(uid.Path))
 	defer cluster.Unlock(cluster.ByStorageUid(uid.Path))
 
+	uids, err := checkFiles(volume, path)
+	if err != nil {
+		return err
+	}
+
+	records := metaPath(volume.Path, RECORD_DIR)
+
 	if common.IsFile(path) {
+		n := diskUsage(path, "")
+
 		err := os.Remove(path)
 		if common.Error(err) {
 			return err
 		}
+
+		addUsage(volume.Path, -n)
+
+		err = os.Remove(volume.recordFile(uid))
+		if err != nil && !os.IsNotExist(err) {
+			common.Error(err)
+
+			return err
+		}
+
+		removeEmptyDirs(records, volume.recordFile(uid))
 	} else {
 		cluster.Lock(cluster.ByStorageVolume(volume.Name))
 		defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
 
+		n := diskUsage(path, META_DIR)
+
 		err := os.RemoveAll(path)
 		if common.Error(err) {
 			return err
 		}
 
+		addUsage(volume.Path, -n)
+
+		err = os.RemoveAll(filepath.Join(records, uid.Path))
+		if common.Error(err) {
+			return err
+		}
+
+		removeEmptyDirs(records, filepath.Join(records, uid.Path))
+
 		for {
 			path = filepath.Dir(path)
 
@@ -350,109 +584,98 @@ func (fs *Fs) Delete(suid string, options *Options) error {
 		}
 	}
 
+	for _, uid := range uids {
+		removeRetention(volume.Path, uid)
+	}
+
 	cache.Remove(FS_VOLUME, uid.Path)
 
 	return nil
 }
 
 func (fs *Fs) rebuildBucket(uid *FsUID) error {
-	bucket := models.NewBucket()
-	bucket.Uid = uid.String()
+	_, err := saveBucket(fs, uid.String(), []string{uid.String()})
 
-	buffer := bytes.Buffer{}
+	return err
+}
 
-	path, h, n, err := fs.Load(uid.String(), &buffer, nil)
+func (fs *Fs) Rebuild(job *RebuildJob) (int, error) {
+	err := database.Exec(func(db database.Handle) error {
+		return db.EnableIndices([]interface{}{models.NewBucket()}, false)
+	})
 	if common.Error(err) {
-		return err
+		return -1, err
 	}
+	defer common.Error(database.Exec(func(db database.Handle) error {
+		return db.EnableIndices([]interface{}{models.NewBucket()}, true)
+	}))
 
-	bucket.FileNames = append(bucket.FileNames, uid.String())
-	bucket.FileHashes = append(bucket.FileHashes, hex.EncodeToString(*h))
-
-	var mimeType string
-	var mapping index.Mapping
-	var fulltext string
-	var orientation utils.Orientation
-
-	err = index.Exec(func(index index.Handle) error {
-		mimeType, mapping, _, fulltext, orientation, err = index.Index(path, nil)
-		if common.Error(err) {
-			return err
-		}
+	resumeVolume, resumePath, _ := strings.Cut(job.Resume(), "|")
 
-		return nil
-	})
-	if common.Error(err) {
-		return err
+	names := make([]string, 0, len(fs.volumes))
+	for name := range fs.volumes {
+		names = append(names, name)
 	}
 
-	bucket.FileMimeTypes = append(bucket.FileMimeTypes, mimeType)
-	bucket.FileFulltext = append(bucket.FileFulltext, fulltext)
-	bucket.FileOrientation = append(bucket.FileOrientation, int(orientation))
+	sort.Strings(names)
 
-	for k, v := range mapping {
-		bucket.Props[k] = v
-	}
+	c := 0
+	for _, name := range names {
+		if job.Resume() != "" && name < resumeVolume {
+			continue
+		}
 
-	bucket.FileSizes = append(bucket.FileSizes, n)
+		volume := fs.volumes[name]
+		resume := common.Eval(name == resumeVolume, resumePath, "")
+		canceled := false
 
-	common.Debug("%s: %s", (*uid).String(), hex.EncodeToString(*h))
+		err := filepath.Walk(volume.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-	err = database.Exec(func(db database.Handle) error {
-		return db.SaveBucket(&bucket, nil)
-	})
-	if common.Error(err) {
-		return err
-	}
+			if info.IsDir() && info.Name() == META_DIR {
+				return filepath.SkipDir
+			}
 
-	return nil
-}
+			if path == volume.Path {
+				return nil
+			}
 
-func (fs *Fs) Rebuild() (int, error) {
-	cluster.Lock(cluster.ByStorage())
-	defer cluster.Unlock(cluster.ByStorage())
+			rel := filepath.ToSlash(path[len(volume.Path)+1:])
 
-	err := database.Exec(func(db database.Handle) error {
-		return db.EnableIndices([]interface{}{models.NewBucket()}, false)
-	})
-	if common.Error(err) {
-		return -1, err
-	}
-	defer common.Error(database.Exec(func(db database.Handle) error {
-		return db.EnableIndices([]interface{}{models.NewBucket()}, true)
-	}))
+			if resume != "" && compareWalkOrder(rel, resume) <= 0 {
+				if info.IsDir() && !strings.HasPrefix(resume, rel+"/") {
+					return filepath.SkipDir
+				}
 
-	wg := sync.WaitGroup{}
-	c := 0
-	for _, volume := range fs.volumes {
-		err := filepath.Walk(volume.Path, func(path string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
-				c++
-				path = path[len(volume.Path)+1:]
+				return nil
+			}
 
-				wg.Add(1)
-				go func(path string) {
-					defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+			if !info.IsDir() && !isDigestSidecar(path) && !isTemp(path) {
+				uid := NewFsUID(filepath.FromSlash(rel))
 
-					defer func() {
-						wg.Done()
-					}()
+				if !job.Submit(name+"|"+rel, func() error {
+					return fs.rebuildBucket(uid)
+				}) {
+					canceled = true
 
-					fmt.Printf("%s\n", path)
+					return filepath.SkipAll
+				}
 
-					common.Error(fs.rebuildBucket(NewFsUID(path)))
-				}(path)
+				c++
 			}
 
 			return nil
 		})
-
 		if common.Error(err) {
-			return -1, err
+			return c, err
 		}
-	}
 
-	wg.Wait()
+		if canceled {
+			break
+		}
+	}
 
 	return c, nil
 }
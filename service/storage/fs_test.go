@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsHostileUID(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	volumePath := filepath.Join(path, "volume")
+	outside := filepath.Join(path, "outside")
+
+	for _, dir := range []string{volumePath, outside} {
+		err := os.MkdirAll(dir, common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.Symlink(outside, filepath.Join(volumePath, "link"))
+	if err != nil {
+		t.Logf("symlinks not supported: %v", err)
+	}
+
+	fs, err := NewFs()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewFsVolume("test", volumePath)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fs.AddVolume(v)
+
+	hostile := []string{
+		"",
+		".",
+		"..",
+		"..@..@etc@passwd",
+		"../outside/secret.txt",
+		"a/../../outside/secret.txt",
+		"a/..",
+		"\\..\\outside\\secret.txt",
+		"@etc@passwd",
+		"/etc/passwd",
+		"C:\\Windows\\win.ini",
+		"c:secret.txt",
+		"a\x00b",
+		META_DIR + "/retention/a.json",
+		"@" + META_DIR,
+		"a.txt" + DIGEST_SUFFIX,
+		"a@b" + TEMP_INFIX + "1",
+	}
+
+	for _, suid := range hostile {
+		_, err := ParseFsUID(suid)
+		require.IsType(t, &ErrUnsafePath{}, err, "parse %q", suid)
+
+		_, _, err = fs.Store(suid, bytes.NewReader([]byte("hostile")), nil)
+		require.IsType(t, &ErrUnsafePath{}, err, "store %q", suid)
+
+		_, _, _, err = fs.Load(suid, &bytes.Buffer{}, nil)
+		require.IsType(t, &ErrUnsafePath{}, err, "load %q", suid)
+
+		err = fs.Delete(suid, nil)
+		require.IsType(t, &ErrUnsafePath{}, err, "delete %q", suid)
+	}
+
+	if isRegularFile(filepath.Join(outside, "secret.txt")) && common.FileExists(filepath.Join(volumePath, "link")) {
+		for _, suid := range []string{"link/secret.txt", "link@new.txt", "link"} {
+			_, _, _, err = fs.Load(suid, &bytes.Buffer{}, nil)
+			require.IsType(t, &ErrUnsafePath{}, err, "load through symlink %q", suid)
+
+			_, _, err = fs.Store(suid, bytes.NewReader([]byte("hostile")), nil)
+			require.IsType(t, &ErrUnsafePath{}, err, "store through symlink %q", suid)
+
+			err = fs.Delete(suid, nil)
+			require.IsType(t, &ErrUnsafePath{}, err, "delete through symlink %q", suid)
+		}
+
+		require.False(t, common.FileExists(filepath.Join(outside, "new.txt")))
+		require.True(t, isRegularFile(filepath.Join(outside, "secret.txt")))
+	}
+
+	for suid, canonical := range map[string]string{
+		"a@b.txt":      "a/b.txt",
+		"a\\.\\c.txt":  "a/c.txt",
+		"a//d.txt":     "a/d.txt",
+		"a/x/../e.txt": "",
+	} {
+		uid, err := ParseFsUID(suid)
+		if canonical == "" {
+			require.IsType(t, &ErrUnsafePath{}, err, "parse %q", suid)
+
+			continue
+		}
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, filepath.FromSlash(canonical), uid.Path)
+
+		_, _, err = fs.Store(suid, bytes.NewReader([]byte(canonical)), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.True(t, isRegularFile(filepath.Join(volumePath, filepath.FromSlash(canonical))), "stored below the volume %q", suid)
+	}
+}
+
+func TestFsRecords(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	fs, err := NewFs()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewFsVolume("test", path)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fs.AddVolume(v)
+
+	suid, _, err := fs.Store("a@b.txt", bytes.NewReader([]byte("content")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	var files []string
+
+	err = filepath.WalkDir(path, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && d.Name() == META_DIR {
+			return filepath.SkipDir
+		}
+
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+
+		return nil
+	})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, []string{filepath.Join(path, "a", "b.txt")}, files, "records and temp files are kept in META_DIR")
+
+	buf := bytes.Buffer{}
+
+	_, _, _, err = fs.Load(suid, &buf, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "content", buf.String())
+
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.True(t, isRegularFile(v.recordFile(uid)))
+
+	err = fs.Delete(suid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.False(t, common.FileExists(v.recordFile(uid)), "record deleted with the object")
+}
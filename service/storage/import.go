@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/hash"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	IMPORT = "import"
+	// IMPORT_METADATA is the optional JSON sidecar of an imported directory or bag whose values are merged into Bucket.Props
+	IMPORT_METADATA = "metadata.json"
+)
+
+// ImportItem reports the outcome of importing a single bag or directory
+type ImportItem struct {
+	Source string `json:"source"`
+	Uid    string `json:"uid,omitempty"`
+	Pages  int    `json:"pages"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	Imported int          `json:"imported"`
+	Failed   int          `json:"failed"`
+	Items    []ImportItem `json:"items"`
+}
+
+// importer stores the items found below a root as new Sha ids, save records their bucket
+type importer struct {
+	sha     *Sha
+	options *Options
+	save    func(uid string, objects []string, props map[string]string) error
+}
+
+// importSource is a bag or a directory with files which is imported as one bucket
+type importSource struct {
+	fsys fs.FS
+	dir  string
+	bag  bool
+}
+
+func newImporter(sha *Sha, options *Options) *importer {
+	im := &importer{sha: sha, options: options}
+
+	im.save = func(uid string, objects []string, props map[string]string) error {
+		bucket, err := saveBucket(sha, uid, objects)
+		if common.Error(err) {
+			return err
+		}
+
+		if len(props) == 0 {
+			return nil
+		}
+
+		for k, v := range props {
+			bucket.Props[k] = v
+		}
+
+		return database.Exec(func(db database.Handle) error {
+			return db.SaveBucket(bucket, nil)
+		})
+	}
+
+	return im
+}
+
+// Import stores every BagIt bag and every directory with files below root, or root itself if it is a
+// bag directory or a zipped bag, as a new Sha id. Failed items are reported and do not stop the import.
+func Import(handle Handle, root string, options *Options) (*ImportReport, error) {
+	sha, ok := handle.(*Sha)
+	if !ok {
+		return nil, &ErrNotSupported{Driver: cfg.Driver, Operation: IMPORT}
+	}
+
+	return newImporter(sha, options).run(root)
+}
+
+func (im *importer) run(root string) (*ImportReport, error) {
+	var fsys fs.FS
+
+	if isRegularFile(root) {
+		r, err := zip.OpenReader(root)
+		if common.Error(err) {
+			return nil, err
+		}
+		defer func() {
+			common.DebugError(r.Close())
+		}()
+
+		fsys = r
+	} else {
+		if !common.FileExists(root) {
+			return nil, &common.ErrFileNotFound{FileName: root}
+		}
+
+		fsys = os.DirFS(root)
+	}
+
+	sources, err := findImportSources(fsys)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+
+	for _, source := range sources {
+		item := ImportItem{Source: filepath.Join(root, filepath.FromSlash(source.dir))}
+
+		err := im.importSource(source, &item)
+		if err != nil {
+			common.Warn("import of %s failed: %v", item.Source, err)
+
+			item.Error = err.Error()
+			report.Failed++
+		} else {
+			common.Info("imported %s as %s", item.Source, item.Uid)
+
+			report.Imported++
+		}
+
+		report.Items = append(report.Items, item)
+	}
+
+	return report, nil
+}
+
+// findImportSources returns the bags and the directories with files, a bag is never descended into
+func findImportSources(fsys fs.FS) ([]importSource, error) {
+	var sources []importSource
+
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if d.Name() == META_DIR {
+			return fs.SkipDir
+		}
+
+		if isFile(fsys, path.Join(p, "bagit.txt")) {
+			sources = append(sources, importSource{fsys: fsys, dir: p, bag: true})
+
+			return fs.SkipDir
+		}
+
+		files, err := importFiles(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		if len(files) > 0 {
+			sources = append(sources, importSource{fsys: fsys, dir: p})
+		}
+
+		return nil
+	})
+
+	return sources, err
+}
+
+func isFile(fsys fs.FS, name string) bool {
+	fi, err := fs.Stat(fsys, name)
+
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// importFiles returns the files of a plain directory in name order without its sidecar
+func importFiles(fsys fs.FS, dir string) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && entry.Name() != IMPORT_METADATA && !isTemp(entry.Name()) {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+	}
+
+	sortNatural(files)
+
+	return files, nil
+}
+
+// readMetadata returns the values of the JSON sidecar of a directory or nil if there is none
+func readMetadata(fsys fs.FS, dir string) (map[string]string, error) {
+	ba, err := fs.ReadFile(fsys, path.Join(dir, IMPORT_METADATA))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+
+	err = json.Unmarshal(ba, &values)
+	if err != nil {
+		return nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("invalid %s: %v", IMPORT_METADATA, err)}
+	}
+
+	props := make(map[string]string)
+
+	for k, v := range values {
+		switch v := v.(type) {
+		case string:
+			props[k] = v
+		default:
+			ba, _ := json.Marshal(v)
+
+			props[k] = string(ba)
+		}
+	}
+
+	return props, nil
+}
+
+func (im *importer) importSource(source importSource, item *ImportItem) error {
+	var files []string
+	var props map[string]string
+	var err error
+
+	if source.bag {
+		files, props, err = validateBag(source.fsys, source.dir)
+	} else {
+		files, err = importFiles(source.fsys, source.dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	metadata, err := readMetadata(source.fsys, source.dir)
+	if err != nil {
+		return err
+	}
+
+	if props == nil {
+		props = make(map[string]string)
+	}
+
+	for k, v := range metadata {
+		props[k] = v
+	}
+
+	tx, err := im.sha.Begin("", im.options)
+	if common.Error(err) {
+		return err
+	}
+
+	for _, file := range files {
+		err := func() error {
+			f, err := source.fsys.Open(file)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				common.DebugError(f.Close())
+			}()
+
+			_, err = tx.Add(f)
+
+			return err
+		}()
+		if err != nil {
+			common.Error(tx.Abort())
+
+			return err
+		}
+	}
+
+	uid, objects, err := tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	item.Uid = uid
+	item.Pages = len(objects)
+
+	return im.save(uid, objects, props)
+}
+
+// parseBagInfo reads the labels and values of bag-info.txt, indented lines continue the previous value
+func parseBagInfo(fsys fs.FS, dir string) (map[string]string, error) {
+	props := make(map[string]string)
+
+	f, err := fsys.Open(path.Join(dir, "bag-info.txt"))
+	if os.IsNotExist(err) {
+		return props, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		common.DebugError(f.Close())
+	}()
+
+	label := ""
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if label != "" && strings.TrimLeft(line, " \t") != line {
+			props[label] += " " + strings.TrimSpace(line)
+
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		label = strings.TrimSpace(k)
+		props[label] = strings.TrimSpace(v)
+	}
+
+	return props, scanner.Err()
+}
+
+// readManifest returns the hashes of a manifest by the decoded path of the files
+func readManifest(fsys fs.FS, name string) (map[string]string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		common.DebugError(f.Close())
+	}()
+
+	decoder := strings.NewReplacer("%0D", "\r", "%0A", "\n", "%25", "%")
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		h := fields[0]
+		p := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), h))
+
+		entries[decoder.Replace(p)] = strings.ToLower(h)
+	}
+
+	return entries, scanner.Err()
+}
+
+// verifyManifest checks the hashes of all files listed in a manifest of the bag
+func verifyManifest(fsys fs.FS, dir string, name string) (map[string]string, error) {
+	alg := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(name, "tag"), "manifest-"), ".txt")
+
+	_, err := hash.New(alg)
+	if err != nil {
+		return nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("unknown algorithm of %s", name)}
+	}
+
+	entries, err := readManifest(fsys, path.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	for p, expected := range entries {
+		if !fs.ValidPath(p) {
+			return nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("invalid path %s in %s", p, name)}
+		}
+
+		f, err := fsys.Open(path.Join(dir, p))
+		if err != nil {
+			return nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("missing file %s listed in %s", p, name)}
+		}
+
+		digest, _, err := copyDigest(io.Discard, f, alg, nil, false)
+		common.DebugError(f.Close())
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if hex.EncodeToString(digest.Value) != expected {
+			return nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("checksum mismatch of %s in %s", p, name)}
+		}
+	}
+
+	return entries, nil
+}
+
+// validateBag verifies the manifests, completeness and Payload-Oxum of a bag and returns its payload files
+// in path order and its bag-info
+func validateBag(fsys fs.FS, dir string) ([]string, map[string]string, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifests []string
+	var tagManifests []string
+
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), "manifest-") && strings.HasSuffix(entry.Name(), ".txt"):
+			manifests = append(manifests, entry.Name())
+		case strings.HasPrefix(entry.Name(), "tagmanifest-") && strings.HasSuffix(entry.Name(), ".txt"):
+			tagManifests = append(tagManifests, entry.Name())
+		}
+	}
+
+	if len(manifests) == 0 {
+		return nil, nil, &ErrInvalidBag{Bag: dir, Reason: "no payload manifest"}
+	}
+
+	for _, name := range tagManifests {
+		_, err := verifyManifest(fsys, dir, name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var files []string
+	var octets int64
+
+	err = fs.WalkDir(fsys, path.Join(dir, BAGIT_DATA), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			files = append(files, p)
+			octets += fi.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("unreadable payload: %v", err)}
+	}
+
+	for _, name := range manifests {
+		listed, err := verifyManifest(fsys, dir, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, file := range files {
+			rel := strings.TrimPrefix(file, dir+"/")
+			if dir == "." {
+				rel = file
+			}
+
+			if _, ok := listed[rel]; !ok {
+				return nil, nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("file %s missing in %s", rel, name)}
+			}
+		}
+	}
+
+	props, err := parseBagInfo(fsys, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if oxum, ok := props["Payload-Oxum"]; ok {
+		if oxum != strconv.FormatInt(octets, 10)+"."+strconv.Itoa(len(files)) {
+			return nil, nil, &ErrInvalidBag{Bag: dir, Reason: fmt.Sprintf("Payload-Oxum %s does not match payload", oxum)}
+		}
+	}
+
+	sortNatural(files)
+
+	return files, props, nil
+}
+
+// sortNatural orders paths with numbers compared by their value so that page.2 comes before page.10
+func sortNatural(paths []string) {
+	split := func(s string) []string {
+		var parts []string
+
+		for len(s) > 0 {
+			digits := s[0] >= '0' && s[0] <= '9'
+
+			i := 1
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digits {
+				i++
+			}
+
+			parts = append(parts, s[:i])
+			s = s[i:]
+		}
+
+		return parts
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		a, b := split(paths[i]), split(paths[j])
+
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] == b[k] {
+				continue
+			}
+
+			na, errA := strconv.Atoi(a[k])
+			nb, errB := strconv.Atoi(b[k])
+			if errA == nil && errB == nil && na != nb {
+				return na < nb
+			}
+
+			return a[k] < b[k]
+		}
+
+		return len(a) < len(b)
+	})
+}
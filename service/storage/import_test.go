@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	volumePath := filepath.Join(path, "volume")
+	tree := filepath.Join(path, "tree")
+
+	write := func(name string, content string) {
+		p := filepath.Join(tree, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(p), common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(p, []byte(content), common.DefaultFileMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.MkdirAll(volumePath, common.DefaultDirMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", volumePath, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha.AddVolume(v)
+
+	suid, h, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("bagged")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	bucket := models.NewBucket()
+	bucket.Uid = uid.withoutObject().String()
+	bucket.Props["Title"] = "Bagged"
+	bucket.FileNames = []string{uid.Object}
+	bucket.FileHashes = []string{hex.EncodeToString(*h)}
+
+	for _, name := range []string{"bag", "broken"} {
+		err = writeBag(sha, &bucket, &dirBag{root: filepath.Join(tree, name)}, "")
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	write("broken/data/"+PAGE+".1", "tampered")
+	write("plain/1.txt", "one")
+	write("plain/10.txt", "ten")
+	write("plain/2.txt", "two")
+	write("plain/"+IMPORT_METADATA, `{"Title": "Plain", "Year": 2020}`)
+
+	props := make(map[string]map[string]string)
+
+	im := newImporter(sha, nil)
+	im.save = func(uid string, objects []string, p map[string]string) error {
+		props[uid] = p
+
+		return nil
+	}
+
+	report, err := im.run(tree)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, report.Imported)
+	require.Equal(t, 1, report.Failed)
+
+	items := make(map[string]ImportItem)
+	for _, item := range report.Items {
+		items[filepath.Base(item.Source)] = item
+	}
+
+	require.Contains(t, items["broken"].Error, "checksum mismatch")
+	require.Equal(t, "Bagged", props[items["bag"].Uid]["Title"])
+	require.Equal(t, bucket.Uid, props[items["bag"].Uid]["External-Identifier"])
+
+	require.Equal(t, 3, items["plain"].Pages)
+	require.Equal(t, "Plain", props[items["plain"].Uid]["Title"])
+	require.Equal(t, "2020", props[items["plain"].Uid]["Year"])
+
+	plain, err := ParseShaUID(items["plain"].Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for page, content := range []string{"one", "two", "ten"} {
+		plain.Object = PAGE + "." + string(rune('1'+page))
+
+		buf := bytes.Buffer{}
+
+		_, _, _, err := sha.Load(plain.String(), &buf, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, content, buf.String(), "pages in natural order")
+	}
+}
+
+func TestImportRebuild(t *testing.T) {
+	stopServices := startMemoryServices(t)
+	defer stopServices()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	volumePath := filepath.Join(path, "volume")
+	tree := filepath.Join(path, "tree")
+
+	for _, dir := range []string{volumePath, tree} {
+		err := os.MkdirAll(dir, common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(tree, "1.txt"), []byte("one"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(tree, IMPORT_METADATA), []byte(`{"Title": "Plain"}`), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", volumePath, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha.AddVolume(v)
+
+	report, err := newImporter(sha, nil).run(tree)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, report.Imported)
+
+	uid, err := ParseShaUID(report.Items[0].Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	// a rebuild indexes the objects again
+	err = sha.rebuildBucket(uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	bucket := models.NewBucket()
+
+	err = database.Exec(func(db database.Handle) error {
+		return db.LoadBucket("uid", uid.String(), &bucket, nil)
+	})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "Plain", bucket.Props["Title"], "import metadata survives a rebuild")
+}
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	TYPE_MEMORY   = "memory"
+	MEMORY_VOLUME = "memory"
+)
+
+// memoryVolumes are shared by name between all handles of the pool and live as long as the process
+var (
+	memoryVolumes   = make(map[string]*MemoryVolume)
+	memoryVolumesMu sync.Mutex
+)
+
+// memoryCfg is the part of Cfg the Memory driver reads, registered as its configuration schema
+type memoryCfg struct {
+	driverCfg
+	Volumes []memoryVolumeCfg `json:"volumes" html:"Volumes"`
+}
+
+type memoryVolumeCfg struct {
+	Name     string `json:"name" html:"Name"`
+	Hash     string `json:"hash" html:"Hash"`
+	ReadOnly bool   `json:"readOnly" html:"Read only"`
+}
+
+type memoryObject struct {
+	data    []byte
+	digest  *Digest
+	modTime time.Time
+}
+
+// MemoryVolume keeps the objects of a volume by their path uid, the path of the volume configuration is ignored
+type MemoryVolume struct {
+	Name     string
+	Hash     string
+	ReadOnly bool
+	objects  map[string]*memoryObject
+	mu       sync.RWMutex
+}
+
+// Memory stores objects with path uids like Fs but holds them in memory only. It is meant for tests and
+// throwaway instances which do not want to depend on directories.
+type Memory struct {
+	volumes map[string]*MemoryVolume
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+// NewMemoryVolume returns the volume of the given name, every call with the same name shares its objects
+func NewMemoryVolume(name string) *MemoryVolume {
+	memoryVolumesMu.Lock()
+	defer memoryVolumesMu.Unlock()
+
+	volume, ok := memoryVolumes[name]
+	if !ok {
+		volume = &MemoryVolume{Name: name, Hash: DEFAULT_HASH, objects: make(map[string]*memoryObject)}
+
+		memoryVolumes[name] = volume
+	}
+
+	return volume
+}
+
+// Clear removes all objects of the volume
+func (volume *MemoryVolume) Clear() {
+	volume.mu.Lock()
+	defer volume.mu.Unlock()
+
+	volume.objects = make(map[string]*memoryObject)
+}
+
+func NewMemory() (*Memory, error) {
+	return &Memory{volumes: make(map[string]*MemoryVolume)}, nil
+}
+
+func (memory *Memory) Init(cfg *Cfg) error {
+	for i := 0; i < len(cfg.Volumes); i++ {
+		volume := NewMemoryVolume(cfg.Volumes[i].Name)
+		volume.Hash = hashAlgorithm(cfg.Volumes[i].Hash)
+		volume.ReadOnly = cfg.Volumes[i].ReadOnly
+
+		memory.AddVolume(volume)
+	}
+
+	if len(memory.volumes) == 0 {
+		memory.AddVolume(NewMemoryVolume(MEMORY_VOLUME))
+	}
+
+	return nil
+}
+
+func (memory *Memory) Start() error {
+	return nil
+}
+
+func (memory *Memory) Stop() error {
+	return nil
+}
+
+func (memory *Memory) Volume(n string) *MemoryVolume {
+	return memory.volumes[n]
+}
+
+// Volumes returns the names of the volumes in alphabetical order
+func (memory *Memory) Volumes() []string {
+	names := make([]string, 0, len(memory.volumes))
+	for name := range memory.volumes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (memory *Memory) AddVolume(v *MemoryVolume) {
+	memory.volumes[v.Name] = v
+}
+
+func (memory *Memory) RemoveVolume(v *MemoryVolume) {
+	delete(memory.volumes, v.Name)
+}
+
+// find returns the volume holding the object, the named volume only if the options select one
+func (memory *Memory) find(uid *FsUID, options *Options) (*MemoryVolume, *memoryObject, error) {
+	names := memory.Volumes()
+
+	if options != nil && options.VolumeName != "" {
+		if _, ok := memory.volumes[options.VolumeName]; !ok {
+			return nil, nil, &ErrInvalidVolumeName{options.VolumeName}
+		}
+
+		names = []string{options.VolumeName}
+	}
+
+	for _, name := range names {
+		volume := memory.volumes[name]
+
+		volume.mu.RLock()
+		object, ok := volume.objects[uid.String()]
+		volume.mu.RUnlock()
+
+		if ok {
+			return volume, object, nil
+		}
+	}
+
+	return nil, nil, &ErrObjectNotFound{Uid: uid.String()}
+}
+
+// placement returns the volume for a new object, the named one or the first writable volume
+func (memory *Memory) placement(options *Options) (*MemoryVolume, error) {
+	if options != nil && options.VolumeName != "" {
+		volume, ok := memory.volumes[options.VolumeName]
+		if !ok {
+			return nil, &ErrInvalidVolumeName{options.VolumeName}
+		}
+
+		return volume, nil
+	}
+
+	for _, name := range memory.Volumes() {
+		if !memory.volumes[name].ReadOnly {
+			return memory.volumes[name], nil
+		}
+	}
+
+	return nil, &ErrNoVolumeAvailable{}
+}
+
+func (memory *Memory) Store(suid string, source io.Reader, options *Options) (string, *[]byte, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	volume, _, err := memory.find(uid, options)
+	if err == nil {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+	if _, ok := err.(*ErrObjectNotFound); ok {
+		volume, err = memory.placement(options)
+	}
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	if volume.ReadOnly {
+		return "", nil, &ErrVolumeReadOnly{volume.Name}
+	}
+
+	buf := bytes.Buffer{}
+
+	digest, _, err := copyDigest(&buf, source, volume.Hash, nil, false)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	volume.mu.Lock()
+	defer volume.mu.Unlock()
+
+	// a concurrent store may have won the race since the lookup
+	if _, ok := volume.objects[uid.String()]; ok {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+
+	volume.objects[uid.String()] = &memoryObject{data: buf.Bytes(), digest: digest, modTime: time.Now()}
+
+	return uid.String(), &digest.Value, nil
+}
+
+// Load returns an empty path since there is no file behind the object
+func (memory *Memory) Load(suid string, dest io.Writer, options *Options) (string, *[]byte, int64, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	volume, object, err := memory.find(uid, options)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	digest, n, err := copyDigest(dest, bytes.NewReader(object.data), volume.Hash, object.digest, options != nil && options.Verify)
+	err = objectError(err, volume.Name, uid.String())
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	return "", &digest.Value, n, nil
+}
+
+func (memory *Memory) Open(suid string, options *Options) (io.ReadSeekCloser, *ObjectInfo, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	_, object, err := memory.find(uid, options)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	return memoryReader{bytes.NewReader(object.data)}, &ObjectInfo{Path: uid.String(), Size: int64(len(object.data)), ModTime: object.modTime, Digest: object.digest}, nil
+}
+
+func (memory *Memory) Delete(suid string, options *Options) error {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return err
+	}
+
+	volume, _, err := memory.find(uid, options)
+	if common.Error(err) {
+		return err
+	}
+
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
+
+	volume.mu.Lock()
+	delete(volume.objects, uid.String())
+	volume.mu.Unlock()
+
+	return nil
+}
+
+// Rebuild saves a bucket for every object, in the order of volume names and uids
+func (memory *Memory) Rebuild(job *RebuildJob) (int, error) {
+	resumeVolume, resumeUid, _ := strings.Cut(job.Resume(), "|")
+
+	c := 0
+
+	for _, name := range memory.Volumes() {
+		if job.Resume() != "" && name < resumeVolume {
+			continue
+		}
+
+		volume := memory.volumes[name]
+
+		volume.mu.RLock()
+		uids := make([]string, 0, len(volume.objects))
+		for uid := range volume.objects {
+			uids = append(uids, uid)
+		}
+		volume.mu.RUnlock()
+
+		sort.Strings(uids)
+
+		for _, uid := range uids {
+			if name == resumeVolume && uid <= resumeUid {
+				continue
+			}
+
+			if !job.Submit(name+"|"+uid, func() error {
+				_, err := saveBucket(memory, uid, []string{uid})
+
+				return err
+			}) {
+				return c, nil
+			}
+
+			c++
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/mpetavy/tresor/service/index"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	memory, err := NewMemory()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = memory.Init(&Cfg{Driver: TYPE_MEMORY, Volumes: []VolumeCfg{{Name: t.Name()}, {Name: t.Name() + "-ro", ReadOnly: true}}})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer memory.Volume(t.Name()).Clear()
+
+	uid, h, err := memory.Store("a@b.txt", bytes.NewReader([]byte("hello")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, NewFsUID("a/b.txt").String(), uid)
+
+	_, _, err = memory.Store(uid, bytes.NewReader([]byte("overwritten")), nil)
+	require.IsType(t, &ErrObjectAlreadyExists{}, err, "existing objects are never overwritten")
+
+	other, err := NewMemory()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = other.Init(&Cfg{Driver: TYPE_MEMORY, Volumes: []VolumeCfg{{Name: t.Name()}}})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+
+	_, loaded, n, err := other.Load("a/b.txt", &buf, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "hello", buf.String(), "handles share the volume")
+	require.Equal(t, int64(5), n)
+	require.Equal(t, hex.EncodeToString(*h), hex.EncodeToString(*loaded))
+
+	reader, info, err := memory.Open(uid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, err = reader.Seek(1, io.SeekStart)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "ello", string(ba))
+	require.Equal(t, int64(5), info.Size)
+	require.Equal(t, *h, info.Digest.Value)
+
+	memory.Volume(t.Name()).objects[uid].data = []byte("jello")
+
+	_, _, _, err = memory.Load(uid, io.Discard, &Options{Verify: true})
+	require.IsType(t, &ErrObjectCorrupted{}, err)
+
+	_, _, err = memory.Store("c.txt", bytes.NewReader([]byte("c")), &Options{VolumeName: t.Name() + "-ro"})
+	require.IsType(t, &ErrVolumeReadOnly{}, err)
+
+	_, _, err = memory.Store("../c.txt", bytes.NewReader([]byte("c")), nil)
+	require.IsType(t, &ErrUnsafePath{}, err)
+
+	err = memory.Delete(uid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = memory.Load(uid, io.Discard, nil)
+	require.IsType(t, &ErrObjectNotFound{}, err)
+}
+
+// startMemoryServices runs the database and index services with the memory drivers for tests which save buckets
+func startMemoryServices(t *testing.T) func() {
+	router := mux.NewRouter()
+
+	err := database.Init(&database.Cfg{Driver: database.TYPE_MEMORY, Instance: t.Name()}, router)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = index.Init(&index.Cfg{Driver: index.MEMORY_INDEXER}, router)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	return func() {
+		index.Close()
+		database.Close()
+	}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	PLACEMENT_FILL_FIRST      = "fill-first"
+	PLACEMENT_ROUND_ROBIN     = "round-robin"
+	PLACEMENT_MOST_FREE_SPACE = "most-free-space"
+)
+
+type RouteCfg struct {
+	// MimeType is an exact mime type, a wildcard like "image/*" or "*"
+	MimeType string   `json:"mimeType" html:"Mime type"`
+	Volumes  []string `json:"volumes" html:"Volumes"`
+}
+
+type PlacementCfg struct {
+	Strategy string     `json:"strategy" html:"Strategy"`
+	Routes   []RouteCfg `json:"routes" html:"Routes"`
+}
+
+// placementVolume describes a volume as candidate for storing a new object
+type placementVolume struct {
+	Name     string
+	Path     string
+	ReadOnly bool
+	Capacity int64
+}
+
+var (
+	volumeUsage   = make(map[string]int64)
+	volumeUsageMu sync.Mutex
+	roundRobin    uint64
+)
+
+func (cfg *PlacementCfg) validate() error {
+	switch cfg.Strategy {
+	case "", PLACEMENT_FILL_FIRST, PLACEMENT_ROUND_ROBIN, PLACEMENT_MOST_FREE_SPACE:
+		return nil
+	default:
+		return &ErrInvalidPlacementStrategy{cfg.Strategy}
+	}
+}
+
+// diskUsage returns the bytes of the regular files at or below path, files and directories named skip are left out
+func diskUsage(path string, skip string) int64 {
+	var n int64
+
+	common.DebugError(filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if skip != "" && info.Name() == skip {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			n += info.Size()
+		}
+
+		return nil
+	}))
+
+	return n
+}
+
+// objectUsage returns the bytes of the loose object at path together with its record
+func objectUsage(path string) int64 {
+	return diskUsage(path, "") + diskUsage(path+DIGEST_SUFFIX, "")
+}
+
+// usage returns the bytes stored in the volume including its trash, the volume is walked once per process
+func usage(path string) (int64, error) {
+	volumeUsageMu.Lock()
+	defer volumeUsageMu.Unlock()
+
+	if n, ok := volumeUsage[path]; ok {
+		return n, nil
+	}
+
+	n := diskUsage(path, META_DIR) + diskUsage(metaPath(path, TRASH_DIR), TRASH_MANIFEST)
+
+	volumeUsage[path] = n
+
+	return n, nil
+}
+
+func addUsage(path string, n int64) {
+	volumeUsageMu.Lock()
+	defer volumeUsageMu.Unlock()
+
+	if _, ok := volumeUsage[path]; ok {
+		volumeUsage[path] += n
+	}
+}
+
+// available returns the bytes which can still be stored in the volume
+func (v *placementVolume) available() (int64, error) {
+	if v.Path == "" {
+		return math.MaxInt64, nil
+	}
+
+	free, err := diskFree(v.Path)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	if v.Capacity > 0 {
+		used, err := usage(v.Path)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		free = min(free, v.Capacity-used)
+	}
+
+	return free, nil
+}
+
+func matchMimeType(pattern string, mimeType string) bool {
+	if pattern == "*" || pattern == mimeType {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return false
+}
+
+// routed returns the volumes the first matching route allows for the mime type or nil if all volumes are allowed
+func (cfg *PlacementCfg) routed(mimeType string) []string {
+	for _, route := range cfg.Routes {
+		if matchMimeType(route.MimeType, mimeType) {
+			return route.Volumes
+		}
+	}
+
+	return nil
+}
+
+// sniffMimeType detects the mime type of the content and returns a reader which still delivers the complete content
+func sniffMimeType(source io.Reader, name string) (string, io.Reader, error) {
+	header := make([]byte, HEADER_SIZE)
+
+	n, err := io.ReadFull(source, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+
+	header = header[:n]
+
+	mt, err := common.DetectMimeType(name, header)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	return mt.MimeType, io.MultiReader(bytes.NewReader(header), source), nil
+}
+
+// selectVolume chooses the volume for a new object of the expected size, 0 if unknown. Volumes are considered
+// in the order of their names, read-only volumes and those without room for the object are skipped.
+func selectVolume(cfg *PlacementCfg, volumes []placementVolume, mimeType string, size int64) (string, error) {
+	if cfg == nil {
+		cfg = &PlacementCfg{}
+	}
+
+	var allowed []string
+	if mimeType != "" {
+		allowed = cfg.routed(mimeType)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+
+	var candidates []placementVolume
+	var free []int64
+
+	for _, v := range volumes {
+		if v.ReadOnly || (allowed != nil && !slices.Contains(allowed, v.Name)) {
+			continue
+		}
+
+		n, err := v.available()
+		if common.Error(err) {
+			return "", err
+		}
+
+		if n <= 0 || n < size {
+			continue
+		}
+
+		candidates = append(candidates, v)
+		free = append(free, n)
+	}
+
+	if len(candidates) == 0 {
+		return "", &ErrNoVolumeAvailable{MimeType: common.Eval(mimeType != "", mimeType, "*")}
+	}
+
+	switch cfg.Strategy {
+	case PLACEMENT_ROUND_ROBIN:
+		return candidates[(atomic.AddUint64(&roundRobin, 1)-1)%uint64(len(candidates))].Name, nil
+	case PLACEMENT_MOST_FREE_SPACE:
+		best := 0
+		for i := range candidates {
+			if free[i] > free[best] {
+				best = i
+			}
+		}
+
+		return candidates[best].Name, nil
+	default:
+		return candidates[0].Name, nil
+	}
+}
+
+// placeObject selects the volume for a new object of the expected size and returns the reader which delivers
+// the complete object
+func placeObject(cfg *PlacementCfg, volumes []placementVolume, source io.Reader, name string, size int64) (string, io.Reader, error) {
+	mimeType := ""
+
+	if cfg != nil && len(cfg.Routes) > 0 {
+		var err error
+
+		mimeType, source, err = sniffMimeType(source, name)
+		if common.Error(err) {
+			return "", nil, err
+		}
+	}
+
+	volume, err := selectVolume(cfg, volumes, mimeType, size)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	return volume, source, nil
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlacement(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	volumes := make([]placementVolume, 0)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		p := filepath.Join(path, name)
+
+		err := os.MkdirAll(p, common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		volumes = append(volumes, placementVolume{Name: name, Path: p})
+	}
+
+	// "a" is retired, "b" is full
+	volumes[0].ReadOnly = true
+	volumes[1].Capacity = 10
+
+	err = os.WriteFile(filepath.Join(volumes[1].Path, "full"), make([]byte, 10), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	name, err := selectVolume(&PlacementCfg{Strategy: PLACEMENT_FILL_FIRST}, volumes, "", 0)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "c", name, "Fill first skips read-only and full volumes")
+
+	volumes[2].Capacity = 100
+
+	name, err = selectVolume(&PlacementCfg{Strategy: PLACEMENT_FILL_FIRST}, volumes, "", 200)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "d", name, "Fill first skips volumes without room for the object")
+
+	volumes[2].Capacity = 0
+
+	cfg := &PlacementCfg{Strategy: PLACEMENT_ROUND_ROBIN}
+
+	names := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		name, err := selectVolume(cfg, volumes, "", 0)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		names[name] = true
+	}
+
+	require.Equal(t, map[string]bool{"c": true, "d": true}, names, "Round robin over writable volumes")
+
+	cfg = &PlacementCfg{Routes: []RouteCfg{{MimeType: "image/*", Volumes: []string{"d"}}, {MimeType: "application/pdf", Volumes: []string{"a", "b"}}}}
+
+	name, err = selectVolume(cfg, volumes, "image/jpeg", 0)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "d", name, "Routed by mime type")
+
+	_, err = selectVolume(cfg, volumes, "application/pdf", 0)
+	_, ok := err.(*ErrNoVolumeAvailable)
+	require.True(t, ok, "No writable volume for routed mime type")
+
+	require.NotNil(t, (&PlacementCfg{Strategy: "random"}).validate(), "Unknown strategy")
+}
+
+func TestUsage(t *testing.T) {
+	for _, zip := range []bool{false, true} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+
+		used, err := usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(make([]byte, 1000)), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		_, _, err = sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader(make([]byte, 1000)), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		stored, err := usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Greater(t, stored, used)
+
+		// the deleted object stays in the trash until it is purged
+		err = sha.Delete(suid, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		n, err := usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, stored, n)
+
+		sha.grace = time.Nanosecond
+
+		_, err = sha.Purge()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		n, err = usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Less(t, n, stored, "purged bytes are freed")
+
+		sha.grace = 0
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Delete(NewShaUID(uid.Id+1, 0, "").String(), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		n, err = usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, used, n, "deleted bytes are freed")
+
+		volumeUsageMu.Lock()
+		delete(volumeUsage, path)
+		volumeUsageMu.Unlock()
+
+		walked, err := usage(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, walked, n, "accounting matches the volume")
+	}
+}
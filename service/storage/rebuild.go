@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	REBUILD = "rebuild"
+	// REBUILD_CHECKPOINT is the default file an interrupted rebuild resumes from
+	REBUILD_CHECKPOINT = "tresor-rebuild.json"
+	// REBUILD_CHECKPOINT_INTERVAL is the minimum time between two writes of the checkpoint
+	REBUILD_CHECKPOINT_INTERVAL = time.Second * 5
+)
+
+type RebuildStatus struct {
+	Running    bool      `json:"running"`
+	Canceled   bool      `json:"canceled"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Workers    int       `json:"workers"`
+	Resumed    string    `json:"resumed"`
+	Checkpoint string    `json:"checkpoint"`
+	Queued     int       `json:"queued"`
+	Done       int       `json:"done"`
+	Errors     int       `json:"errors"`
+}
+
+// rebuildCheckpoint is persisted while a rebuild runs and removed once it completes
+type rebuildCheckpoint struct {
+	Driver     string `json:"driver"`
+	Checkpoint string `json:"checkpoint"`
+}
+
+var (
+	rebuildStatus RebuildStatus
+	rebuildMu     sync.Mutex
+	rebuildStop   chan struct{}
+)
+
+type rebuildTask struct {
+	seq int
+	key string
+	fn  func() error
+}
+
+// RebuildJob runs the buckets a driver submits on a bounded pool of workers and tracks the checkpoint,
+// the key of the last bucket up to which all buckets are rebuilt successfully
+type RebuildJob struct {
+	resume string
+	stop   chan struct{}
+	tasks  chan rebuildTask
+	wg     sync.WaitGroup
+	seq    int
+	next   int
+	failed int
+	done   map[int]string
+	file   string
+	driver string
+	saved  time.Time
+}
+
+func newRebuildJob(workers int, driver string, file string, resume string, stop chan struct{}) *RebuildJob {
+	job := &RebuildJob{
+		resume: resume,
+		stop:   stop,
+		tasks:  make(chan rebuildTask),
+		failed: -1,
+		done:   make(map[int]string),
+		file:   file,
+		driver: driver,
+		saved:  time.Now(),
+	}
+
+	for i := 0; i < workers; i++ {
+		job.wg.Add(1)
+
+		go job.work()
+	}
+
+	return job
+}
+
+// Resume returns the key of the checkpoint an interrupted rebuild stopped at or an empty string
+func (job *RebuildJob) Resume() string {
+	return job.resume
+}
+
+// Submit queues the rebuild of the bucket identified by key and blocks while all workers are busy.
+// Keys must be submitted in the order the driver resumes in. It returns false once the job is canceled.
+func (job *RebuildJob) Submit(key string, fn func() error) bool {
+	if stopped(job.stop) {
+		return false
+	}
+
+	select {
+	case <-job.stop:
+		return false
+	case job.tasks <- rebuildTask{seq: job.seq, key: key, fn: fn}:
+	}
+
+	job.seq++
+
+	rebuildMu.Lock()
+	rebuildStatus.Queued++
+	rebuildMu.Unlock()
+
+	return true
+}
+
+func (job *RebuildJob) work() {
+	defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+	defer job.wg.Done()
+
+	for task := range job.tasks {
+		err := task.fn()
+		common.Error(err)
+
+		job.complete(task, err)
+	}
+}
+
+// complete advances the checkpoint over all buckets which are done without a gap. It stops before the first
+// failed bucket so a resumed rebuild retries it.
+func (job *RebuildJob) complete(task rebuildTask, err error) {
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+
+	if err != nil {
+		rebuildStatus.Errors++
+
+		if job.failed == -1 || task.seq < job.failed {
+			job.failed = task.seq
+		}
+	} else {
+		rebuildStatus.Done++
+
+		if job.failed == -1 || task.seq < job.failed {
+			job.done[task.seq] = task.key
+		}
+	}
+
+	for job.failed == -1 || job.next < job.failed {
+		key, ok := job.done[job.next]
+		if !ok {
+			break
+		}
+
+		delete(job.done, job.next)
+		job.next++
+
+		rebuildStatus.Checkpoint = key
+	}
+
+	if time.Since(job.saved) > REBUILD_CHECKPOINT_INTERVAL {
+		job.saved = time.Now()
+
+		common.Error(saveCheckpoint(job.file, job.driver, rebuildStatus.Checkpoint))
+	}
+}
+
+// wait lets the workers finish all submitted buckets
+func (job *RebuildJob) wait() {
+	close(job.tasks)
+
+	job.wg.Wait()
+}
+
+func loadCheckpoint(file string, driver string) (string, error) {
+	ba, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if common.Error(err) {
+		return "", err
+	}
+
+	checkpoint := rebuildCheckpoint{}
+
+	err = json.Unmarshal(ba, &checkpoint)
+	if err != nil || checkpoint.Driver != driver {
+		common.Warn("ignore invalid rebuild checkpoint: %s", file)
+
+		return "", nil
+	}
+
+	return checkpoint.Checkpoint, nil
+}
+
+func saveCheckpoint(file string, driver string, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	ba, err := json.Marshal(&rebuildCheckpoint{Driver: driver, Checkpoint: key})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeFileAtomic(file, ba)
+}
+
+// rebuild runs the rebuild of the driver as job. The checkpoint is kept if the rebuild is canceled or fails.
+func rebuild(handle Handle, driver string, workers int, file string) (*RebuildStatus, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	rebuildMu.Lock()
+
+	if rebuildStatus.Running {
+		rebuildMu.Unlock()
+
+		return nil, &ErrRebuildRunning{}
+	}
+
+	resume, err := loadCheckpoint(file, driver)
+	if common.Error(err) {
+		rebuildMu.Unlock()
+
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	rebuildStop = stop
+	rebuildStatus = RebuildStatus{Running: true, StartedAt: time.Now(), Workers: workers, Resumed: resume, Checkpoint: resume}
+
+	rebuildMu.Unlock()
+
+	if resume != "" {
+		common.Info("Rebuild resumed after %s ...", resume)
+	} else {
+		common.Info("Rebuild started ...")
+	}
+
+	job := newRebuildJob(workers, driver, file, resume, stop)
+
+	_, err = handle.Rebuild(job)
+
+	job.wait()
+
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+
+	rebuildStatus.Running = false
+	rebuildStatus.Canceled = stopped(stop)
+	rebuildStatus.FinishedAt = time.Now()
+	rebuildStop = nil
+
+	status := rebuildStatus
+
+	if err != nil || status.Canceled || status.Errors > 0 {
+		common.Error(saveCheckpoint(file, driver, status.Checkpoint))
+	} else if common.FileExists(file) {
+		common.Error(os.Remove(file))
+	}
+
+	if common.Error(err) {
+		return &status, err
+	}
+
+	if status.Canceled {
+		common.Info("Rebuild canceled at %s. time needed %v, %d buckets", status.Checkpoint, status.FinishedAt.Sub(status.StartedAt), status.Done)
+	} else {
+		common.Info("Rebuild successfully completed. time needed %v, %d buckets", status.FinishedAt.Sub(status.StartedAt), status.Done)
+	}
+
+	return &status, nil
+}
+
+// Rebuild recreates the buckets of all stored objects in the database, resuming an interrupted rebuild
+func Rebuild(handle Handle) (*RebuildStatus, error) {
+	return rebuild(handle, cfg.Driver, cfg.RebuildWorkers, common.Eval(cfg.RebuildCheckpoint != "", cfg.RebuildCheckpoint, REBUILD_CHECKPOINT))
+}
+
+// cancelRebuild stops a running rebuild after the buckets in progress
+func cancelRebuild() bool {
+	rebuildMu.Lock()
+	defer rebuildMu.Unlock()
+
+	if rebuildStop == nil || stopped(rebuildStop) {
+		return false
+	}
+
+	close(rebuildStop)
+
+	return true
+}
+
+// compareWalkOrder compares two slash separated paths in the order filepath.Walk visits them
+func compareWalkOrder(a string, b string) int {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(as) - len(bs)
+}
+
+// rebuildHandler starts a rebuild with POST, cancels it with DELETE and reports its progress with GET
+func rebuildHandler(rw http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		rebuildMu.Lock()
+		running := rebuildStatus.Running
+		rebuildMu.Unlock()
+
+		if running {
+			return &ErrRebuildRunning{}
+		}
+
+		go func() {
+			defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+
+			common.Error(Exec(func(handle Handle) error {
+				_, err := Rebuild(handle)
+
+				return err
+			}))
+		}()
+
+		rw.WriteHeader(http.StatusAccepted)
+
+		return nil
+	case http.MethodDelete:
+		if !cancelRebuild() {
+			return &ErrObjectNotFound{Uid: REBUILD}
+		}
+
+		rw.WriteHeader(http.StatusAccepted)
+
+		return nil
+	}
+
+	rebuildMu.Lock()
+	status := rebuildStatus
+	rebuildMu.Unlock()
+
+	return writeJson(rw, http.StatusOK, &status)
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+// rebuildHandle submits a fixed number of buckets, cancels the rebuild at a given key and fails another
+type rebuildHandle struct {
+	Handle
+	buckets int
+	cancel  string
+	fail    string
+	mu      sync.Mutex
+	rebuilt map[string]int
+}
+
+func (h *rebuildHandle) Rebuild(job *RebuildJob) (int, error) {
+	c := 0
+
+	for i := 1; i <= h.buckets; i++ {
+		key := fmt.Sprintf("%04d", i)
+
+		if key <= job.Resume() {
+			continue
+		}
+
+		if !job.Submit(key, func() error {
+			h.mu.Lock()
+			h.rebuilt[key]++
+			h.mu.Unlock()
+
+			if key == h.cancel {
+				cancelRebuild()
+			}
+
+			if key == h.fail {
+				return fmt.Errorf("cannot rebuild %s", key)
+			}
+
+			return nil
+		}) {
+			break
+		}
+
+		c++
+	}
+
+	return c, nil
+}
+
+func TestRebuild(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	file := filepath.Join(path, REBUILD_CHECKPOINT)
+
+	h := &rebuildHandle{buckets: 1000, cancel: "0400", rebuilt: make(map[string]int)}
+
+	status, err := rebuild(h, TYPE_SHA, 4, file)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.True(t, status.Canceled)
+	require.Equal(t, status.Queued, status.Done, "buckets in progress are finished")
+	require.True(t, status.Checkpoint >= "0400", "checkpoint reached the cancel point")
+
+	for i := 1; i <= 400; i++ {
+		require.Equal(t, 1, h.rebuilt[fmt.Sprintf("%04d", i)])
+	}
+
+	resume, err := loadCheckpoint(file, TYPE_SHA)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, status.Checkpoint, resume, "checkpoint persisted")
+
+	h.cancel = ""
+
+	status, err = rebuild(h, TYPE_SHA, 4, file)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.False(t, status.Canceled)
+	require.Equal(t, resume, status.Resumed)
+	require.Equal(t, "1000", status.Checkpoint)
+	require.Equal(t, 1000, len(h.rebuilt), "all buckets rebuilt")
+	require.False(t, common.FileExists(file), "checkpoint removed after completion")
+
+	require.True(t, compareWalkOrder("a/b", "a-c") < 0, "walk order descends before siblings")
+	require.True(t, compareWalkOrder("a", "a/b") < 0, "directory before its content")
+}
+
+func TestRebuildFailed(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	file := filepath.Join(path, REBUILD_CHECKPOINT)
+
+	h := &rebuildHandle{buckets: 100, fail: "0050", rebuilt: make(map[string]int)}
+
+	status, err := rebuild(h, TYPE_SHA, 4, file)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, status.Errors)
+	require.Equal(t, 99, status.Done)
+	require.Equal(t, "0049", status.Checkpoint, "checkpoint stops before the failed bucket")
+
+	resume, err := loadCheckpoint(file, TYPE_SHA)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "0049", resume, "checkpoint persisted")
+
+	h.fail = ""
+
+	status, err = rebuild(h, TYPE_SHA, 4, file)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 0, status.Errors)
+	require.Equal(t, "0100", status.Checkpoint)
+	require.Equal(t, 2, h.rebuilt["0050"], "failed bucket is retried")
+	require.Equal(t, 1, h.rebuilt["0049"])
+	require.False(t, common.FileExists(file), "checkpoint removed after completion")
+}
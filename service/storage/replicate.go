@@ -0,0 +1,497 @@
+package storage
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/service/cluster"
+)
+
+const (
+	REPAIR = "repair"
+)
+
+type RepairResult struct {
+	Repaired int `json:"repaired"`
+}
+
+// validateReplicas checks that every replica is a distinct volume which neither has replicas itself
+// nor serves as replica of another volume
+func (sha *Sha) validateReplicas() error {
+	replicas := make(map[string]bool)
+
+	for _, volume := range sha.volumes {
+		for _, name := range volume.Replicas {
+			replica, ok := sha.volumes[name]
+			if !ok || replica == volume || len(replica.Replicas) > 0 || replicas[name] {
+				return &ErrInvalidVolumeName{name}
+			}
+
+			replicas[name] = true
+		}
+
+		if volume.Quorum < 0 || volume.Quorum > len(volume.Replicas)+1 {
+			return &ErrInvalidQuorum{Volume: volume.Name, Quorum: volume.Quorum}
+		}
+	}
+
+	return nil
+}
+
+// quorum returns the number of copies which must be written or deleted
+func (volume *ShaVolume) quorum() int {
+	if volume.Quorum == 0 {
+		return len(volume.Replicas) + 1
+	}
+
+	return volume.Quorum
+}
+
+func (sha *Sha) isReplica(volume *ShaVolume) bool {
+	return sha.primary(volume) != volume
+}
+
+func (sha *Sha) isReplicated(volume *ShaVolume) bool {
+	return len(volume.Replicas) > 0 || sha.isReplica(volume)
+}
+
+// primary returns the volume which volume is a replica of or volume itself
+func (sha *Sha) primary(volume *ShaVolume) *ShaVolume {
+	for _, v := range sha.volumes {
+		for _, name := range v.Replicas {
+			if name == volume.Name {
+				return v
+			}
+		}
+	}
+
+	return volume
+}
+
+// replicaSet returns the primary followed by its replicas
+func (sha *Sha) replicaSet(primary *ShaVolume) []*ShaVolume {
+	l := []*ShaVolume{primary}
+
+	for _, name := range primary.Replicas {
+		l = append(l, sha.volumes[name])
+	}
+
+	return l
+}
+
+// openObject opens the object of the uid on a single volume
+func openObject(volume *ShaVolume, uid *ShaUID) (io.ReadCloser, error) {
+	if volume.Zip {
+		container, err := createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if isRegularFile(container) {
+			reader, _, err := openZipEntry(volume, uid, container)
+
+			return reader, err
+		}
+	}
+
+	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if !isRegularFile(path) {
+		return nil, &ErrObjectNotFound{volume.Name, uid.String()}
+	}
+
+	reader, _, err := openFile(volume.Name, uid.String(), path, path+DIGEST_SUFFIX, volume.formatted(), volume.keys)
+
+	return reader, err
+}
+
+// checkObject reads the object found at path and verifies it against its recorded digest
+func checkObject(volume *ShaVolume, uid *ShaUID, path string) error {
+	var err error
+
+	if isZipContainer(path) {
+		_, _, err = loadZipEntry(volume, uid, path, io.Discard, true)
+	} else {
+		var expected *record
+
+		expected, err = readRecordFile(path+DIGEST_SUFFIX, volume.formatted())
+		if common.Error(err) {
+			return err
+		}
+
+		var source *os.File
+
+		source, err = os.Open(path)
+		if common.Error(err) {
+			return err
+		}
+		defer func() {
+			common.DebugError(source.Close())
+		}()
+
+		var reader io.ReadCloser
+
+		reader, err = plainReader(source, expected.format, volume.keys)
+		if err == nil {
+			_, _, err = copyDigest(io.Discard, reader, volume.Hash, expected.digest, true)
+
+			common.DebugError(reader.Close())
+		}
+	}
+
+	return objectError(err, volume.Name, uid.String())
+}
+
+func (sha *Sha) copyObject(from *ShaVolume, to *ShaVolume, uid *ShaUID) error {
+	source, err := openObject(from, uid)
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(source.Close())
+	}()
+
+	_, err = sha.storeObject(to, uid, source)
+
+	return err
+}
+
+// replicate copies the object just stored on the primary to its replicas. If fewer copies than the
+// quorum requires could be written all copies are removed again.
+func (sha *Sha) replicate(primary *ShaVolume, uid *ShaUID) error {
+	if len(primary.Replicas) == 0 || uid.Object == "" {
+		return nil
+	}
+
+	stored := []*ShaVolume{primary}
+
+	for _, replica := range sha.replicaSet(primary)[1:] {
+		err := sha.copyObject(primary, replica, uid)
+		if err != nil {
+			common.Warn("replication of %s to volume %s failed: %v", uid.String(), replica.Name, err)
+
+			continue
+		}
+
+		stored = append(stored, replica)
+	}
+
+	if len(stored) >= primary.quorum() {
+		return nil
+	}
+
+	for _, volume := range stored {
+		common.Error(sha.deleteObject(volume, uid))
+	}
+
+	return &ErrQuorumNotReached{Uid: uid.String(), Required: primary.quorum(), Reached: len(stored)}
+}
+
+// deleteReplicated removes the uid from the primary and all its replicas
+func (sha *Sha) deleteReplicated(primary *ShaVolume, uid *ShaUID) error {
+	return sha.removeReplicated(primary, uid, func(volume *ShaVolume) error {
+		return sha.deleteObject(volume, uid)
+	})
+}
+
+// removeReplicated applies remove to the primary and all its replicas. A copy which is already missing
+// counts as removed.
+func (sha *Sha) removeReplicated(primary *ShaVolume, uid *ShaUID, remove func(volume *ShaVolume) error) error {
+	volumes := sha.replicaSet(primary)
+
+	if len(volumes) == 1 {
+		return remove(primary)
+	}
+
+	for _, volume := range volumes {
+		if volume.ReadOnly {
+			return &ErrVolumeReadOnly{volume.Name}
+		}
+	}
+
+	deleted := 0
+
+	for _, volume := range volumes {
+		err := remove(volume)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			err = nil
+		}
+
+		if err != nil {
+			common.Warn("deletion of %s on volume %s failed: %v", uid.String(), volume.Name, err)
+
+			continue
+		}
+
+		deleted++
+	}
+
+	if deleted < primary.quorum() {
+		return &ErrQuorumNotReached{Uid: uid.String(), Required: primary.quorum(), Reached: deleted}
+	}
+
+	return nil
+}
+
+// listObjects returns the names of the objects stored in a version of an uid on a single volume
+func listObjects(volume *ShaVolume, uid *ShaUID) ([]string, error) {
+	var names []string
+
+	if volume.Zip {
+		container, err := createShaPath(volume.Path, uid, volume.Flat, true)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if isRegularFile(container) {
+			r, err := zip.OpenReader(container)
+			if common.Error(err) {
+				return nil, err
+			}
+			defer func() {
+				common.DebugError(r.Close())
+			}()
+
+			for _, f := range r.File {
+				if f.Name != ZIP_MANIFEST {
+					names = append(names, f.Name)
+				}
+			}
+
+			return names, nil
+		}
+	}
+
+	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if !common.IsDirectory(path) {
+		return nil, nil
+	}
+
+	files, err := os.ReadDir(path)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.Type().IsRegular() && !isDigestSidecar(file.Name()) && !isTemp(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// repairObject re-copies the object to every volume of the set which lost it or holds a corrupted copy
+func (sha *Sha) repairObject(volumes []*ShaVolume, uid *ShaUID) (int, error) {
+	var good *ShaVolume
+	var bad []*ShaVolume
+
+	for _, volume := range volumes {
+		path, err := locate(volume, uid)
+		if err == nil {
+			err = checkObject(volume, uid, path)
+		}
+
+		switch err.(type) {
+		case nil:
+			if good == nil {
+				good = volume
+			}
+		case *ErrObjectNotFound, *ErrObjectCorrupted, *ErrDecryptionFailed:
+			bad = append(bad, volume)
+		default:
+			return 0, err
+		}
+	}
+
+	if good == nil {
+		common.Warn("no valid copy of %s left to repair from", uid.String())
+
+		return 0, nil
+	}
+
+	c := 0
+
+	for _, volume := range bad {
+		if volume.ReadOnly {
+			continue
+		}
+
+		err := sha.deleteObject(volume, uid)
+		if _, ok := err.(*ErrObjectNotFound); !ok && common.Error(err) {
+			return c, err
+		}
+
+		err = sha.copyObject(good, volume, uid)
+		if common.Error(err) {
+			return c, err
+		}
+
+		common.Info("repaired %s on volume %s from volume %s", uid.String(), volume.Name, good.Name)
+
+		c++
+	}
+
+	return c, nil
+}
+
+// repairUid repairs all objects of all versions of an id within a replica set, up to the highest version
+// found on any volume of the set
+func (sha *Sha) repairUid(volumes []*ShaVolume, id int) (int, error) {
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(id)))
+
+	current := 0
+
+	for _, volume := range volumes {
+		path, err := locate(volume, NewShaUID(id, 0, ""))
+		if err != nil {
+			continue
+		}
+
+		v, err := sha.currentVersion(nil, path)
+		if common.Error(err) {
+			return 0, err
+		}
+
+		current = max(current, v)
+	}
+
+	c := 0
+
+	for version := 1; version <= current; version++ {
+		uid := NewShaUID(id, version, "")
+		names := make(map[string]bool)
+		found := false
+
+		for _, volume := range volumes {
+			if _, err := locate(volume, uid); err != nil {
+				continue
+			}
+
+			found = true
+
+			l, err := listObjects(volume, uid)
+			if common.Error(err) {
+				return c, err
+			}
+
+			for _, name := range l {
+				names[name] = true
+			}
+		}
+
+		if !found {
+			continue
+		}
+
+		objects := make([]string, 0, len(names))
+		for name := range names {
+			objects = append(objects, name)
+		}
+
+		sort.Strings(objects)
+
+		for _, object := range objects {
+			n, err := sha.repairObject(volumes, NewShaUID(id, version, object))
+			c += n
+			if common.Error(err) {
+				return c, err
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Repair re-copies all objects which replicas lost or hold corrupted from a valid copy and returns the number of repaired copies
+func (sha *Sha) Repair() (int, error) {
+	c := 0
+
+	for _, primary := range sha.storeVolumes() {
+		if len(primary.Replicas) == 0 {
+			continue
+		}
+
+		volumes := sha.replicaSet(primary)
+
+		maxId := 0
+
+		for _, volume := range volumes {
+			id, err := scanShaId(volume.Path, common.Eval(volume.Flat, 0, 3))
+			if common.Error(err) {
+				return c, err
+			}
+
+			maxId = max(maxId, id)
+		}
+
+		for id := 1; id <= maxId; id++ {
+			n, err := sha.repairUid(volumes, id)
+			c += n
+			if common.Error(err) {
+				return c, err
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// Repair re-copies the objects which replicas of the storage lost
+func Repair(handle Handle) (int, error) {
+	sha, ok := handle.(*Sha)
+	if !ok {
+		return 0, &ErrNotSupported{Driver: cfg.Driver, Operation: REPAIR}
+	}
+
+	start := time.Now()
+
+	common.Info("Repair started ...")
+
+	c, err := sha.Repair()
+	if common.Error(err) {
+		return c, err
+	}
+
+	common.Info("Repair successfully completed. time needed %v, %d copies repaired", time.Since(start), c)
+
+	return c, nil
+}
+
+// repairHandler runs a repair with POST and reports the number of repaired copies
+func repairHandler(rw http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return nil
+	}
+
+	result := RepairResult{}
+
+	err := Exec(func(handle Handle) error {
+		var err error
+
+		result.Repaired, err = Repair(handle)
+
+		return err
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeJson(rw, http.StatusOK, &result)
+}
@@ -0,0 +1,672 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/cache"
+	"github.com/mpetavy/tresor/hash"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/mpetavy/tresor/service/index"
+)
+
+const (
+	HEADER_SIZE = 4096
+)
+
+var (
+	digestNames = map[string]string{
+		hash.MD5:    "MD5",
+		hash.SHA1:   "SHA",
+		hash.SHA256: "SHA-256",
+		hash.SHA512: "SHA-512",
+	}
+)
+
+type StoredObject struct {
+	Uid    string `json:"uid"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+type StoreResult struct {
+	Uid     string         `json:"uid"`
+	Objects []StoredObject `json:"objects"`
+}
+
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+
+	return n, err
+}
+
+func removeIndex[T any](s []T, i int) []T {
+	if i < len(s) {
+		return append(s[:i], s[i+1:]...)
+	}
+
+	return s
+}
+
+// digestHeader formats a digest as RFC 3230 Digest header value
+func digestHeader(alg string, digest []byte) string {
+	return digestNames[alg] + "=" + base64.StdEncoding.EncodeToString(digest)
+}
+
+func httpError(rw http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch err.(type) {
+	case *ErrObjectNotFound:
+		status = http.StatusNotFound
+	case *ErrObjectAlreadyExists, *ErrFixityRunning, *ErrRebuildRunning, *ErrRetentionShortened:
+		status = http.StatusConflict
+	case *ErrInvalidUID, *ErrInvalidVolumeName, *ErrNoVolumesDefined, *ErrUnsafePath:
+		status = http.StatusBadRequest
+	case *ErrVolumeReadOnly, *ErrRetentionActive, *ErrLegalHold:
+		status = http.StatusForbidden
+	case *ErrNoVolumeAvailable:
+		status = http.StatusInsufficientStorage
+	case *ErrQuorumNotReached:
+		status = http.StatusServiceUnavailable
+	case *ErrNotSupported:
+		status = http.StatusNotImplemented
+	}
+
+	http.Error(rw, err.Error(), status)
+}
+
+func writeJson(rw http.ResponseWriter, status int, v interface{}) error {
+	ba, err := json.MarshalIndent(v, "", "  ")
+	if common.Error(err) {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	_, err = rw.Write(ba)
+	if common.Error(err) {
+		return err
+	}
+
+	return nil
+}
+
+// pathAddressed reports if the driver identifies objects by path like Fs instead of by Sha uid
+func pathAddressed(handle Handle) bool {
+	switch handle.(type) {
+	case *Fs, *Memory:
+		return true
+	default:
+		return false
+	}
+}
+
+// bucketRef returns the uid of the bucket an object belongs to and the file name of the object inside that bucket
+func bucketRef(handle Handle, suid string) (string, string, error) {
+	if pathAddressed(handle) {
+		uid, err := ParseFsUID(suid)
+		if common.Error(err) {
+			return "", "", err
+		}
+
+		return uid.String(), uid.String(), nil
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return "", "", err
+	}
+
+	return uid.withoutObject().String(), uid.Object, nil
+}
+
+// objectRef returns the uid of an object from the uid of its bucket and its file name inside that bucket
+func objectRef(handle Handle, bucketUid string, name string) (string, error) {
+	if pathAddressed(handle) {
+		return name, nil
+	}
+
+	uid, err := ParseShaUID(bucketUid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	uid.Object = name
+
+	return uid.String(), nil
+}
+
+// objectUID returns the uid with which the page-th object of an upload is stored
+func objectUID(handle Handle, suid string, page int) (string, error) {
+	if pathAddressed(handle) {
+		if suid == "" || page > 1 {
+			return "", &ErrInvalidUID{suid}
+		}
+
+		return suid, nil
+	}
+
+	var uid *ShaUID
+
+	if suid == "" {
+		uid = NewShaUID(0, 0, "")
+	} else {
+		var err error
+
+		uid, err = ParseShaUID(suid)
+		if common.Error(err) {
+			return "", err
+		}
+
+		if page == 1 {
+			uid.Version = 0
+		}
+	}
+
+	uid.Object = PAGE + "." + strconv.Itoa(page)
+
+	return uid.String(), nil
+}
+
+// readParts calls fn for every file of a multipart request or once for the raw request body
+func readParts(r *http.Request, fn func(io.Reader) error) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fn(r.Body)
+	}
+
+	reader, err := r.MultipartReader()
+	if common.Error(err) {
+		return err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		if part.FileName() != "" {
+			err = fn(part)
+		}
+
+		common.DebugError(part.Close())
+
+		if common.Error(err) {
+			return err
+		}
+	}
+}
+
+// indexObject loads an object and indexes its content through the index service. The content is always
+// indexed from a temp file written through Load, since the stored file may be encrypted or compressed.
+func indexObject(handle Handle, uid string) (*[]byte, int64, *index.IndexResult, error) {
+	// the extension lets the mime type detection work like on the stored file
+	temp, err := os.CreateTemp("", "tresor-index-*"+filepath.Ext(uid))
+	if common.Error(err) {
+		return nil, -1, nil, err
+	}
+	defer func() {
+		common.DebugError(temp.Close())
+		common.DebugError(os.Remove(temp.Name()))
+	}()
+
+	_, h, n, err := handle.Load(uid, temp, nil)
+	if common.Error(err) {
+		return nil, -1, nil, err
+	}
+
+	path := temp.Name()
+
+	ir := &index.IndexResult{}
+
+	err = index.Exec(func(index index.Handle) error {
+		var err error
+
+		ir.MimeType, ir.Mapping, ir.Thumbnail, ir.Fulltext, ir.Orientation, err = index.Index(path, nil)
+
+		return err
+	})
+	common.WarnError(err)
+
+	return h, n, ir, nil
+}
+
+// saveBucket indexes the objects through the index service and saves them as bucket through the database service.
+// Props which indexing does not produce, like the metadata of an import, are kept from the saved bucket.
+func saveBucket(handle Handle, uid string, objects []string) (*models.Bucket, error) {
+	bucket := models.NewBucket()
+	bucket.Uid = uid
+
+	for _, object := range objects {
+		_, name, err := bucketRef(handle, object)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		h, n, ir, err := indexObject(handle, object)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		bucket.FileNames = append(bucket.FileNames, name)
+		bucket.FileHashes = append(bucket.FileHashes, hex.EncodeToString(*h))
+		bucket.FileSizes = append(bucket.FileSizes, n)
+		bucket.FileMimeTypes = append(bucket.FileMimeTypes, ir.MimeType)
+		bucket.FileFulltext = append(bucket.FileFulltext, ir.Fulltext)
+		bucket.FileOrientation = append(bucket.FileOrientation, int(ir.Orientation))
+
+		for k, v := range ir.Mapping {
+			bucket.Props[k] = v
+		}
+	}
+
+	retention, err := bucketRetention(handle, uid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	applyRetention(&bucket, retention)
+
+	err = database.Exec(func(db database.Handle) error {
+		old := models.NewBucket()
+
+		err := db.LoadBucket("uid", bucket.Uid, &old, nil)
+		if _, ok := err.(*database.ErrNotFound); !ok {
+			if common.Error(err) {
+				return err
+			}
+
+			bucket.Id = old.Id
+			bucket.CreatedAt = old.CreatedAt
+
+			for k, v := range old.Props {
+				if _, ok := bucket.Props[k]; !ok {
+					bucket.Props[k] = v
+				}
+			}
+		}
+
+		return db.SaveBucket(&bucket, nil)
+	})
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return &bucket, nil
+}
+
+func storeHandler(rw http.ResponseWriter, r *http.Request) error {
+	uid := r.URL.Path
+	options := &Options{VolumeName: r.URL.Query().Get("volume"), Size: r.ContentLength}
+
+	result := StoreResult{}
+
+	err := Exec(func(handle Handle) error {
+		var objects []string
+
+		if sha, ok := handle.(*Sha); ok {
+			var err error
+
+			result.Uid, objects, err = storeTransaction(sha, uid, options, r, &result)
+			if common.Error(err) {
+				return err
+			}
+
+			_, err = saveBucket(handle, result.Uid, objects)
+
+			return err
+		}
+
+		err := readParts(r, func(source io.Reader) error {
+			ouid, err := objectUID(handle, uid, len(objects)+1)
+			if common.Error(err) {
+				return err
+			}
+
+			reader := &countingReader{reader: source}
+
+			ouid, h, err := handle.Store(ouid, reader, options)
+			if common.Error(err) {
+				return err
+			}
+
+			if len(objects) == 0 {
+				uid = ouid
+			}
+
+			objects = append(objects, ouid)
+			result.Objects = append(result.Objects, StoredObject{Uid: ouid, Digest: hex.EncodeToString(*h), Size: reader.n})
+
+			return nil
+		})
+		if common.Error(err) {
+			return err
+		}
+
+		if len(objects) == 0 {
+			return &ErrInvalidUID{uid}
+		}
+
+		result.Uid, _, err = bucketRef(handle, objects[0])
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = saveBucket(handle, result.Uid, objects)
+		if common.Error(err) {
+			return err
+		}
+
+		return nil
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	cache.RemovePrefix(database.QUERY)
+
+	return writeJson(rw, http.StatusCreated, &result)
+}
+
+// storeTransaction stores all parts of the request as one new version which only becomes visible once
+// every part has been received
+func storeTransaction(sha *Sha, uid string, options *Options, r *http.Request, result *StoreResult) (string, []string, error) {
+	tx, err := sha.Begin(uid, options)
+	if common.Error(err) {
+		return "", nil, err
+	}
+	defer func() {
+		common.Error(tx.Abort())
+	}()
+
+	err = readParts(r, func(source io.Reader) error {
+		reader := &countingReader{reader: source}
+
+		h, err := tx.Add(reader)
+		if common.Error(err) {
+			return err
+		}
+
+		result.Objects = append(result.Objects, StoredObject{Digest: hex.EncodeToString(*h), Size: reader.n})
+
+		return nil
+	})
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	version, objects, err := tx.Commit()
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	for i, object := range objects {
+		result.Objects[i].Uid = object
+	}
+
+	return version, objects, nil
+}
+
+// bucketDigest returns the hex digest recorded for an object in its bucket or an empty string if there is none
+func bucketDigest(handle Handle, uid string) (string, error) {
+	bucketUid, name, err := bucketRef(handle, uid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	bucket := models.NewBucket()
+
+	err = database.Exec(func(db database.Handle) error {
+		return db.LoadBucket("uid", bucketUid, &bucket, nil)
+	})
+	if _, ok := err.(*database.ErrNotFound); ok || !bucket.DeletedAt.IsZero() {
+		return "", nil
+	}
+	if common.Error(err) {
+		return "", err
+	}
+
+	for i, fileName := range bucket.FileNames {
+		if fileName == name && i < len(bucket.FileHashes) {
+			return bucket.FileHashes[i], nil
+		}
+	}
+
+	return "", nil
+}
+
+// loadHandler serves GET and HEAD requests including byte ranges and conditional requests
+func loadHandler(rw http.ResponseWriter, r *http.Request) error {
+	uid := r.URL.Path
+
+	var reader io.ReadSeekCloser
+	var info *ObjectInfo
+
+	err := Exec(func(handle Handle) error {
+		var err error
+
+		uid, err = resolveObject(handle, uid)
+		if common.Error(err) {
+			return err
+		}
+
+		if common.ToBool(r.URL.Query().Get("verify")) {
+			_, _, _, err = handle.Load(uid, io.Discard, &Options{Verify: true})
+			if common.Error(err) {
+				return err
+			}
+		}
+
+		reader, info, err = handle.Open(uid, nil)
+		if common.Error(err) {
+			return err
+		}
+
+		if info.Digest != nil {
+			return nil
+		}
+
+		digest, err := bucketDigest(handle, uid)
+		common.WarnError(err)
+
+		if digest != "" {
+			ba, err := hex.DecodeString(digest)
+			if common.Error(err) {
+				return err
+			}
+
+			info.Digest = &Digest{Algorithm: DEFAULT_HASH, Value: ba}
+		}
+
+		return nil
+	})
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
+
+	header := make([]byte, HEADER_SIZE)
+
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	mt, err := common.DetectMimeType(info.Path, header[:n])
+	if common.Error(err) {
+		return err
+	}
+
+	if info.Digest == nil && r.Method == http.MethodHead {
+		info.Digest, _, err = copyDigest(io.Discard, io.MultiReader(bytes.NewReader(header[:n]), reader), DEFAULT_HASH, nil, false)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	_, err = reader.Seek(0, io.SeekStart)
+	if common.Error(err) {
+		return err
+	}
+
+	rw.Header().Set("Content-Type", common.Eval(mt.MimeType != "", mt.MimeType, common.MimetypeApplicationOctetStream.MimeType))
+
+	if info.Digest != nil {
+		rw.Header().Set("ETag", strconv.Quote(hex.EncodeToString(info.Digest.Value)))
+		rw.Header().Set("Digest", digestHeader(info.Digest.Algorithm, info.Digest.Value))
+	}
+
+	http.ServeContent(rw, r, "", info.ModTime, reader)
+
+	return nil
+}
+
+// removeBucket deletes the bucket or removes a single file from it if the name refers to a page of the bucket
+func removeBucket(uid string, name string) error {
+	return database.Exec(func(db database.Handle) error {
+		if name == "" || name == uid {
+			return db.DeleteBucket("uid", uid, 0, nil)
+		}
+
+		bucket := models.NewBucket()
+
+		err := db.LoadBucket("uid", uid, &bucket, nil)
+		if _, ok := err.(*database.ErrNotFound); ok {
+			return nil
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		for i := len(bucket.FileNames) - 1; i >= 0; i-- {
+			if bucket.FileNames[i] != name {
+				continue
+			}
+
+			bucket.FileNames = removeIndex(bucket.FileNames, i)
+			bucket.FileMimeTypes = removeIndex(bucket.FileMimeTypes, i)
+			bucket.FileSizes = removeIndex(bucket.FileSizes, i)
+			bucket.FileHashes = removeIndex(bucket.FileHashes, i)
+			bucket.FileFulltext = removeIndex(bucket.FileFulltext, i)
+			bucket.FileOrientation = removeIndex(bucket.FileOrientation, i)
+		}
+
+		if len(bucket.FileNames) == 0 {
+			return db.DeleteBucket("", nil, bucket.Id, nil)
+		}
+
+		return db.SaveBucket(&bucket, nil)
+	})
+}
+
+// deletedBuckets returns the buckets a delete of the uid removes. All later versions are kept below
+// version 1 of an id, so a delete of the id or of its version 1 removes the buckets of all versions.
+func deletedBuckets(handle Handle, suid string, bucketUid string) ([]string, error) {
+	if pathAddressed(handle) {
+		return []string{bucketUid}, nil
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if uid.Object != "" || uid.Version > 1 {
+		return []string{bucketUid}, nil
+	}
+
+	var current int
+
+	switch h := handle.(type) {
+	case *Sha:
+		current, err = h.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+	case *S3:
+		current, err = h.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+	default:
+		return []string{bucketUid}, nil
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	var bucketUids []string
+
+	for version := 1; version <= current; version++ {
+		bucketUids = append(bucketUids, NewShaUID(uid.Id, version, "").String())
+	}
+
+	return bucketUids, nil
+}
+
+func deleteHandler(rw http.ResponseWriter, r *http.Request) error {
+	uid := r.URL.Path
+
+	err := Exec(func(handle Handle) error {
+		bucketUid, name, err := bucketRef(handle, uid)
+		if common.Error(err) {
+			return err
+		}
+
+		bucketUids, err := deletedBuckets(handle, uid, bucketUid)
+		if common.Error(err) {
+			return err
+		}
+
+		err = handle.Delete(uid, nil)
+		if common.Error(err) {
+			return err
+		}
+
+		for _, bucketUid := range bucketUids {
+			if sha, ok := handle.(*Sha); ok && sha.grace > 0 && name == "" {
+				err := markDeleted(bucketUid, true)
+				if common.Error(err) {
+					return err
+				}
+
+				continue
+			}
+
+			err := removeBucket(bucketUid, name)
+			if common.Error(err) {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	cache.RemovePrefix(database.QUERY)
+
+	rw.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/cache"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/stretchr/testify/require"
+)
+
+// serveStorage runs the storage service with the memory database and index behind a test server
+func serveStorage(t *testing.T, c *Cfg) (*httptest.Server, func()) {
+	stopServices := startMemoryServices(t)
+
+	router := mux.NewRouter()
+
+	err := Init(c, router)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(router)
+
+	return server, func() {
+		server.Close()
+		Close()
+		stopServices()
+	}
+}
+
+func doRequest(t *testing.T, method string, url string, body string, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(resp.Body.Close())
+	}()
+
+	ba, err := io.ReadAll(resp.Body)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	return resp, string(ba)
+}
+
+func TestLoadRange(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+	defer stop()
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/"+TYPE+"/", "0123456789", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	result := StoreResult{}
+
+	err = json.Unmarshal([]byte(body), &result)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	u := server.URL + "/" + TYPE + "/" + url.PathEscape(result.Objects[0].Uid)
+
+	resp, body = doRequest(t, http.MethodGet, u, "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, "0123456789", body)
+	require.Equal(t, common.MimetypeApplicationOctetStream.MimeType, resp.Header.Get("Content-Type"), "unknown type served as octet stream")
+
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	resp, body = doRequest(t, http.MethodGet, u, "", map[string]string{"Range": "bytes=2-4"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode, body)
+	require.Equal(t, "234", body)
+	require.Equal(t, "bytes 2-4/10", resp.Header.Get("Content-Range"))
+
+	resp, body = doRequest(t, http.MethodGet, u, "", map[string]string{"Range": "bytes=0-1,6-7"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode, body)
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "multipart/byteranges", mediaType)
+
+	parts := multipart.NewReader(strings.NewReader(body), params["boundary"])
+
+	for _, expected := range []struct {
+		contentRange string
+		content      string
+	}{
+		{"bytes 0-1/10", "01"},
+		{"bytes 6-7/10", "67"},
+	} {
+		part, err := parts.NextPart()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		ba, err := io.ReadAll(part)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, expected.contentRange, part.Header.Get("Content-Range"))
+		require.Equal(t, expected.content, string(ba))
+	}
+
+	_, err = parts.NextPart()
+	require.Equal(t, io.EOF, err)
+
+	resp, _ = doRequest(t, http.MethodGet, u, "", map[string]string{"Range": "bytes=20-30"})
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp, body = doRequest(t, http.MethodGet, u, "", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Empty(t, body)
+
+	resp, _ = doRequest(t, http.MethodGet, u, "", map[string]string{"If-None-Match": `"other"`})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// postObject stores content through the handler under suid
+func postObject(t *testing.T, server *httptest.Server, suid string, content string) (*http.Response, StoreResult) {
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/"+TYPE+"/"+url.PathEscape(suid), content, nil)
+
+	result := StoreResult{}
+
+	if resp.StatusCode == http.StatusCreated {
+		err := json.Unmarshal([]byte(body), &result)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	return resp, result
+}
+
+// bucketExists reports if the bucket of uid exists and is not marked deleted
+func bucketExists(t *testing.T, uid string) bool {
+	bucket := models.NewBucket()
+
+	err := database.Exec(func(db database.Handle) error {
+		return db.LoadBucket("uid", uid, &bucket, nil)
+	})
+	if _, ok := err.(*database.ErrNotFound); ok {
+		return false
+	}
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	return bucket.DeletedAt.IsZero()
+}
+
+func TestStoreHandler(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+
+	cache.Put(database.QUERY, "select * from bucket", "stale")
+
+	resp, result := postObject(t, server, "", "version 1")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "1.1", result.Uid)
+	require.Equal(t, 1, len(result.Objects))
+	require.Equal(t, int64(len("version 1")), result.Objects[0].Size)
+	require.True(t, bucketExists(t, result.Uid), "bucket saved")
+
+	_, ok := cache.Get(database.QUERY, "select * from bucket")
+	require.False(t, ok, "query cache invalidated")
+
+	resp, result = postObject(t, server, "1", "version 2")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "1.2", result.Uid, "new version of the id")
+	require.True(t, bucketExists(t, result.Uid), "bucket saved")
+
+	resp, _ = postObject(t, server, "99", "unknown")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "new version of an unknown id")
+
+	stop()
+
+	server, stop = serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path, ReadOnly: true}}})
+	defer stop()
+
+	resp, _ = postObject(t, server, "1", "version 3")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "read-only volume")
+
+	resp, _ = doRequest(t, http.MethodGet, server.URL+"/"+TYPE+"/"+url.PathEscape("1.3|"+PAGE+".1"), "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "nothing stored")
+}
+
+func TestDeleteHandler(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+
+	for _, suid := range []string{"", "1", "", "2"} {
+		resp, _ := postObject(t, server, suid, "content of "+suid)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	object := func(suid string) string {
+		return server.URL + "/" + TYPE + "/" + url.PathEscape(suid)
+	}
+
+	resp, body := doRequest(t, http.MethodDelete, object("2.2"), "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, body)
+	require.False(t, bucketExists(t, "2.2"), "bucket of the version removed")
+	require.True(t, bucketExists(t, "2.1"), "bucket of the other version kept")
+
+	resp, _ = doRequest(t, http.MethodGet, object("2.1|"+PAGE+".1"), "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "other version kept")
+
+	// version 1 holds all later versions, so they are deleted together with their buckets
+	resp, body = doRequest(t, http.MethodDelete, object("1.1"), "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, body)
+
+	for _, suid := range []string{"1.1", "1.2"} {
+		require.False(t, bucketExists(t, suid), "bucket %s removed", suid)
+
+		resp, _ = doRequest(t, http.MethodGet, object(suid+"|"+PAGE+".1"), "", nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, "object of %s removed", suid)
+	}
+
+	resp, _ = doRequest(t, http.MethodDelete, object("1.1"), "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "deleted twice")
+
+	resp, _ = doRequest(t, http.MethodDelete, object("99"), "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown id")
+
+	stop()
+
+	server, stop = serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path, ReadOnly: true}}})
+	defer stop()
+
+	resp, _ = doRequest(t, http.MethodDelete, object("2.1"), "", nil)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "read-only volume")
+
+	resp, _ = doRequest(t, http.MethodGet, object("2.1|"+PAGE+".1"), "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "object kept")
+}
+
+func TestHeadHandler(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+
+	resp, result := postObject(t, server, "", "0123456789")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	u := server.URL + "/" + TYPE + "/" + url.PathEscape(result.Objects[0].Uid)
+
+	head := func() {
+		resp, body := doRequest(t, http.MethodHead, u, "", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, body, "no content")
+		require.Equal(t, "10", resp.Header.Get("Content-Length"))
+		require.Equal(t, strconv.Quote(result.Objects[0].Digest), resp.Header.Get("ETag"))
+	}
+
+	head()
+
+	resp, _ = doRequest(t, http.MethodHead, server.URL+"/"+TYPE+"/"+url.PathEscape("99.1|"+PAGE+".1"), "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown id")
+
+	resp, _ = doRequest(t, http.MethodHead, server.URL+"/"+TYPE+"/"+url.PathEscape("1.1|"+PAGE+".2"), "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown object")
+
+	stop()
+
+	server, stop = serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path, ReadOnly: true}}})
+	defer stop()
+
+	u = server.URL + "/" + TYPE + "/" + url.PathEscape(result.Objects[0].Uid)
+
+	head()
+}
@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/cluster"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	RETENTION = "retention"
+	// RETENTION_DIR holds the retention records of the buckets inside META_DIR
+	RETENTION_DIR = "retention"
+)
+
+// Retention protects a bucket from deletion and modification until RetainUntil or while LegalHold is set
+type Retention struct {
+	RetainUntil time.Time `json:"retainUntil"`
+	LegalHold   bool      `json:"legalHold"`
+}
+
+// retainer is implemented by the drivers which enforce retention
+type retainer interface {
+	Retention(uid string) (*Retention, error)
+	SetRetention(uid string, retention *Retention) (*Retention, error)
+}
+
+func retentionPath(volumePath string, bucketUid string) string {
+	return filepath.Join(volumePath, META_DIR, RETENTION_DIR, filepath.FromSlash(bucketUid)+".json")
+}
+
+// loadRetention returns the retention recorded for a bucket or an empty retention if there is none
+func loadRetention(volumePath string, bucketUid string) (*Retention, error) {
+	retention := &Retention{}
+
+	ba, err := os.ReadFile(retentionPath(volumePath, bucketUid))
+	if os.IsNotExist(err) {
+		return retention, nil
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	err = json.Unmarshal(ba, retention)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return retention, nil
+}
+
+// saveRetention records the retention of a bucket. A retention period can only be extended.
+func saveRetention(volumePath string, bucketUid string, retention *Retention) error {
+	old, err := loadRetention(volumePath, bucketUid)
+	if common.Error(err) {
+		return err
+	}
+
+	if retention.RetainUntil.Before(old.RetainUntil) {
+		return &ErrRetentionShortened{Uid: bucketUid, Until: old.RetainUntil}
+	}
+
+	ba, err := json.Marshal(retention)
+	if common.Error(err) {
+		return err
+	}
+
+	path := retentionPath(volumePath, bucketUid)
+
+	err = os.MkdirAll(filepath.Dir(path), common.DefaultDirMode)
+	if common.Error(err) {
+		return err
+	}
+
+	return writeFileAtomic(path, ba)
+}
+
+func removeRetention(volumePath string, bucketUid string) {
+	err := os.Remove(retentionPath(volumePath, bucketUid))
+	if err != nil && !os.IsNotExist(err) {
+		common.Error(err)
+	}
+}
+
+// effectiveRetention combines the record of a bucket with the retention period in days of its volume
+// counted from the time the bucket was created
+func effectiveRetention(volumePath string, days int, bucketUid string, created time.Time) (*Retention, error) {
+	retention, err := loadRetention(volumePath, bucketUid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if days > 0 {
+		until := created.AddDate(0, 0, days)
+		if until.After(retention.RetainUntil) {
+			retention.RetainUntil = until
+		}
+	}
+
+	return retention, nil
+}
+
+// checkRetention refuses the modification of a bucket under legal hold or within its retention period
+func checkRetention(volume string, bucketUid string, retention *Retention) error {
+	if retention.LegalHold {
+		return &ErrLegalHold{Volume: volume, Uid: bucketUid}
+	}
+
+	if time.Now().Before(retention.RetainUntil) {
+		return &ErrRetentionActive{Volume: volume, Uid: bucketUid, Until: retention.RetainUntil}
+	}
+
+	return nil
+}
+
+// versionRetention returns the volume and the effective retention of a single version
+func (sha *Sha) versionRetention(uid *ShaUID) (*ShaVolume, *Retention, error) {
+	volume, path, err := sha.find(uid.withoutObject(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	volume = sha.primary(volume)
+
+	retention, err := effectiveRetention(volume.Path, volume.Retention, uid.withoutObject().String(), fi.ModTime())
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	return volume, retention, nil
+}
+
+// checkVersion refuses the modification of a version under retention
+func (sha *Sha) checkVersion(uid *ShaUID) error {
+	volume, retention, err := sha.versionRetention(uid)
+	if _, ok := err.(*ErrObjectNotFound); ok {
+		return nil
+	}
+	if common.Error(err) {
+		return err
+	}
+
+	return checkRetention(volume.Name, uid.withoutObject().String(), retention)
+}
+
+// deletedVersions returns the versions a delete of the uid removes, all versions if it addresses the whole id
+func (sha *Sha) deletedVersions(uid *ShaUID) ([]*ShaUID, error) {
+	if uid.Object != "" || uid.Version > 1 {
+		return []*ShaUID{NewShaUID(uid.Id, max(uid.Version, 1), "")}, nil
+	}
+
+	current, err := sha.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+	if common.Error(err) {
+		return nil, err
+	}
+
+	var versions []*ShaUID
+
+	for version := 1; version <= current; version++ {
+		versions = append(versions, NewShaUID(uid.Id, version, ""))
+	}
+
+	return versions, nil
+}
+
+func (sha *Sha) Retention(suid string) (*Retention, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	err = sha.latest(uid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	_, retention, err := sha.versionRetention(uid)
+
+	return retention, err
+}
+
+// SetRetention records the retention of a version and returns its effective retention
+func (sha *Sha) SetRetention(suid string, retention *Retention) (*Retention, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	err = sha.latest(uid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	volume, _, err := sha.versionRetention(uid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	err = saveRetention(volume.Path, uid.withoutObject().String(), retention)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	_, retention, err = sha.versionRetention(uid)
+
+	return retention, err
+}
+
+// fileRetention returns the effective retention of a file of a Fs volume
+func fileRetention(volume *FsVolume, uid string, path string) (*Retention, error) {
+	fi, err := os.Stat(path)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return effectiveRetention(volume.Path, volume.Retention, uid, fi.ModTime())
+}
+
+// checkFiles refuses the deletion of the path if it or any file below it is under retention and returns
+// the uids of the files
+func checkFiles(volume *FsVolume, path string) ([]string, error) {
+	var uids []string
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || isDigestSidecar(p) || isTemp(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(volume.Path, p)
+		if common.Error(err) {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		retention, err := fileRetention(volume, rel, p)
+		if common.Error(err) {
+			return err
+		}
+
+		err = checkRetention(volume.Name, rel, retention)
+		if err != nil {
+			return err
+		}
+
+		uids = append(uids, rel)
+
+		return nil
+	})
+
+	return uids, err
+}
+
+func (fs *Fs) Retention(suid string) (*Retention, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	volume, path, err := fs.find(uid, nil)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return fileRetention(volume, filepath.ToSlash(uid.Path), path)
+}
+
+// SetRetention records the retention of a file and returns its effective retention
+func (fs *Fs) SetRetention(suid string, retention *Retention) (*Retention, error) {
+	uid, err := ParseFsUID(suid)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(uid.Path))
+	defer cluster.Unlock(cluster.ByStorageUid(uid.Path))
+
+	volume, path, err := fs.find(uid, nil)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if !isRegularFile(path) {
+		return nil, &ErrInvalidUID{suid}
+	}
+
+	err = saveRetention(volume.Path, filepath.ToSlash(uid.Path), retention)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return fileRetention(volume, filepath.ToSlash(uid.Path), path)
+}
+
+// bucketRetention returns the effective retention of a bucket or nil if the driver has no retention
+func bucketRetention(handle Handle, bucketUid string) (*Retention, error) {
+	r, ok := handle.(retainer)
+	if !ok {
+		return nil, nil
+	}
+
+	return r.Retention(bucketUid)
+}
+
+// applyRetention records the retention on the bucket saved in the database
+func applyRetention(bucket *models.Bucket, retention *Retention) {
+	if retention == nil {
+		return
+	}
+
+	bucket.RetainUntil = retention.RetainUntil
+	bucket.LegalHold = retention.LegalHold
+}
+
+// retentionHandler reports the effective retention of a bucket with GET and changes it with PUT
+func retentionHandler(rw http.ResponseWriter, r *http.Request) error {
+	uid := r.URL.Path
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return nil
+	}
+
+	var retention *Retention
+
+	err := Exec(func(handle Handle) error {
+		rh, ok := handle.(retainer)
+		if !ok {
+			return &ErrNotSupported{Driver: cfg.Driver, Operation: RETENTION}
+		}
+
+		bucketUid, _, err := bucketRef(handle, uid)
+		if common.Error(err) {
+			return err
+		}
+
+		if sha, ok := handle.(*Sha); ok {
+			suid, err := ParseShaUID(bucketUid)
+			if common.Error(err) {
+				return err
+			}
+
+			err = sha.latest(suid)
+			if common.Error(err) {
+				return err
+			}
+
+			bucketUid = suid.String()
+		}
+
+		if r.Method == http.MethodGet {
+			retention, err = rh.Retention(bucketUid)
+
+			return err
+		}
+
+		ba, err := io.ReadAll(r.Body)
+		if common.Error(err) {
+			return err
+		}
+
+		request := &Retention{}
+
+		err = json.Unmarshal(ba, request)
+		if err != nil {
+			return &ErrInvalidUID{uid}
+		}
+
+		retention, err = rh.SetRetention(bucketUid, request)
+		if common.Error(err) {
+			return err
+		}
+
+		return database.Exec(func(db database.Handle) error {
+			bucket := models.NewBucket()
+
+			err := db.LoadBucket("uid", bucketUid, &bucket, nil)
+			if _, ok := err.(*database.ErrNotFound); ok {
+				return nil
+			}
+			if common.Error(err) {
+				return err
+			}
+
+			applyRetention(&bucket, retention)
+
+			return db.SaveBucket(&bucket, nil)
+		})
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeJson(rw, http.StatusOK, retention)
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionSha(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	for _, zip := range []bool{false, true} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v.Retention = 1
+
+		sha.AddVolume(v)
+
+		suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("retained")), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		require.IsType(t, &ErrRetentionActive{}, err, "delete refused within volume retention")
+
+		_, _, err = sha.Store(NewShaUID(uid.Id, uid.Version, PAGE+".2").String(), bytes.NewReader([]byte("added")), nil)
+		require.IsType(t, &ErrRetentionActive{}, err, "version cannot be modified")
+
+		v.Retention = 0
+
+		_, err = sha.SetRetention(uid.String(), &Retention{LegalHold: true})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		require.IsType(t, &ErrLegalHold{}, err, "delete refused under legal hold")
+
+		until := time.Now().Add(time.Hour)
+
+		retention, err := sha.SetRetention(uid.String(), &Retention{RetainUntil: until})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.False(t, retention.LegalHold)
+		require.True(t, retention.RetainUntil.Equal(until))
+
+		_, err = sha.SetRetention(uid.String(), &Retention{RetainUntil: time.Now()})
+		require.IsType(t, &ErrRetentionShortened{}, err, "retention cannot be shortened")
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		require.IsType(t, &ErrRetentionActive{}, err, "delete refused within bucket retention")
+
+		err = writeFileAtomic(retentionPath(path, uid.withoutObject().String()), []byte("{}"))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		require.NoError(t, err, "delete allowed after retention expired")
+		require.False(t, common.FileExists(retentionPath(path, uid.withoutObject().String())), "retention record removed")
+	}
+}
+
+func TestRetentionFs(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	fs, err := NewFs()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewFsVolume("test", path)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Retention = 1
+
+	fs.AddVolume(v)
+
+	_, _, err = fs.Store("dir/a.txt", bytes.NewReader([]byte("retained")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete("dir", nil)
+	require.IsType(t, &ErrRetentionActive{}, err, "directory with retained file is not deleted")
+	require.True(t, common.FileExists(filepath.Join(path, "dir", "a.txt")))
+
+	v.Retention = 0
+
+	_, err = fs.SetRetention("dir/a.txt", &Retention{LegalHold: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete("dir/a.txt", nil)
+	require.IsType(t, &ErrLegalHold{}, err, "delete refused under legal hold")
+
+	_, err = fs.SetRetention("dir/a.txt", &Retention{})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete("dir/a.txt", nil)
+	require.NoError(t, err, "delete allowed after legal hold released")
+	require.False(t, common.FileExists(retentionPath(path, "dir/a.txt")), "retention record removed")
+}
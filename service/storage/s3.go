@@ -0,0 +1,1053 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/cache"
+	"github.com/mpetavy/tresor/hash"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/cluster"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	TYPE_S3   = "s3"
+	S3_VOLUME = "S3_VOLUME_"
+
+	S3_REGION           = "us-east-1"
+	S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+	// S3_UID_CLAIMS names the keys below META_DIR which claim the ids handed out
+	S3_UID_CLAIMS = "uids"
+)
+
+var (
+	// s3uid is the last id handed out by this process, only a hint since ids belong to their claim object
+	s3uid      int
+	s3uidValid bool
+	s3uidMu    sync.Mutex
+
+	// ifNoneMatch makes a PUT fail with ErrObjectAlreadyExists if the key exists
+	ifNoneMatch = http.Header{"If-None-Match": []string{"*"}}
+)
+
+// s3Cfg is the part of Cfg the S3 driver reads, registered as its configuration schema
+type s3Cfg struct {
+	driverCfg
+	Volumes   []s3VolumeCfg `json:"volumes" html:"Volumes"`
+	Placement PlacementCfg  `json:"placement" html:"Placement"`
+	KeyFile   string        `json:"keyFile" html:"Key file"`
+}
+
+type s3VolumeCfg struct {
+	Name      string `json:"name" html:"Name"`
+	Flat      bool   `json:"flat" html:"Flat"`
+	Hash      string `json:"hash" html:"Hash"`
+	ReadOnly  bool   `json:"readOnly" html:"Read only"`
+	Encrypt   bool   `json:"encrypt" html:"Encrypt"`
+	Endpoint  string `json:"endpoint" html:"Endpoint"`
+	Bucket    string `json:"bucket" html:"Bucket"`
+	Prefix    string `json:"prefix" html:"Prefix"`
+	Region    string `json:"region" html:"Region"`
+	AccessKey string `json:"accessKey" html:"Access key"`
+	SecretKey string `json:"secretKey" html:"Secret key"`
+}
+
+type S3 struct {
+	volumes   map[string]*S3Volume
+	placement *PlacementCfg
+	client    *http.Client
+}
+
+type S3Volume struct {
+	Name      string
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Flat      bool
+	Hash      string
+	ReadOnly  bool
+	Encrypt   bool
+	keys      *Keyring
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type s3Reader struct {
+	volume *S3Volume
+	client *http.Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func NewS3Volume(cfg *VolumeCfg) (*S3Volume, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, &ErrVolumePathNotFound{Volume: cfg.Name, Path: cfg.Endpoint + "/" + cfg.Bucket}
+	}
+
+	volume := &S3Volume{
+		Name:      cfg.Name,
+		Endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		Bucket:    cfg.Bucket,
+		Prefix:    strings.Trim(cfg.Prefix, "/"),
+		Region:    common.Eval(cfg.Region != "", cfg.Region, S3_REGION),
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+		Flat:      cfg.Flat,
+		Hash:      hashAlgorithm(cfg.Hash),
+		ReadOnly:  cfg.ReadOnly,
+		Encrypt:   cfg.Encrypt,
+	}
+
+	_, err := hash.New(volume.Hash)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return volume, nil
+}
+
+func NewS3() (*S3, error) {
+	return &S3{volumes: make(map[string]*S3Volume), client: &http.Client{}}, nil
+}
+
+func (s3 *S3) Init(cfg *Cfg) error {
+	keys, err := loadKeys(cfg)
+	if common.Error(err) {
+		return err
+	}
+
+	for i := 0; i < len(cfg.Volumes); i++ {
+		vol, err := NewS3Volume(&cfg.Volumes[i])
+		if common.Error(err) {
+			return err
+		}
+
+		vol.keys = keys
+
+		if vol.Encrypt && keys == nil {
+			return &ErrNoEncryptionKey{vol.Name}
+		}
+
+		s3.AddVolume(vol)
+	}
+
+	err = cfg.Placement.validate()
+	if common.Error(err) {
+		return err
+	}
+
+	s3.placement = &cfg.Placement
+
+	return nil
+}
+
+func (s3 *S3) Start() error {
+	return nil
+}
+
+func (s3 *S3) Stop() error {
+	return nil
+}
+
+func (s3 *S3) AddVolume(v *S3Volume) {
+	s3.volumes[v.Name] = v
+}
+
+func (s3 *S3) RemoveVolume(v *S3Volume) {
+	delete(s3.volumes, v.Name)
+}
+
+// key returns the object key of an uid, named like the path createShaPath produces on disk
+func (volume *S3Volume) key(uid *ShaUID) string {
+	key := path.Clean(filepath.ToSlash(createShaName(uid, volume.Flat, false)))
+
+	if volume.Prefix != "" {
+		key = volume.Prefix + "/" + key
+	}
+
+	return key
+}
+
+func (volume *S3Volume) url(key string, query url.Values) string {
+	elements := strings.Split(key, "/")
+	for i := range elements {
+		elements[i] = url.PathEscape(elements[i])
+	}
+
+	u := volume.Endpoint + "/" + url.PathEscape(volume.Bucket)
+	if key != "" {
+		u += "/" + strings.Join(elements, "/")
+	}
+
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+
+	return u
+}
+
+func s3Query(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// sign adds an AWS signature version 4 to the request
+func (volume *S3Volume) sign(req *http.Request) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", S3_UNSIGNED_PAYLOAD)
+
+	if volume.AccessKey == "" {
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + S3_UNSIGNED_PAYLOAD + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		S3_UNSIGNED_PAYLOAD,
+	}, "\n")
+
+	scope := strings.Join([]string{date, volume.Region, "s3", "aws4_request"}, "/")
+
+	crh := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(crh[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+volume.SecretKey), date)
+	key = hmacSHA256(key, volume.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", volume.AccessKey, scope, signedHeaders, signature))
+}
+
+func (volume *S3Volume) request(client *http.Client, method string, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, volume.url(key, query), body)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	volume.sign(req)
+
+	resp, err := client.Do(req)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		common.DebugError(resp.Body.Close())
+
+		return nil, &ErrObjectNotFound{volume.Name, key}
+	}
+
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		common.DebugError(resp.Body.Close())
+
+		return nil, &ErrObjectAlreadyExists{volume.Name, key}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ba, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		common.DebugError(resp.Body.Close())
+
+		return nil, &ErrS3Request{Volume: volume.Name, Key: key, Status: resp.Status, Message: string(ba)}
+	}
+
+	return resp, nil
+}
+
+func (volume *S3Volume) head(client *http.Client, key string) (int64, time.Time, error) {
+	resp, err := volume.request(client, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return -1, time.Time{}, err
+	}
+
+	common.DebugError(resp.Body.Close())
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return resp.ContentLength, modTime, nil
+}
+
+// writeRecord writes the record of the object with the key. A record left behind by an upload which never
+// completed is replaced, the record of an existing object fails with ErrObjectAlreadyExists.
+func (volume *S3Volume) writeRecord(client *http.Client, key string, r *record) error {
+	ba := []byte(r.String())
+
+	resp, err := volume.request(client, http.MethodPut, key+DIGEST_SUFFIX, nil, bytes.NewReader(ba), int64(len(ba)), ifNoneMatch)
+	if _, ok := err.(*ErrObjectAlreadyExists); ok {
+		_, _, err = volume.head(client, key)
+		if err == nil {
+			return &ErrObjectAlreadyExists{volume.Name, key}
+		}
+		if _, ok := err.(*ErrObjectNotFound); !ok {
+			common.Error(err)
+
+			return err
+		}
+
+		resp, err = volume.request(client, http.MethodPut, key+DIGEST_SUFFIX, nil, bytes.NewReader(ba), int64(len(ba)), nil)
+	}
+	if common.Error(err) {
+		return err
+	}
+
+	common.DebugError(resp.Body.Close())
+
+	return nil
+}
+
+// readRecord returns the record of the object with the key
+func (volume *S3Volume) readRecord(client *http.Client, key string) (*record, error) {
+	resp, err := volume.request(client, http.MethodGet, key+DIGEST_SUFFIX, nil, nil, 0, nil)
+	if _, ok := err.(*ErrObjectNotFound); ok {
+		return missingRecord(volume.Encrypt)
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+	defer func() {
+		common.DebugError(resp.Body.Close())
+	}()
+
+	ba, err := io.ReadAll(resp.Body)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return parseRecord(string(ba))
+}
+
+// list returns all keys and common prefixes below prefix
+func (volume *S3Volume) list(client *http.Client, prefix string, delimiter string, maxKeys int) ([]string, []string, error) {
+	var keys []string
+	var prefixes []string
+
+	token := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := volume.request(client, http.MethodGet, "", query, nil, 0, nil)
+		if common.Error(err) {
+			return nil, nil, err
+		}
+
+		result := s3ListResult{}
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		common.DebugError(resp.Body.Close())
+		if common.Error(err) {
+			return nil, nil, err
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, content.Key)
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, commonPrefix.Prefix)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" || (maxKeys > 0 && len(keys)+len(prefixes) >= maxKeys) {
+			return keys, prefixes, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// exists checks if there is an object with the key or any object below the key
+func (volume *S3Volume) exists(client *http.Client, key string) (bool, error) {
+	_, _, err := volume.head(client, key)
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*ErrObjectNotFound); !ok {
+		return false, err
+	}
+
+	keys, _, err := volume.list(client, key+"/", "", 1)
+	if common.Error(err) {
+		return false, err
+	}
+
+	return len(keys) > 0, nil
+}
+
+// maxId returns the highest id stored in the volume
+func (volume *S3Volume) maxId(client *http.Client) (int, error) {
+	prefix := ""
+	if volume.Prefix != "" {
+		prefix = volume.Prefix + "/"
+	}
+
+	levels := common.Eval(volume.Flat, 1, 4)
+	max := 0
+
+	for level := 0; level < levels; level++ {
+		_, prefixes, err := volume.list(client, prefix, "/", 0)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		next := ""
+		max = 0
+
+		for _, p := range prefixes {
+			id, err := strconv.Atoi(path.Base(p))
+			if err != nil {
+				continue
+			}
+
+			if next == "" || id > max {
+				max = id
+				next = p
+			}
+		}
+
+		if next == "" {
+			return 0, nil
+		}
+
+		prefix = next
+	}
+
+	return max, nil
+}
+
+// maxId returns the highest id stored in any volume, locked only for the scan so uploads go on during a rebuild
+func (s3 *S3) maxId() (int, error) {
+	cluster.Lock(cluster.ByStorage())
+	defer cluster.Unlock(cluster.ByStorage())
+
+	maxId := 0
+
+	for _, volume := range s3.volumes {
+		id, err := volume.maxId(s3.client)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		maxId = max(maxId, id)
+	}
+
+	return maxId, nil
+}
+
+// claim creates the claim object of the id, it fails with ErrObjectAlreadyExists if the id is claimed already
+func (volume *S3Volume) claim(client *http.Client, id int) error {
+	key := path.Join(volume.Prefix, META_DIR, S3_UID_CLAIMS, strconv.Itoa(id))
+
+	resp, err := volume.request(client, http.MethodPut, key, nil, bytes.NewReader(nil), 0, ifNoneMatch)
+	if err != nil {
+		return err
+	}
+
+	common.DebugError(resp.Body.Close())
+
+	return nil
+}
+
+// claimVolume returns the volume which holds the id claims, the same one for all processes on the volumes
+func (s3 *S3) claimVolume() (*S3Volume, error) {
+	var claims *S3Volume
+
+	for _, volume := range s3.volumes {
+		if !volume.ReadOnly && (claims == nil || volume.Name < claims.Name) {
+			claims = volume
+		}
+	}
+
+	if claims == nil {
+		return nil, &ErrNoVolumeAvailable{}
+	}
+
+	return claims, nil
+}
+
+// nextUID returns a new id. An id belongs to the process which creates its claim object first, so processes
+// and cluster nodes sharing the volumes never hand out the same id.
+func (s3 *S3) nextUID() (int, error) {
+	s3uidMu.Lock()
+	defer s3uidMu.Unlock()
+
+	claims, err := s3.claimVolume()
+	if common.Error(err) {
+		return -1, err
+	}
+
+	if !s3uidValid {
+		for _, volume := range s3.volumes {
+			id, err := volume.maxId(s3.client)
+			if common.Error(err) {
+				return -1, err
+			}
+
+			s3uid = max(s3uid, id)
+		}
+
+		s3uidValid = true
+	}
+
+	for {
+		s3uid++
+
+		err := claims.claim(s3.client, s3uid)
+		if _, ok := err.(*ErrObjectAlreadyExists); ok {
+			continue
+		}
+		if common.Error(err) {
+			return -1, err
+		}
+
+		return s3uid, nil
+	}
+}
+
+func (s3 *S3) find(uid *ShaUID, options *Options) (*S3Volume, string, error) {
+	volumeName, ok := cache.Get(S3_VOLUME, strconv.Itoa(uid.Id))
+
+	names := make([]string, 0, len(s3.volumes))
+	if ok {
+		if _, valid := s3.volumes[volumeName.(string)]; valid {
+			names = append(names, volumeName.(string))
+		}
+	}
+
+	for name := range s3.volumes {
+		if !ok || volumeName != name {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		volume := s3.volumes[name]
+		key := volume.key(uid)
+
+		b, err := volume.exists(s3.client, key)
+		if common.Error(err) {
+			return nil, "", err
+		}
+
+		if b {
+			cache.Put(S3_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+
+			return volume, key, nil
+		}
+	}
+
+	return nil, "", &ErrObjectNotFound{"??", uid.String()}
+}
+
+func (s3 *S3) CurrentVersion(uid *ShaUID) (int, error) {
+	volume, key, err := s3.find(NewShaUID(uid.Id, 0, ""), nil)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	return s3.currentVersion(volume, key)
+}
+
+func (s3 *S3) currentVersion(volume *S3Volume, key string) (int, error) {
+	_, prefixes, err := volume.list(s3.client, key+"/", "/", 0)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	currentVersion := 0
+
+	for _, p := range prefixes {
+		v, err := strconv.Atoi(path.Base(p))
+		if err != nil {
+			continue
+		}
+
+		currentVersion = max(currentVersion, v)
+	}
+
+	return currentVersion + 1, nil
+}
+
+func (s3 *S3) Store(suid string, source io.Reader, options *Options) (string, *[]byte, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	if uid.Id != 0 {
+		cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+		defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	}
+
+	var volume *S3Volume
+
+	if uid.Id != 0 {
+		var key string
+
+		volume, key, err = s3.find(uid.withoutObject(), options)
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		if uid.Version == 0 {
+			v, err := s3.currentVersion(volume, key)
+			if common.Error(err) {
+				return "", nil, err
+			}
+
+			uid.Version = v + 1
+		}
+	} else {
+		if options != nil && len(options.VolumeName) > 0 {
+			var ok bool
+
+			volume, ok = s3.volumes[options.VolumeName]
+			if !ok {
+				return "", nil, &ErrInvalidVolumeName{options.VolumeName}
+			}
+		} else {
+			if len(s3.volumes) == 0 {
+				return "", nil, &ErrNoVolumesDefined{}
+			}
+
+			volumes := make([]placementVolume, 0, len(s3.volumes))
+			for _, v := range s3.volumes {
+				volumes = append(volumes, placementVolume{Name: v.Name, ReadOnly: v.ReadOnly})
+			}
+
+			var name string
+
+			name, source, err = placeObject(s3.placement, volumes, source, "", options.expectedSize())
+			if common.Error(err) {
+				return "", nil, err
+			}
+
+			volume = s3.volumes[name]
+		}
+
+		uid.Id, err = s3.nextUID()
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		uid.Version = 1
+
+		cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+		defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	}
+
+	if volume.ReadOnly {
+		return "", nil, &ErrVolumeReadOnly{volume.Name}
+	}
+
+	key := volume.key(uid)
+
+	_, _, err = volume.head(s3.client, key)
+	if err == nil {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+	if _, ok := err.(*ErrObjectNotFound); !ok {
+		common.Error(err)
+
+		return "", nil, err
+	}
+
+	temp, err := os.CreateTemp("", "tresor-s3-")
+	if common.Error(err) {
+		return "", nil, err
+	}
+	defer func() {
+		common.DebugError(temp.Close())
+		common.DebugError(os.Remove(temp.Name()))
+	}()
+
+	writer, encryption, err := encrypting(temp, volume.Encrypt, volume.keys)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	digest, _, err := copyDigest(writer, source, volume.Hash, nil, false)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	err = writer.Close()
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	n, err := temp.Seek(0, io.SeekCurrent)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	_, err = temp.Seek(0, io.SeekStart)
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	// the record is written first so a failed upload never leaves an object without its record
+	err = volume.writeRecord(s3.client, key, &record{digest: digest, format: Format{Encryption: encryption}})
+	if _, ok := err.(*ErrObjectAlreadyExists); ok {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+	if common.Error(err) {
+		return "", nil, err
+	}
+
+	resp, err := volume.request(s3.client, http.MethodPut, key, nil, temp, n, ifNoneMatch)
+	if _, ok := err.(*ErrObjectAlreadyExists); ok {
+		return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+	if common.Error(err) {
+		removed, removeErr := volume.request(s3.client, http.MethodDelete, key+DIGEST_SUFFIX, nil, nil, 0, nil)
+		if !common.DebugError(removeErr) {
+			common.DebugError(removed.Body.Close())
+		}
+
+		return "", nil, err
+	}
+
+	common.DebugError(resp.Body.Close())
+
+	cache.Put(S3_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+
+	return uid.String(), &digest.Value, nil
+}
+
+func (s3 *S3) Load(suid string, dest io.Writer, options *Options) (string, *[]byte, int64, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	volume, key, err := s3.find(uid, options)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	expected, err := volume.readRecord(s3.client, key)
+	if common.Error(err) {
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
+	}
+
+	resp, err := volume.request(s3.client, http.MethodGet, key, nil, nil, 0, nil)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+	defer func() {
+		common.DebugError(resp.Body.Close())
+	}()
+
+	reader, err := plainReader(resp.Body, expected.format, volume.keys)
+	if common.Error(err) {
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
+	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
+
+	digest, n, err := copyDigest(dest, reader, volume.Hash, expected.digest, options != nil && options.Verify)
+	err = objectError(err, volume.Name, uid.String())
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	return volume.url(key, nil), &digest.Value, n, nil
+}
+
+func (s3 *S3) Open(suid string, options *Options) (io.ReadSeekCloser, *ObjectInfo, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	volume, key, err := s3.find(uid, options)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	size, modTime, err := volume.head(s3.client, key)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	r, err := volume.readRecord(s3.client, key)
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume.Name, uid.String())
+	}
+
+	file := &s3Reader{volume: volume, client: s3.client, key: key, size: size}
+
+	reader, plainSize, err := plainFile(file, size, r.format, volume.keys, volume.url(key, nil)+"|"+modTime.String()+"|"+strconv.FormatInt(size, 10))
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume.Name, uid.String())
+	}
+
+	return reader, &ObjectInfo{Path: volume.url(key, nil), Size: plainSize, ModTime: modTime, Digest: r.digest}, nil
+}
+
+func (s3 *S3) Delete(suid string, options *Options) error {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	volume, key, err := s3.find(uid, options)
+	if common.Error(err) {
+		return err
+	}
+
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
+
+	keys, _, err := volume.list(s3.client, key, "", 0)
+	if common.Error(err) {
+		return err
+	}
+
+	for _, k := range keys {
+		if k != key && k != key+DIGEST_SUFFIX && !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+
+		resp, err := volume.request(s3.client, http.MethodDelete, k, nil, nil, 0, nil)
+		if common.Error(err) {
+			return err
+		}
+
+		common.DebugError(resp.Body.Close())
+	}
+
+	cache.Remove(S3_VOLUME, strconv.Itoa(uid.Id))
+
+	return nil
+}
+
+func (s3 *S3) rebuildBucket(uid *ShaUID) error {
+	var objects []string
+
+	for page := 1; ; page++ {
+		object := NewShaUID(uid.Id, uid.Version, PAGE+"."+strconv.Itoa(page))
+
+		_, _, err := s3.find(object, nil)
+		if err != nil {
+			break
+		}
+
+		objects = append(objects, object.String())
+	}
+
+	_, err := saveBucket(s3, uid.String(), objects)
+
+	return err
+}
+
+func (s3 *S3) Rebuild(job *RebuildJob) (int, error) {
+	err := database.Exec(func(db database.Handle) error {
+		return db.EnableIndices([]interface{}{models.NewBucket()}, false)
+	})
+	if common.Error(err) {
+		return -1, err
+	}
+	defer func() {
+		common.Error(database.Exec(func(db database.Handle) error {
+			return db.EnableIndices([]interface{}{models.NewBucket()}, true)
+		}))
+	}()
+
+	start := NewShaUID(1, 1, "")
+
+	if job.Resume() != "" {
+		uid, err := ParseShaUID(job.Resume())
+		if common.Error(err) {
+			return -1, err
+		}
+
+		start = NewShaUID(uid.Id, uid.Version+1, "")
+	}
+
+	maxId, err := s3.maxId()
+	if common.Error(err) {
+		return -1, err
+	}
+
+	c := 0
+
+	for id := start.Id; id <= maxId; id++ {
+		volume, key, err := s3.find(NewShaUID(id, 0, ""), nil)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			continue
+		}
+		if common.Error(err) {
+			return c, err
+		}
+
+		current, err := s3.currentVersion(volume, key)
+		if common.Error(err) {
+			return c, err
+		}
+
+		for version := common.Eval(id == start.Id, start.Version, 1); version <= current; version++ {
+			uid := NewShaUID(id, version, "")
+
+			_, _, err := s3.find(uid, nil)
+			if _, ok := err.(*ErrObjectNotFound); ok {
+				continue
+			}
+			if common.Error(err) {
+				return c, err
+			}
+
+			if !job.Submit(uid.String(), func() error {
+				return s3.rebuildBucket(uid)
+			}) {
+				return c, nil
+			}
+
+			c++
+		}
+	}
+
+	return c, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+
+		resp, err := r.volume.request(r.client, http.MethodGet, r.key, nil, nil, 0, header)
+		if common.Error(err) {
+			return 0, err
+		}
+
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position: %d", abs)
+	}
+
+	if abs != r.offset && r.body != nil {
+		common.DebugError(r.body.Close())
+		r.body = nil
+	}
+
+	r.offset = abs
+
+	return abs, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal in-process implementation of the S3 REST protocol
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	elements := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(elements) > 1 {
+		key = elements[1]
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		type content struct {
+			Key string
+		}
+		type commonPrefix struct {
+			Prefix string
+		}
+		result := struct {
+			XMLName        xml.Name       `xml:"ListBucketResult"`
+			Contents       []content      `xml:"Contents"`
+			CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+			IsTruncated    bool
+		}{}
+
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+		maxKeys, err := strconv.Atoi(r.URL.Query().Get("max-keys"))
+		if err != nil {
+			maxKeys = 1000
+		}
+
+		var keys []string
+		for k := range f.objects {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		prefixes := make(map[string]bool)
+
+		for _, k := range keys {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+
+			if delimiter != "" {
+				if p := strings.Index(k[len(prefix):], delimiter); p != -1 {
+					cp := k[:len(prefix)+p+1]
+					if !prefixes[cp] {
+						prefixes[cp] = true
+						result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{cp})
+					}
+					continue
+				}
+			}
+
+			if len(result.Contents) < maxKeys {
+				result.Contents = append(result.Contents, content{k})
+			}
+		}
+
+		ba, _ := xml.Marshal(&result)
+		_, _ = rw.Write(ba)
+	case r.Method == http.MethodPut:
+		if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		ba, _ := io.ReadAll(r.Body)
+		f.objects[key] = ba
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		ba, ok := f.objects[key]
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+
+		http.ServeContent(rw, r, "", time.Now(), bytes.NewReader(ba))
+	}
+}
+
+func TestS3(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer server.Close()
+
+	s3, err := NewS3()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewS3Volume(&VolumeCfg{Name: "test", Endpoint: server.URL, Bucket: "tresor", Prefix: "archive", AccessKey: "key", SecretKey: "secret"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	s3.AddVolume(v)
+
+	uid := NewShaUID(0, 0, "")
+	hashes := make(map[string]*[]byte)
+
+	for version := 1; version <= 2; version++ {
+		uid.Version = 0
+		for page := 1; page <= 3; page++ {
+			uid.Object = PAGE + "." + strconv.Itoa(page)
+
+			suid, h, err := s3.Store(uid.String(), strings.NewReader(fmt.Sprintf("Version %d Page %d", version, page)), nil)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			uid, err = ParseShaUID(suid)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, version, uid.Version, "Correct version")
+
+			hashes[suid] = h
+		}
+	}
+
+	v2, err := s3.CurrentVersion(uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, v2, "Correct current version")
+
+	for suid, hs := range hashes {
+		var w bytes.Buffer
+
+		_, hl, _, err := s3.Load(suid, &w, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, *hs, *hl, "Hash compare")
+	}
+
+	uid.Object = PAGE + ".2"
+
+	reader, info, err := s3.Open(uid.String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, int64(len("Version 2 Page 2")), info.Size, "Size compare")
+
+	_, err = reader.Seek(10, io.SeekStart)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	common.Error(reader.Close())
+
+	require.Equal(t, "Page 2", string(ba), "Range compare")
+
+	err = s3.Delete(uid.String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = s3.Load(uid.String(), io.Discard, nil)
+	_, ok := err.(*ErrObjectNotFound)
+	require.True(t, ok, "load on deleted page gave no error")
+
+	err = s3.Delete(NewShaUID(uid.Id, 1, "").String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, err = s3.find(NewShaUID(uid.Id, 1, ""), nil)
+	_, ok = err.(*ErrObjectNotFound)
+	require.True(t, ok, "find on deleted uid gave no error")
+}
+
+func TestS3Rebuild(t *testing.T) {
+	defer startMemoryServices(t)()
+
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server := httptest.NewServer(&fakeS3{objects: make(map[string][]byte)})
+	defer server.Close()
+
+	s3, err := NewS3()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewS3Volume(&VolumeCfg{Name: "test", Endpoint: server.URL, Bucket: "tresor", AccessKey: "key", SecretKey: "secret"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	s3.AddVolume(v)
+
+	var uids []*ShaUID
+
+	for i := 0; i < 3; i++ {
+		suid, _, err := s3.Store(NewShaUID(0, 0, PAGE+".1").String(), strings.NewReader(fmt.Sprintf("object %d", i)), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uids = append(uids, uid)
+	}
+
+	err = s3.Delete(NewShaUID(uids[1].Id, 0, "").String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	status, err := rebuild(s3, TYPE_S3, 2, filepath.Join(path, REBUILD_CHECKPOINT))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, status.Done, "ids after a deleted id are rebuilt")
+	require.Equal(t, uids[2].withoutObject().String(), status.Checkpoint)
+}
+
+func TestS3Claims(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3, err := NewS3()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewS3Volume(&VolumeCfg{Name: "test", Endpoint: server.URL, Bucket: "tresor", AccessKey: "key", SecretKey: "secret"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	s3.AddVolume(v)
+
+	s3uidMu.Lock()
+	s3uid, s3uidValid = 0, false
+	s3uidMu.Unlock()
+	defer func() {
+		s3uidMu.Lock()
+		s3uid, s3uidValid = 0, false
+		s3uidMu.Unlock()
+	}()
+
+	store := func(suid string) (*ShaUID, error) {
+		suid, _, err := s3.Store(suid, strings.NewReader("content"), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return ParseShaUID(suid)
+	}
+
+	uid, err := store(NewShaUID(0, 0, PAGE+".1").String())
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, uid.Id)
+
+	// another node claims the next id while the counter of this process is still stale
+	err = v.claim(s3.client, 2)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	s3uidMu.Lock()
+	s3uid = 0
+	s3uidMu.Unlock()
+
+	uid, err = store(NewShaUID(0, 0, PAGE+".1").String())
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 3, uid.Id, "claimed ids are skipped")
+
+	uid.Object = PAGE + ".2"
+
+	fake.mu.Lock()
+	fake.objects[v.key(uid)] = nil
+	fake.mu.Unlock()
+
+	_, err = store(uid.String())
+	_, ok := err.(*ErrObjectAlreadyExists)
+	require.True(t, ok, "existing empty object is not overwritten")
+}
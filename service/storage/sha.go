@@ -2,21 +2,16 @@ package storage
 
 import (
 	"container/list"
-	"encoding/hex"
 	"io"
-	"reflect"
 	"strings"
 
-	"github.com/mpetavy/tresor/models"
-	"github.com/mpetavy/tresor/service/database"
-	"github.com/mpetavy/tresor/service/index"
-
 	"github.com/mpetavy/tresor/service/cluster"
 
 	"fmt"
 
 	"path/filepath"
 	"sync"
+	"time"
 
 	"math"
 	"os"
@@ -58,7 +53,7 @@ func ParseShaUID(s string) (*ShaUID, error) {
 
 	elements := strings.Split(s, "|")
 
-	if strings.Contains(elements[0], ".") {
+	if elements[0] != "" {
 		elements := strings.Split(elements[0], ".")
 
 		uid.Id, err = strconv.Atoi(elements[0])
@@ -95,24 +90,63 @@ func (uid *ShaUID) String() string {
 	return sb.String()
 }
 
+// shaCfg is the part of Cfg the Sha driver reads, registered as its configuration schema
+type shaCfg struct {
+	driverCfg
+	Repair     bool           `json:"repair" html:"Repair"`
+	Volumes    []shaVolumeCfg `json:"volumes" html:"Volumes"`
+	Trash      TrashCfg       `json:"trash" html:"Trash"`
+	Placement  PlacementCfg   `json:"placement" html:"Placement"`
+	UnzipCache int            `json:"unzipCache" html:"Unzip cache"`
+	KeyFile    string         `json:"keyFile" html:"Key file"`
+}
+
+type shaVolumeCfg struct {
+	Name         string   `json:"name" html:"Name"`
+	Path         string   `json:"path" html:"path"`
+	Flat         bool     `json:"flat" html:"Flat"`
+	Zip          bool     `json:"zip" html:"Zip"`
+	Hash         string   `json:"hash" html:"Hash"`
+	ReadOnly     bool     `json:"readOnly" html:"Read only"`
+	Capacity     int      `json:"capacity" html:"Capacity"`
+	Replicas     []string `json:"replicas" html:"Replicas"`
+	Quorum       int      `json:"quorum" html:"Quorum"`
+	Encrypt      bool     `json:"encrypt" html:"Encrypt"`
+	Compression  string   `json:"compression" html:"Compression"`
+	CompressSkip []string `json:"compressSkip" html:"Compress skip"`
+	Retention    int      `json:"retention" html:"Retention"`
+}
+
 type Sha struct {
-	volumes map[string]*ShaVolume
-	uid     int
-	mu      *sync.Mutex
+	volumes   map[string]*ShaVolume
+	placement *PlacementCfg
+	mu        *sync.Mutex
+	// grace is the time deleted objects are kept in the trash, 0 deletes immediately
+	grace time.Duration
 }
 
 type ShaVolume struct {
-	Name string
-	Path string
-	Flat bool
-	Zip  bool
+	Name     string
+	Path     string
+	Flat     bool
+	Zip      bool
+	Hash     string
+	ReadOnly bool
+	Capacity int64
+	// Replicas are the names of the volumes which receive a copy of every object stored on this volume
+	Replicas []string
+	// Quorum is the number of copies including this volume which must be written, 0 requires all
+	Quorum  int
+	Encrypt bool
+	keys    *Keyring
+	// Compression is the codec new objects are compressed with unless their mime type is listed in CompressSkip
+	Compression  string
+	CompressSkip []string
+	// Retention is the number of days a version is protected against deletion and modification
+	Retention int
 }
 
 func NewShaVolume(name string, path string, flat bool, zip bool) (*ShaVolume, error) {
-	if name == UNZIP {
-		return nil, &ErrInvalidVolumeName{name}
-	}
-
 	volume := ShaVolume{Name: name, Path: common.CleanPath(path), Flat: flat, Zip: zip}
 
 	if !common.FileExists(path) {
@@ -123,19 +157,17 @@ func NewShaVolume(name string, path string, flat bool, zip bool) (*ShaVolume, er
 }
 
 func NewSha() (*Sha, error) {
-	sha := &Sha{volumes: make(map[string]*ShaVolume), uid: 0, mu: new(sync.Mutex)}
-
-	path, err := common.CreateTempDir()
-	if common.Error(err) {
-		return nil, err
-	}
-
-	sha.AddVolume(&ShaVolume{Name: UNZIP, Path: common.CleanPath(path), Flat: false, Zip: false})
+	sha := &Sha{volumes: make(map[string]*ShaVolume), mu: new(sync.Mutex), grace: TRASH_GRACE}
 
 	return sha, nil
 }
 
 func (sha *Sha) Init(cfg *Cfg) error {
+	keys, err := loadKeys(cfg)
+	if common.Error(err) {
+		return err
+	}
+
 	for i := 0; i < len(cfg.Volumes); i++ {
 		path := common.CleanPath(cfg.Volumes[i].Path)
 
@@ -148,17 +180,74 @@ func (sha *Sha) Init(cfg *Cfg) error {
 			return err
 		}
 
+		vol.Hash = hashAlgorithm(cfg.Volumes[i].Hash)
+		vol.ReadOnly = cfg.Volumes[i].ReadOnly
+		vol.Capacity = int64(cfg.Volumes[i].Capacity) * 1024 * 1024
+		vol.Replicas = cfg.Volumes[i].Replicas
+		vol.Quorum = cfg.Volumes[i].Quorum
+		vol.Encrypt = cfg.Volumes[i].Encrypt
+		vol.keys = keys
+
+		if vol.Encrypt && keys == nil {
+			return &ErrNoEncryptionKey{vol.Name}
+		}
+
+		vol.Retention = cfg.Volumes[i].Retention
+		vol.Compression = cfg.Volumes[i].Compression
+		vol.CompressSkip = cfg.Volumes[i].CompressSkip
+
+		err = validateCompression(vol.Compression)
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = hash.New(vol.Hash)
+		if common.Error(err) {
+			return err
+		}
+
 		sha.AddVolume(vol)
 	}
 
+	err = sha.validateReplicas()
+	if common.Error(err) {
+		return err
+	}
+
+	err = cfg.Placement.validate()
+	if common.Error(err) {
+		return err
+	}
+
+	sha.placement = &cfg.Placement
+	sha.grace = cfg.Trash.grace()
+
+	unzips.setLimit(cfg.UnzipCache)
+
 	return nil
 }
 
 func (sha *Sha) Start() error {
-	return nil
+	unzips.acquire()
+
+	err := cleanStaging(sha.storeVolumes())
+	if common.Error(err) {
+		return err
+	}
+
+	for _, volume := range sha.storeVolumes() {
+		err := cleanTempOnce(volume.Path)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return recoverShaUIDs(sha.storeVolumes())
 }
 
 func (sha *Sha) Stop() error {
+	unzips.release()
+
 	return nil
 }
 
@@ -184,13 +273,55 @@ func (sha *Sha) RemoveVolume(v *ShaVolume) {
 	delete(sha.volumes, v.Name)
 }
 
-func (sha *Sha) nextUID() int {
+// storeVolumes returns all volumes which hold stored objects
+func (sha *Sha) storeVolumes() []*ShaVolume {
+	l := make([]*ShaVolume, 0)
+
+	for _, v := range sha.volumes {
+		l = append(l, v)
+	}
+
+	return l
+}
+
+func (sha *Sha) placementVolumes() []placementVolume {
+	l := make([]placementVolume, 0)
+
+	for _, v := range sha.volumes {
+		if sha.isReplica(v) {
+			continue
+		}
+
+		l = append(l, placementVolume{Name: v.Name, Path: v.Path, ReadOnly: v.ReadOnly, Capacity: v.Capacity})
+	}
+
+	return l
+}
+
+func (sha *Sha) nextUID() (int, error) {
+	cluster.Lock(cluster.ByStorage())
+	defer cluster.Unlock(cluster.ByStorage())
+
+	return nextShaUID(sha.storeVolumes())
+}
+
+// maxId returns the highest id stored in any volume, locked only for the scan so uploads go on during a rebuild
+func (sha *Sha) maxId() (int, error) {
 	cluster.Lock(cluster.ByStorage())
 	defer cluster.Unlock(cluster.ByStorage())
 
-	sha.uid++
+	maxId := 0
+
+	for _, volume := range sha.storeVolumes() {
+		id, err := scanShaId(volume.Path, common.Eval(volume.Flat, 0, 3))
+		if common.Error(err) {
+			return -1, err
+		}
+
+		maxId = max(maxId, id)
+	}
 
-	return sha.uid
+	return maxId, nil
 }
 
 func (sha *Sha) CurrentVersion(uid *ShaUID) (int, error) {
@@ -212,6 +343,10 @@ func (sha *Sha) currentVersion(_uid *ShaUID, path string) (int, error) {
 		}
 	}
 
+	if isZipContainer(path) {
+		return zipCurrentVersion(path)
+	}
+
 	files, err := os.ReadDir(path)
 	if common.Error(err) {
 		return -1, err
@@ -239,13 +374,10 @@ func (sha *Sha) currentVersion(_uid *ShaUID, path string) (int, error) {
 	return currentVersion + 1, nil
 }
 
-func createShaPath(rootDir string, uid *ShaUID, flat bool, zip bool) (string, error) {
+// createShaName returns the path of an uid relative to the volume root
+func createShaName(uid *ShaUID, flat bool, zip bool) string {
 	var path string
 
-	if rootDir != "" {
-		path = rootDir + string(filepath.Separator)
-	}
-
 	object := ""
 	if uid.Object != "" {
 		object = fmt.Sprintf("%s%s", string(filepath.Separator), uid.Object)
@@ -304,9 +436,57 @@ func createShaPath(rootDir string, uid *ShaUID, flat bool, zip bool) (string, er
 		}
 	}
 
+	return path
+}
+
+func createShaPath(rootDir string, uid *ShaUID, flat bool, zip bool) (string, error) {
+	var path string
+
+	if rootDir != "" {
+		path = rootDir + string(filepath.Separator)
+	}
+
+	path += createShaName(uid, flat, zip)
+
 	return common.CleanPath(path), nil
 }
 
+// locate returns the path of the uid on a single volume, for zip volumes the path of the container
+func locate(volume *ShaVolume, uid *ShaUID) (string, error) {
+	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+	if common.Error(err) {
+		return "", err
+	}
+
+	if common.FileExists(path) {
+		return path, nil
+	}
+
+	if volume.Zip {
+		path, err = createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
+		if common.Error(err) {
+			return "", err
+		}
+
+		b := common.FileExists(path)
+
+		if b && uid.Object != "" {
+			b, err = zipHasEntry(path, uid.Object)
+			if common.Error(err) {
+				return "", err
+			}
+		}
+
+		if b {
+			return path, nil
+		}
+	}
+
+	return "", &ErrObjectNotFound{volume.Name, uid.String()}
+}
+
+// find returns the volume and path of the uid. With Options.Verify a corrupted copy on a replicated volume
+// is skipped in favour of a valid replica.
 func (sha *Sha) find(uid *ShaUID, options *Options) (*ShaVolume, string, error) {
 	var listVolumes list.List
 
@@ -323,63 +503,48 @@ func (sha *Sha) find(uid *ShaUID, options *Options) (*ShaVolume, string, error)
 	}
 
 	for key := range sha.volumes {
-		if key != UNZIP && (!ok || volumeName != key) {
+		if !ok || volumeName != key {
 			listVolumes.PushBack(key)
 		}
 	}
-	listVolumes.PushBack(UNZIP)
+
+	var corrupted error
 
 	for i := 0; i < listVolumes.Len(); i++ {
 		vn := getFromList(listVolumes, i).(string)
 		volume := sha.volumes[vn]
 
-		path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+		path, err := locate(volume, uid)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			continue
+		}
 		if common.Error(err) {
 			return nil, "", err
 		}
 
-		b := common.FileExists(path)
-
-		if !b && volume.Zip {
-			path, err = createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
-			if common.Error(err) {
-				return nil, "", err
-			}
-
-			b = common.FileExists(path)
-
-			if b {
-				volume = sha.volumes[UNZIP]
-
-				uidDir, err := createShaPath(volume.Path, uid.withoutObject(), volume.Flat, volume.Zip)
-				if common.Error(err) {
-					return nil, "", err
-				}
-
-				err = os.MkdirAll(uidDir, common.DefaultDirMode)
-				if common.Error(err) {
-					return nil, "", err
-				}
+		if uid.Object != "" && options != nil && options.Verify && sha.isReplicated(volume) {
+			err := checkObject(volume, uid, path)
+			if isCorrupted(err) {
+				common.Warn("%v, trying replica", err)
 
-				err = common.Unzip(uidDir, path)
-				if common.Error(err) {
-					return nil, "", err
+				if corrupted == nil {
+					corrupted = err
 				}
 
-				path, err = createShaPath(volume.Path, uid, volume.Flat, volume.Zip)
-				if common.Error(err) {
-					return nil, "", err
-				}
-
-				b = common.FileExists(path)
+				continue
+			}
+			if common.Error(err) {
+				return nil, "", err
 			}
 		}
 
-		if b {
-			cache.Put(SHA_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+		cache.Put(SHA_VOLUME, strconv.Itoa(uid.Id), volume.Name)
 
-			return volume, path, nil
-		}
+		return volume, path, nil
+	}
+
+	if corrupted != nil {
+		return nil, "", corrupted
 	}
 
 	return nil, "", &ErrObjectNotFound{"??", uid.String()}
@@ -414,74 +579,132 @@ func (sha *Sha) Store(suid string, source io.Reader, options *Options) (string,
 			}
 
 			uid.Version = v + 1
-		}
-	} else {
-		if options != nil && len(options.VolumeName) > 0 {
-			var ok bool
-
-			volume, ok = sha.volumes[options.VolumeName]
-			if !ok {
-				return "", nil, &ErrInvalidVolumeName{options.VolumeName}
-			}
 		} else {
-			if len(sha.volumes) > 0 {
-				volume = sha.volumes[reflect.ValueOf(sha.Volumes).MapKeys()[0].String()]
-			} else {
-				return "", nil, &ErrNoVolumesDefined{}
+			err := sha.checkVersion(uid)
+			if err != nil {
+				return "", nil, err
 			}
 		}
+	} else {
+		volume, source, err = sha.selectVolume(options, source)
+		if common.Error(err) {
+			return "", nil, err
+		}
 
-		uid.Id = sha.nextUID()
+		uid.Id, err = sha.nextUID()
+		if common.Error(err) {
+			return "", nil, err
+		}
 		uid.Version = 1
 	}
 
-	cluster.Lock(cluster.ByStorageVolume(volume.Name))
-	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+	volume = sha.primary(volume)
 
-	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+	if volume.ReadOnly {
+		return "", nil, &ErrVolumeReadOnly{volume.Name}
+	}
+
+	digest, err := sha.storeObject(volume, uid, source)
 	if common.Error(err) {
 		return "", nil, err
 	}
 
-	if common.FileExists(path) {
-		sha, err := common.FileSize(path)
-		if common.Error(err) {
-			return "", nil, err
-		}
+	err = sha.replicate(volume, uid)
+	if common.Error(err) {
+		return "", nil, err
+	}
 
-		if sha > 0 {
-			return "", nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	cache.Put(SHA_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+
+	return uid.String(), &digest.Value, nil
+}
+
+// selectVolume returns the volume a new id is stored on, either the one requested by the options or
+// the one chosen by placement
+func (sha *Sha) selectVolume(options *Options, source io.Reader) (*ShaVolume, io.Reader, error) {
+	if options != nil && len(options.VolumeName) > 0 {
+		volume, ok := sha.volumes[options.VolumeName]
+		if !ok {
+			return nil, nil, &ErrInvalidVolumeName{options.VolumeName}
 		}
+
+		return volume, source, nil
+	}
+
+	if len(sha.volumes) == 0 {
+		return nil, nil, &ErrNoVolumesDefined{}
 	}
 
-	err = os.MkdirAll(filepath.Dir(path), common.DefaultDirMode)
+	name, source, err := placeObject(sha.placement, sha.placementVolumes(), source, "", options.expectedSize())
 	if common.Error(err) {
-		return "", nil, err
+		return nil, nil, err
+	}
+
+	return sha.volumes[name], source, nil
+}
+
+// storeObject writes the object to a single volume
+func (sha *Sha) storeObject(volume *ShaVolume, uid *ShaUID, source io.Reader) (*Digest, error) {
+	if volume.ReadOnly {
+		return nil, &ErrVolumeReadOnly{volume.Name}
 	}
 
-	dest, err := os.Create(path)
+	cluster.Lock(cluster.ByStorageVolume(volume.Name))
+	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+	if volume.Zip {
+		return sha.storeZip(volume, uid, source)
+	}
+
+	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
 	if common.Error(err) {
-		return "", nil, err
+		return nil, err
 	}
-	defer func() {
-		common.DebugError(dest.Close())
-	}()
 
-	h, err := hash.New(hash.MD5)
+	if isRegularFile(path) {
+		return nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+
+	digest, _, err := writeObject(volume, path, source)
 	if common.Error(err) {
-		return "", nil, err
+		return nil, err
 	}
 
-	_, err = io.Copy(io.MultiWriter(dest, h), source)
+	addUsage(volume.Path, objectUsage(path))
+
+	return digest, nil
+}
+
+// writeObject writes source as loose file to path together with its record. The content is written
+// to a temp file first so a failed write never leaves a partial object at path.
+func writeObject(volume *ShaVolume, path string, source io.Reader) (*Digest, int64, error) {
+	dest, err := createTemp(path)
 	if common.Error(err) {
-		return "", nil, err
+		return nil, -1, err
+	}
+	defer discardTemp(dest)
+
+	writer, source, format, err := volume.writer(dest, source)
+	if common.Error(err) {
+		return nil, -1, err
 	}
 
-	digest := h.Sum(nil)
+	digest, n, err := copyDigest(writer, source, volume.Hash, nil, false)
+	if common.Error(err) {
+		return nil, -1, err
+	}
 
-	cache.Put(SHA_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+	err = writer.Close()
+	if common.Error(err) {
+		return nil, -1, err
+	}
 
-	return uid.String(), &digest, nil
+	err = commitObject(dest, path, path+DIGEST_SUFFIX, &record{digest: digest, format: format})
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	return digest, n, nil
 }
 
 func (sha *Sha) Load(suid string, dest io.Writer, options *Options) (string, *[]byte, int64, error) {
@@ -493,11 +716,36 @@ func (sha *Sha) Load(suid string, dest io.Writer, options *Options) (string, *[]
 	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
 	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
 
-	_, path, err := sha.find(uid, options)
+	err = sha.latest(uid)
+	if common.Error(err) {
+		return "", nil, -1, err
+	}
+
+	volume, path, err := sha.find(uid, options)
 	if common.Error(err) {
 		return "", nil, -1, err
 	}
 
+	if uid.Object != "" && isZipContainer(path) {
+		digest, n, err := loadZipEntry(volume, uid, path, dest, options != nil && options.Verify)
+		err = objectError(err, volume.Name, uid.String())
+		if common.Error(err) {
+			return "", nil, -1, err
+		}
+
+		path, err = createShaPath(volume.Path, uid, volume.Flat, true)
+		if common.Error(err) {
+			return "", nil, -1, err
+		}
+
+		return path, &digest.Value, n, nil
+	}
+
+	expected, err := readRecordFile(path+DIGEST_SUFFIX, volume.formatted())
+	if common.Error(err) {
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
+	}
+
 	source, err := os.Open(path)
 	if common.Error(err) {
 		return "", nil, -1, err
@@ -506,19 +754,52 @@ func (sha *Sha) Load(suid string, dest io.Writer, options *Options) (string, *[]
 		common.DebugError(source.Close())
 	}()
 
-	h, err := hash.New(hash.MD5)
+	reader, err := plainReader(source, expected.format, volume.keys)
 	if common.Error(err) {
-		return "", nil, -1, err
+		return "", nil, -1, objectError(err, volume.Name, uid.String())
 	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
 
-	n, err := io.Copy(io.MultiWriter(dest, h), source)
+	digest, n, err := copyDigest(dest, reader, volume.Hash, expected.digest, options != nil && options.Verify)
+	err = objectError(err, volume.Name, uid.String())
 	if common.Error(err) {
 		return "", nil, -1, err
 	}
 
-	digest := h.Sum(nil)
+	return path, &digest.Value, n, nil
+}
 
-	return path, &digest, n, nil
+func (sha *Sha) Open(suid string, options *Options) (io.ReadSeekCloser, *ObjectInfo, error) {
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	err = sha.latest(uid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	return sha.open(uid, options)
+}
+
+// open opens the object of the uid without taking the uid lock
+func (sha *Sha) open(uid *ShaUID, options *Options) (io.ReadSeekCloser, *ObjectInfo, error) {
+	volume, path, err := sha.find(uid, options)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	if uid.Object != "" && isZipContainer(path) {
+		return openZipEntry(volume, uid, path)
+	}
+
+	return openFile(volume.Name, uid.String(), path, path+DIGEST_SUFFIX, volume.formatted(), volume.keys)
 }
 
 func (sha *Sha) Delete(suid string, options *Options) error {
@@ -530,48 +811,37 @@ func (sha *Sha) Delete(suid string, options *Options) error {
 	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
 	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
 
-	var volume *ShaVolume
-	var path string
-
-	volume, path, err = sha.find(uid, options)
+	volume, _, err := sha.find(uid, options)
 	if common.Error(err) {
 		return err
 	}
 
-	if common.IsFile(path) {
-		err := os.Remove(path)
-		if common.Error(err) {
-			return err
-		}
-	} else {
-		cluster.Lock(cluster.ByStorageVolume(volume.Name))
-		defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+	versions, err := sha.deletedVersions(uid)
+	if common.Error(err) {
+		return err
+	}
 
-		err := os.RemoveAll(path)
-		if common.Error(err) {
+	for _, version := range versions {
+		err := sha.checkVersion(version)
+		if err != nil {
 			return err
 		}
+	}
 
-		for {
-			path = filepath.Dir(path)
+	volume = sha.primary(volume)
 
-			if path == volume.Path {
-				break
-			}
-
-			files, err := os.ReadDir(path)
-			if common.Error(err) {
-				break
-			}
+	if sha.grace > 0 {
+		err = sha.trash(volume, uid, versions)
+	} else {
+		err = sha.deleteReplicated(volume, uid)
+	}
+	if common.Error(err) {
+		return err
+	}
 
-			if len(files) == 0 {
-				err := os.RemoveAll(path)
-				if common.Error(err) {
-					break
-				}
-			} else {
-				break
-			}
+	if uid.Object == "" {
+		for _, version := range versions {
+			removeRetention(volume.Path, version.String())
 		}
 	}
 
@@ -580,107 +850,137 @@ func (sha *Sha) Delete(suid string, options *Options) error {
 	return nil
 }
 
-func (sha *Sha) rebuildBucket(wg *sync.WaitGroup, uid *ShaUID, version int) {
-	defer wg.Done()
+// deleteObject removes the object or the version of an uid from a single volume
+func (sha *Sha) deleteObject(volume *ShaVolume, uid *ShaUID) error {
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
 
-	bucket := models.NewBucket()
-	bucket.Uid = uid.String()
+	cluster.Lock(cluster.ByStorageVolume(volume.Name))
+	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+	if volume.Zip {
+		container, err := createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
+		if common.Error(err) {
+			return err
+		}
 
-	wgIndex := sync.WaitGroup{}
-	mapIndex := make(map[int]index.IndexResult)
+		if isRegularFile(container) {
+			return sha.deleteZip(volume, uid, container)
+		}
+	}
+
+	path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+	if common.Error(err) {
+		return err
+	}
 
-	page := 1
+	if !common.FileExists(path) {
+		return &ErrObjectNotFound{volume.Name, uid.String()}
+	}
 
-	for ; ; page++ {
-		uid.Object = PAGE + "." + strconv.Itoa(page)
+	if common.IsFile(path) {
+		n := objectUsage(path)
 
-		path, h, n, err := sha.Load(uid.String(), io.Discard, nil)
+		err := os.Remove(path)
 		if common.Error(err) {
-			if page == 1 {
-				common.Error(err)
-			}
-			break
+			return err
 		}
 
-		bucket.FileNames = append(bucket.FileNames, uid.Object)
-		bucket.FileHashes = append(bucket.FileHashes, hex.EncodeToString(*h))
+		err = os.Remove(path + DIGEST_SUFFIX)
+		if err != nil && !os.IsNotExist(err) {
+			common.Error(err)
 
-		wgIndex.Add(1)
-		go func(page int, path string) {
-			defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+			return err
+		}
 
-			ir := index.IndexResult{}
+		addUsage(volume.Path, -n)
 
-			err = index.Exec(func(index index.Handle) error {
-				ir.MimeType, ir.Mapping, ir.Thumbnail, ir.Fulltext, ir.Orientation, err = index.Index(path, nil)
+		unzips.invalidate(path)
 
-				return err
-			})
-			if common.Error(err) {
-				common.Error(err)
-				return
-			}
+		return nil
+	}
+
+	n := diskUsage(path, "")
+
+	err = os.RemoveAll(path)
+	if common.Error(err) {
+		return err
+	}
 
-			mapIndex[page] = ir
+	addUsage(volume.Path, -n)
 
-			wgIndex.Done()
-		}(page, path)
+	removeEmptyDirs(volume.Path, path)
 
-		bucket.FileSizes = append(bucket.FileSizes, n)
+	return nil
+}
+
+func (sha *Sha) rebuildBucket(uid *ShaUID) error {
+	var objects []string
+
+	for page := 1; ; page++ {
+		object := NewShaUID(uid.Id, uid.Version, PAGE+"."+strconv.Itoa(page))
+
+		_, _, err := sha.find(object, nil)
+		if err != nil {
+			break
+		}
 
-		common.Debug("%s: %s", (*uid).String(), hex.EncodeToString(*h))
+		objects = append(objects, object.String())
 	}
 
-	wgIndex.Wait()
+	_, err := saveBucket(sha, uid.String(), objects)
+
+	return err
+}
+
+func (sha *Sha) Rebuild(job *RebuildJob) (int, error) {
+	start := NewShaUID(1, 1, "")
 
-	for i := 1; i < page; i++ {
-		ir := mapIndex[i]
-		bucket.FileMimeTypes = append(bucket.FileMimeTypes, ir.MimeType)
+	if job.Resume() != "" {
+		uid, err := ParseShaUID(job.Resume())
+		if common.Error(err) {
+			return -1, err
+		}
+
+		start = NewShaUID(uid.Id, uid.Version+1, "")
 	}
 
-	err := database.Exec(func(db database.Handle) error {
-		return db.SaveBucket(&bucket, nil)
-	})
+	maxId, err := sha.maxId()
 	if common.Error(err) {
-		common.Error(err)
-		return
+		return -1, err
 	}
-}
-
-func (sha *Sha) Rebuild() (int, error) {
-	cluster.Lock(cluster.ByStorage())
-	defer cluster.Unlock(cluster.ByStorage())
 
 	c := 0
-	wg := sync.WaitGroup{}
 
-loop_id:
-	for id := 1; true; id++ {
-	loop_version:
-		for version := 1; ; version++ {
+	for id := start.Id; id <= maxId; id++ {
+		_, path, err := sha.find(NewShaUID(id, 0, ""), nil)
+		if err != nil {
+			continue
+		}
+
+		current, err := sha.currentVersion(nil, path)
+		if common.Error(err) {
+			return c, err
+		}
+
+		for version := common.Eval(id == start.Id, start.Version, 1); version <= current; version++ {
 			uid := NewShaUID(id, version, "")
 
 			_, _, err := sha.find(uid, nil)
-			if _, ok := err.(*ErrObjectNotFound); ok {
-				if version == 1 {
-					break loop_id
-				} else {
-					break loop_version
-				}
+			if err != nil {
+				continue
 			}
 
-			c++
-
-			wg.Add(1)
-			go func() {
-				defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+			if !job.Submit(uid.String(), func() error {
+				return sha.rebuildBucket(uid)
+			}) {
+				return c, nil
+			}
 
-				sha.rebuildBucket(&wg, uid, version)
-			}()
+			c++
 		}
 	}
 
-	wg.Wait()
-
 	return c, nil
 }
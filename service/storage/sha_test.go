@@ -1,21 +1,26 @@
 package storage
 
 import (
+	"archive/zip"
 	"bytes"
+	"container/list"
 	"github.com/stretchr/testify/require"
 	"io"
 	"strconv"
+	"strings"
 	"testing"
 
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"encoding/hex"
 	"flag"
 
 	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/hash"
 )
 
 var count = flag.Int("count", 100, "amount of documents to test with")
@@ -271,7 +276,7 @@ func TestFilestorage(t *testing.T) {
 					m.uid.Object = PAGE + "." + strconv.Itoa(page)
 				}
 
-				suid, hash, err := fs.Store(m.uid.String(), bytes.NewReader([]byte(s)), &Options{volNames[common.Rnd(len(volNames))]})
+				suid, hash, err := fs.Store(m.uid.String(), bytes.NewReader([]byte(s)), &Options{VolumeName: volNames[common.Rnd(len(volNames))]})
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -388,3 +393,719 @@ loop_id:
 		}
 	}
 }
+
+func TestBasicOpen(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	fs, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fs.AddVolume(v)
+
+	s := "Hello world!"
+
+	suid, _, err := fs.Store(NewShaUID(0, 0, PAGE+"."+strconv.Itoa(1)).String(), bytes.NewReader([]byte(s)), &Options{VolumeName: "test"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	reader, info, err := fs.Open(suid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(reader.Close())
+	}()
+
+	require.Equal(t, int64(len(s)), info.Size, "Size compare")
+
+	_, err = reader.Seek(6, io.SeekStart)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, s[6:], string(ba), "Content compare")
+}
+
+func TestUIDRecovery(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	store := func() int {
+		fs, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, false)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		fs.AddVolume(v)
+
+		err = fs.Start()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		suid, _, err := fs.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), &Options{VolumeName: "test"})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		return uid.Id
+	}
+
+	for id := 1; id <= 3; id++ {
+		require.Equal(t, id, store(), "Correct incremented ID over handles")
+	}
+
+	// simulate a restart with a lost uid file
+	err = os.Remove(metaPath(path, SHA_UID_FILE))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	shaUIDsMu.Lock()
+	delete(shaUIDs, path)
+	shaUIDsMu.Unlock()
+
+	require.Equal(t, 4, store(), "Correct recovered ID")
+
+	// simulate a restart with an intact uid file
+	shaUIDsMu.Lock()
+	delete(shaUIDs, path)
+	shaUIDsMu.Unlock()
+
+	require.Equal(t, 5, store(), "Correct persisted ID")
+}
+
+func TestUIDReadOnly(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	rw := filepath.Join(path, "rw")
+	ro := filepath.Join(path, "ro")
+
+	// an object with a higher id on the read-only volume
+	p, err := createShaPath(ro, NewShaUID(7, 1, PAGE+".1"), false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), common.DefaultDirMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(p, []byte("Hello world!"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	// a lock file left behind by a crashed process
+	err = os.MkdirAll(filepath.Join(rw, META_DIR), common.DefaultDirMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(metaPath(rw, SHA_UID_LOCK), []byte("1"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = sha.Init(&Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "rw", Path: rw}, {Name: "ro", Path: ro, ReadOnly: true}}})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = sha.Start()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 8, uid.Id, "ids of the read-only volume are respected")
+	require.Less(t, time.Since(start), SHA_LOCK_TIMEOUT, "left behind lock file does not block")
+	require.False(t, common.FileExists(filepath.Join(ro, META_DIR)), "read-only volume untouched")
+
+	id, err := readUIDFile(sha.volumes["rw"])
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 8, id)
+}
+
+func TestVerify(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	fs, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Hash = hash.SHA256
+
+	fs.AddVolume(v)
+
+	suid, hs, err := fs.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), &Options{VolumeName: "test"})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 32, len(*hs), "SHA-256 digest")
+
+	_, _, _, err = fs.Load(suid, io.Discard, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, p, err := fs.find(NewShaUID(1, 1, PAGE+".1"), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	rec, err := readRecordFile(p+DIGEST_SUFFIX, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, hash.SHA256, rec.digest.Algorithm, "Recorded algorithm")
+	require.Equal(t, *hs, rec.digest.Value, "Recorded digest")
+
+	err = os.WriteFile(p, []byte("Hello World!"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = fs.Load(suid, io.Discard, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = fs.Load(suid, io.Discard, &Options{Verify: true})
+	_, ok := err.(*ErrObjectCorrupted)
+	require.True(t, ok, "load of corrupted object gave no error")
+}
+
+func TestZipArchive(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	fs, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, true)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	fs.AddVolume(v)
+
+	uid := NewShaUID(0, 0, "")
+	contents := make(map[string]string)
+
+	for version := 1; version <= 2; version++ {
+		uid.Version = 0
+		for page := 1; page <= 3; page++ {
+			uid.Object = PAGE + "." + strconv.Itoa(page)
+
+			s := fmt.Sprintf("Version %d Page %d", version, page)
+
+			suid, _, err := fs.Store(uid.String(), bytes.NewReader([]byte(s)), &Options{VolumeName: "test"})
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			uid, err = ParseShaUID(suid)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, version, uid.Version, "Correct version")
+
+			contents[suid] = s
+		}
+
+		p, err := createShaPath(v.Path, uid.withoutObject(), false, true)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.True(t, common.FileExists(p), "Zip container exists")
+	}
+
+	current, err := fs.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, current, "Correct current version")
+
+	for suid, s := range contents {
+		var w bytes.Buffer
+
+		_, _, _, err := fs.Load(suid, &w, &Options{Verify: true})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, s, w.String(), "Content compare")
+	}
+
+	reader, info, err := fs.Open(NewShaUID(uid.Id, 2, PAGE+".3").String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, int64(len("Version 2 Page 3")), info.Size, "Size compare")
+
+	_, err = reader.Seek(10, io.SeekStart)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	common.Error(reader.Close())
+
+	require.Equal(t, "Page 3", string(ba), "Content compare")
+
+	deleted := NewShaUID(uid.Id, 1, PAGE+".2")
+
+	err = fs.Delete(deleted.String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = fs.Load(deleted.String(), io.Discard, nil)
+	_, ok := err.(*ErrObjectNotFound)
+	require.True(t, ok, "load on deleted page gave no error")
+
+	_, _, _, err = fs.Load(NewShaUID(uid.Id, 1, PAGE+".3").String(), io.Discard, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = fs.Delete(NewShaUID(uid.Id, 1, "").String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for version := 1; version <= 2; version++ {
+		_, _, err = fs.find(NewShaUID(uid.Id, version, ""), nil)
+		_, ok = err.(*ErrObjectNotFound)
+		require.True(t, ok, "find on deleted uid gave no error")
+	}
+}
+
+func TestZipManifest(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, true)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha.AddVolume(v)
+
+	uid := NewShaUID(0, 0, "")
+	contents := make(map[string]string)
+
+	// the records of all entries exceed the 64 KB a zip comment can hold
+	for page := 1; page <= 400; page++ {
+		uid.Object = fmt.Sprintf("%s.%d.%s", PAGE, page, strings.Repeat("x", 200))
+
+		s := fmt.Sprintf("Page %d", page)
+
+		suid, _, err := sha.Store(uid.String(), bytes.NewReader([]byte(s)), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err = ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		contents[suid] = s
+	}
+
+	for suid, s := range contents {
+		buf := bytes.Buffer{}
+
+		_, _, _, err := sha.Load(suid, &buf, &Options{Verify: true})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, s, buf.String(), "Correct content")
+	}
+
+	f, info, err := sha.Open(uid.String(), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	common.Error(f.Close())
+
+	require.NotNil(t, info.Digest, "Recorded digest")
+
+	names, err := listObjects(v, uid.withoutObject())
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, len(contents), len(names), "Manifest is no object")
+
+	uid.Object = ZIP_MANIFEST
+
+	_, _, err = sha.Store(uid.String(), bytes.NewReader([]byte("manifest")), nil)
+	_, ok := err.(*ErrInvalidUID)
+	require.True(t, ok, "Manifest cannot be stored as object")
+
+	_, _, _, err = sha.Load(uid.String(), io.Discard, nil)
+	_, ok = err.(*ErrObjectNotFound)
+	require.True(t, ok, "Manifest cannot be loaded as object")
+}
+
+func TestUnzipCache(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	container := filepath.Join(path, "test.zip")
+
+	for page := 1; page <= 3; page++ {
+		_, err := rewriteZip(&ShaVolume{Name: "test", Hash: hash.MD5}, container, "", PAGE+"."+strconv.Itoa(page), bytes.NewReader(bytes.Repeat([]byte{byte(page)}, 1000)))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	c := &unzipCache{limit: 2000, lru: list.New(), entries: make(map[string]*list.Element)}
+	c.acquire()
+
+	r, err := zip.OpenReader(container)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for _, f := range r.File {
+		if f.Name == ZIP_MANIFEST {
+			continue
+		}
+
+		file, err := c.open(container+"|"+f.Name, f.Open)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		common.Error(file.Close())
+	}
+
+	common.Error(r.Close())
+
+	require.Equal(t, 2, c.lru.Len(), "Least recently used entry evicted")
+	require.Equal(t, int64(2000), c.size, "Cache size")
+
+	c.invalidate(container)
+
+	require.Equal(t, 0, c.lru.Len(), "Entries of container invalidated")
+
+	dir := c.dir
+
+	c.release()
+
+	require.False(t, common.FileExists(dir), "Cache removed on release")
+}
+
+func TestReplication(t *testing.T) {
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"nas1", "nas2"} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		v, err := NewShaVolume(name, path, false, i == 1)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+	}
+
+	primary := sha.Volume("nas1")
+	replica := sha.Volume("nas2")
+	primary.Replicas = []string{replica.Name}
+
+	require.Nil(t, sha.validateReplicas())
+	require.Equal(t, 1, len(sha.placementVolumes()), "replica is no placement candidate")
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	p, err := locate(primary, uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, err = locate(replica, uid)
+	require.Nil(t, err, "object replicated")
+
+	err = os.WriteFile(p, []byte("Hello World!"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+
+	_, _, _, err = sha.Load(suid, &buf, &Options{Verify: true})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, "Hello world!", buf.String(), "load falls back to replica")
+
+	c, err := sha.Repair()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, c, "corrupted primary repaired")
+	require.Nil(t, checkObject(primary, uid, p))
+
+	err = sha.deleteObject(replica, uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	c, err = sha.Repair()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, c, "lost replica repaired")
+
+	_, err = locate(replica, uid)
+	require.Nil(t, err, "replica restored")
+
+	replica.ReadOnly = true
+
+	_, _, err = sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), nil)
+	_, ok := err.(*ErrQuorumNotReached)
+	require.True(t, ok, "store without quorum gave no error")
+
+	primary.Quorum = 1
+
+	_, _, err = sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("Hello world!")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	replica.ReadOnly = false
+
+	err = sha.Delete(suid, nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for _, v := range []*ShaVolume{primary, replica} {
+		_, err = locate(v, uid)
+		_, ok = err.(*ErrObjectNotFound)
+		require.True(t, ok, "object deleted on volume %s", v.Name)
+	}
+}
+
+func TestRepairVersions(t *testing.T) {
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"nas1", "nas2"} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		v, err := NewShaVolume(name, path, false, i == 1)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+	}
+
+	primary := sha.Volume("nas1")
+	replica := sha.Volume("nas2")
+	primary.Replicas = []string{replica.Name}
+
+	uid := NewShaUID(0, 0, PAGE+".1")
+
+	for version := 1; version <= 3; version++ {
+		suid, _, err := sha.Store(uid.String(), bytes.NewReader([]byte(fmt.Sprintf("Version %d", version))), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err = ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid.Version = 0
+	}
+
+	// version 2 is gone on all volumes
+	for _, volume := range []*ShaVolume{primary, replica} {
+		path, err := locate(volume, NewShaUID(uid.Id, 2, ""))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = os.RemoveAll(path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	lost := NewShaUID(uid.Id, 3, PAGE+".1")
+
+	err = sha.deleteObject(replica, lost)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	corrupted := NewShaUID(uid.Id, 1, PAGE+".1")
+
+	p, err := locate(primary, corrupted)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(p, []byte("Version X"), common.DefaultFileMode)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	c, err := sha.Repair()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 2, c, "versions after a missing version repaired")
+	require.Nil(t, checkObject(primary, corrupted, p))
+
+	p, err = locate(replica, lost)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Nil(t, checkObject(replica, lost, p))
+}
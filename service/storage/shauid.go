@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	// META_DIR is the directory inside a volume which holds the administrative files of tresor
+	META_DIR = ".tresor"
+
+	SHA_UID_FILE     = "uid"
+	SHA_UID_LOCK     = "uid.lock"
+	SHA_LOCK_TIMEOUT = time.Second * 30
+)
+
+var (
+	// shaUIDs holds per volume path the highest id found by scanning the volume, shared by all Sha handles
+	shaUIDs   = make(map[string]int)
+	shaUIDsMu sync.Mutex
+)
+
+func metaPath(volumePath string, name string) string {
+	return filepath.Join(volumePath, META_DIR, name)
+}
+
+// lockVolume acquires an exclusive lock on a file inside the volume which is respected by all processes sharing
+// the volume. The lock is held by the OS on the open file, so a crashed process never leaves a stale lock behind.
+func lockVolume(volume *ShaVolume, name string) (func(), error) {
+	err := os.MkdirAll(filepath.Join(volume.Path, META_DIR), common.DefaultDirMode)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	path := metaPath(volume.Path, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, common.DefaultFileMode)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	for {
+		ok, err := tryLockFile(f)
+		if common.Error(err) {
+			common.DebugError(f.Close())
+
+			return nil, err
+		}
+
+		if ok {
+			return func() {
+				common.Error(unlockFile(f))
+				common.Error(f.Close())
+			}, nil
+		}
+
+		if time.Since(start) > SHA_LOCK_TIMEOUT {
+			common.DebugError(f.Close())
+
+			return nil, &ErrVolumeLocked{Volume: volume.Name, Path: path}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func readUIDFile(volume *ShaVolume) (int, error) {
+	ba, err := os.ReadFile(metaPath(volume.Path, SHA_UID_FILE))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if common.Error(err) {
+		return -1, err
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(string(ba)))
+	if err != nil {
+		common.Warn("invalid content of uid file in volume %s, fallback to scan", volume.Name)
+
+		return 0, nil
+	}
+
+	return id, nil
+}
+
+// writeUIDFile replaces the uid file atomically so a crash never leaves a truncated counter behind
+func writeUIDFile(volume *ShaVolume, id int) error {
+	path := metaPath(volume.Path, SHA_UID_FILE)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, common.DefaultFileMode)
+	if common.Error(err) {
+		return err
+	}
+
+	_, err = f.WriteString(strconv.Itoa(id))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	common.DebugError(f.Close())
+
+	if common.Error(err) {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if common.Error(err) {
+		return err
+	}
+
+	return nil
+}
+
+func parseShaId(name string) (int, bool) {
+	name, _, _ = strings.Cut(name, ".")
+
+	id, err := strconv.Atoi(name)
+
+	return id, err == nil
+}
+
+// scanShaId returns the highest id stored below path, descending only into the highest populated directories
+func scanShaId(path string, level int) (int, error) {
+	files, err := os.ReadDir(path)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	ids := make([]int, 0)
+	names := make(map[int]string)
+
+	for _, file := range files {
+		if level > 0 && !file.IsDir() {
+			continue
+		}
+
+		id, ok := parseShaId(file.Name())
+		if !ok {
+			continue
+		}
+
+		if _, ok := names[id]; !ok {
+			ids = append(ids, id)
+			names[id] = file.Name()
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids {
+		if level == 0 {
+			return id, nil
+		}
+
+		max, err := scanShaId(filepath.Join(path, names[id]), level-1)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		if max > 0 {
+			return max, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// recoverShaUIDs scans every volume once per process for the highest stored id
+func recoverShaUIDs(volumes []*ShaVolume) error {
+	shaUIDsMu.Lock()
+	defer shaUIDsMu.Unlock()
+
+	return recoverShaUIDsLocked(volumes)
+}
+
+func recoverShaUIDsLocked(volumes []*ShaVolume) error {
+	for _, volume := range volumes {
+		if _, ok := shaUIDs[volume.Path]; ok {
+			continue
+		}
+
+		id, err := scanShaId(volume.Path, common.Eval(volume.Flat, 0, 3))
+		if common.Error(err) {
+			return err
+		}
+
+		common.Debug("recovered highest id of volume %s: %d", volume.Name, id)
+
+		shaUIDs[volume.Path] = id
+	}
+
+	return nil
+}
+
+func shaIdExists(volume *ShaVolume, id int) bool {
+	uid := NewShaUID(id, 1, "")
+
+	for _, zip := range []bool{false, true} {
+		path, err := createShaPath(volume.Path, uid, volume.Flat, zip)
+		if err == nil && common.FileExists(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextShaUID allocates the next free id over all volumes. The allocated id is persisted in every writable
+// volume before it is handed out, so neither a restart nor a concurrent process can allocate it again.
+// Read-only volumes are only read.
+func nextShaUID(volumes []*ShaVolume) (int, error) {
+	shaUIDsMu.Lock()
+	defer shaUIDsMu.Unlock()
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Path < volumes[j].Path
+	})
+
+	writable := make([]*ShaVolume, 0, len(volumes))
+	for _, volume := range volumes {
+		if !volume.ReadOnly {
+			writable = append(writable, volume)
+		}
+	}
+
+	for _, volume := range writable {
+		unlock, err := lockVolume(volume, SHA_UID_LOCK)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		defer unlock()
+	}
+
+	err := recoverShaUIDsLocked(volumes)
+	if common.Error(err) {
+		return -1, err
+	}
+
+	id := 0
+
+	for _, volume := range volumes {
+		c, err := readUIDFile(volume)
+		if common.Error(err) {
+			return -1, err
+		}
+
+		id = max(id, c, shaUIDs[volume.Path])
+	}
+
+loop:
+	for {
+		id++
+
+		for _, volume := range volumes {
+			if shaIdExists(volume, id) {
+				continue loop
+			}
+		}
+
+		break
+	}
+
+	for _, volume := range writable {
+		err := writeUIDFile(volume, id)
+		if common.Error(err) {
+			return -1, err
+		}
+	}
+
+	return id, nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	ZIP_EXT = ".zip"
+)
+
+// isZipContainer checks if the path returned by find refers to a zip container and not to a version directory
+func isZipContainer(path string) bool {
+	return strings.HasSuffix(path, ZIP_EXT) && isRegularFile(path)
+}
+
+// zipCurrentVersion returns the latest version stored next to the container of the first version
+func zipCurrentVersion(container string) (int, error) {
+	base := strings.TrimSuffix(filepath.Base(container), ZIP_EXT) + "."
+
+	files, err := os.ReadDir(filepath.Dir(container))
+	if common.Error(err) {
+		return -1, err
+	}
+
+	currentVersion := 0
+
+	for _, file := range files {
+		name := file.Name()
+
+		if file.IsDir() || !strings.HasPrefix(name, base) || !strings.HasSuffix(name, ZIP_EXT) {
+			continue
+		}
+
+		v, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, base), ZIP_EXT))
+		if err != nil {
+			continue
+		}
+
+		currentVersion = max(currentVersion, v)
+	}
+
+	return currentVersion + 1, nil
+}
+
+// rewriteZip replaces the container with a copy in which the entry remove is left out and the entry name is added
+// from source. The records of all entries are kept in the manifest entry. A container without entries is removed.
+func rewriteZip(volume *ShaVolume, path string, remove string, name string, source io.Reader) (*Digest, error) {
+	records := make(zipRecords)
+
+	var files []*zip.File
+
+	if common.FileExists(path) {
+		r, err := zip.OpenReader(path)
+		if common.Error(err) {
+			return nil, err
+		}
+		defer func() {
+			common.DebugError(r.Close())
+		}()
+
+		records, err = readZipManifest(r)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		files = r.File
+	}
+
+	found := false
+
+	for _, f := range files {
+		if name != "" && f.Name == name {
+			return nil, &ErrObjectAlreadyExists{}
+		}
+
+		found = found || f.Name == remove
+	}
+
+	if remove != "" && !found {
+		return nil, &ErrObjectNotFound{}
+	}
+
+	temp, err := createTemp(path)
+	if common.Error(err) {
+		return nil, err
+	}
+	defer discardTemp(temp)
+
+	w := zip.NewWriter(temp)
+
+	entries := 0
+
+	for _, f := range files {
+		if f.Name == remove || f.Name == ZIP_MANIFEST {
+			continue
+		}
+
+		err := w.Copy(f)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		entries++
+	}
+
+	delete(records, remove)
+
+	var digest *Digest
+
+	if name != "" {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if common.Error(err) {
+			return nil, err
+		}
+
+		writer, source, format, err := volume.writer(fw, source)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		digest, _, err = copyDigest(writer, source, volume.Hash, nil, false)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		err = writer.Close()
+		if common.Error(err) {
+			return nil, err
+		}
+
+		records[name] = &record{digest: digest, format: format}
+
+		entries++
+	}
+
+	err = writeZipManifest(w, records)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	err = w.Close()
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if entries == 0 {
+		err = os.Remove(path)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		return nil, nil
+	}
+
+	err = commitTemp(temp, path)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return digest, nil
+}
+
+func (sha *Sha) storeZip(volume *ShaVolume, uid *ShaUID, source io.Reader) (*Digest, error) {
+	if uid.Object == "" || uid.Object == ZIP_MANIFEST {
+		return nil, &ErrInvalidUID{uid.String()}
+	}
+
+	path, err := createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	n := diskUsage(path, "")
+
+	digest, err := rewriteZip(volume, path, "", uid.Object, source)
+	if _, ok := err.(*ErrObjectAlreadyExists); ok {
+		return nil, &ErrObjectAlreadyExists{volume.Name, uid.String()}
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	addUsage(volume.Path, diskUsage(path, "")-n)
+
+	unzips.invalidate(path)
+
+	return digest, nil
+}
+
+func (sha *Sha) deleteZip(volume *ShaVolume, uid *ShaUID, path string) error {
+	if uid.Object != "" {
+		n := diskUsage(path, "")
+
+		_, err := rewriteZip(volume, path, uid.Object, "", nil)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			return &ErrObjectNotFound{volume.Name, uid.String()}
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		addUsage(volume.Path, diskUsage(path, "")-n)
+	} else {
+		paths, err := zipContainers(volume, uid, path)
+		if common.Error(err) {
+			return err
+		}
+
+		for _, p := range paths {
+			n := diskUsage(p, "")
+
+			err := os.Remove(p)
+			if err != nil && !os.IsNotExist(err) {
+				common.Error(err)
+
+				return err
+			}
+
+			addUsage(volume.Path, -n)
+
+			unzips.invalidate(p)
+		}
+	}
+
+	removeEmptyDirs(volume.Path, path)
+
+	unzips.invalidate(path)
+
+	return nil
+}
+
+// zipContainers returns the containers of the version of an uid, those of all its versions if the uid
+// addresses the whole id
+func zipContainers(volume *ShaVolume, uid *ShaUID, path string) ([]string, error) {
+	paths := []string{path}
+
+	if uid.Version > 1 {
+		return paths, nil
+	}
+
+	v, err := zipCurrentVersion(path)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	for version := 2; version <= v; version++ {
+		p, err := createShaPath(volume.Path, NewShaUID(uid.Id, version, ""), volume.Flat, true)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// copyZipEntry adds the entry name of the container src together with its record to the container dst
+func copyZipEntry(src string, dst string, name string) error {
+	r, err := zip.OpenReader(src)
+	if common.Error(err) {
+		return err
+	}
+	defer func() {
+		common.DebugError(r.Close())
+	}()
+
+	entry := zipEntry(r, name)
+	if entry == nil {
+		return &ErrObjectNotFound{}
+	}
+
+	sources, err := readZipManifest(r)
+	if common.Error(err) {
+		return err
+	}
+
+	records := make(zipRecords)
+
+	var files []*zip.File
+
+	if isRegularFile(dst) {
+		d, err := zip.OpenReader(dst)
+		if common.Error(err) {
+			return err
+		}
+		defer func() {
+			common.DebugError(d.Close())
+		}()
+
+		records, err = readZipManifest(d)
+		if common.Error(err) {
+			return err
+		}
+
+		files = d.File
+	}
+
+	temp, err := createTemp(dst)
+	if common.Error(err) {
+		return err
+	}
+	defer discardTemp(temp)
+
+	w := zip.NewWriter(temp)
+
+	for _, f := range files {
+		if f.Name == name {
+			return &ErrObjectAlreadyExists{}
+		}
+
+		if f.Name == ZIP_MANIFEST {
+			continue
+		}
+
+		err := w.Copy(f)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	err = w.Copy(entry)
+	if common.Error(err) {
+		return err
+	}
+
+	if rec, ok := sources[name]; ok {
+		records[name] = rec
+	}
+
+	err = writeZipManifest(w, records)
+	if common.Error(err) {
+		return err
+	}
+
+	err = w.Close()
+	if common.Error(err) {
+		return err
+	}
+
+	return commitTemp(temp, dst)
+}
+
+// writeZipManifest adds the manifest entry with the records of all entries to the container
+func writeZipManifest(w *zip.Writer, records zipRecords) error {
+	fw, err := w.CreateHeader(&zip.FileHeader{Name: ZIP_MANIFEST, Method: zip.Deflate, Modified: time.Now()})
+	if common.Error(err) {
+		return err
+	}
+
+	_, err = io.WriteString(fw, formatZipManifest(records))
+	if common.Error(err) {
+		return err
+	}
+
+	return nil
+}
+
+// removeEmptyDirs removes the empty parent directories of path up to the volume root
+func removeEmptyDirs(root string, path string) {
+	for {
+		path = filepath.Dir(path)
+
+		if path == root || len(path) <= len(root) {
+			break
+		}
+
+		files, err := os.ReadDir(path)
+		if common.Error(err) {
+			break
+		}
+
+		if len(files) > 0 {
+			break
+		}
+
+		err = os.RemoveAll(path)
+		if common.Error(err) {
+			break
+		}
+	}
+}
@@ -10,44 +10,109 @@ import (
 	"image/jpeg"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mpetavy/common"
-	"github.com/mpetavy/tresor/service/errors"
+	"github.com/mpetavy/tresor/service/registry"
 )
 
 const (
-	TYPE  = "storage"
-	PAGE  = "page"
-	UNZIP = "unzip"
+	TYPE = "storage"
+	PAGE = "page"
 )
 
 type Options struct {
 	VolumeName string
+	Verify     bool
+	// Size is the expected size of the content to store or 0 if unknown, placement skips volumes without room for it
+	Size int64
+}
+
+func (options *Options) expectedSize() int64 {
+	if options == nil {
+		return 0
+	}
+
+	return options.Size
+}
+
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Digest  *Digest
 }
 
 type VolumeCfg struct {
-	Name string `json:"name" html:"Name"`
-	Path string `json:"path" html:"path"`
-	Flat bool   `json:"flat" html:"Flat"`
-	Zip  bool   `json:"zip" html:"Zip"`
+	Name     string `json:"name" html:"Name"`
+	Path     string `json:"path" html:"path"`
+	Flat     bool   `json:"flat" html:"Flat"`
+	Zip      bool   `json:"zip" html:"Zip"`
+	Hash     string `json:"hash" html:"Hash"`
+	ReadOnly bool   `json:"readOnly" html:"Read only"`
+	Capacity int    `json:"capacity" html:"Capacity"`
+	// Replicas names the volumes which receive a copy of every object, Quorum the copies required to succeed
+	Replicas []string `json:"replicas" html:"Replicas"`
+	Quorum   int      `json:"quorum" html:"Quorum"`
+	// Encrypt stores new objects encrypted with the current key of the key file
+	Encrypt bool `json:"encrypt" html:"Encrypt"`
+	// Compression is the codec new objects are compressed with, CompressSkip lists additional mime types stored uncompressed
+	Compression  string   `json:"compression" html:"Compression"`
+	CompressSkip []string `json:"compressSkip" html:"Compress skip"`
+	// Watch ingests files changed outside of tresor on Fs volumes, "notify" uses inotify, "poll" rescans every WatchInterval seconds
+	Watch         string `json:"watch" html:"Watch"`
+	WatchInterval int    `json:"watchInterval" html:"Watch interval"`
+	// Retention is the number of days a stored bucket can neither be deleted nor modified
+	Retention int    `json:"retention" html:"Retention"`
+	Endpoint  string `json:"endpoint" html:"Endpoint"`
+	Bucket    string `json:"bucket" html:"Bucket"`
+	Prefix    string `json:"prefix" html:"Prefix"`
+	Region    string `json:"region" html:"Region"`
+	AccessKey string `json:"accessKey" html:"Access key"`
+	SecretKey string `json:"secretKey" html:"Secret key"`
 }
 
 type Cfg struct {
 	Driver  string      `json:"driver" html:"Driver"`
 	Rebuild bool        `json:"rebuild" html:"Rebuild"`
+	Repair  bool        `json:"repair" html:"Repair"`
 	Volumes []VolumeCfg `json:"volumes" html:"Volumes"`
+	Fixity  FixityCfg   `json:"fixity" html:"Fixity"`
+	// Trash keeps deleted objects of Sha volumes restorable until they are purged
+	Trash TrashCfg `json:"trash" html:"Trash"`
+	// RebuildWorkers limits the buckets rebuilt in parallel, 0 means one per CPU
+	RebuildWorkers int `json:"rebuildWorkers" html:"Rebuild workers"`
+	// RebuildCheckpoint is the file an interrupted rebuild resumes from
+	RebuildCheckpoint string `json:"rebuildCheckpoint" html:"Rebuild checkpoint"`
+	// Placement selects the volume for new objects without an explicit volume name
+	Placement PlacementCfg `json:"placement" html:"Placement"`
+	// UnzipCache limits the size in MB of extracted zip entries
+	UnzipCache int `json:"unzipCache" html:"Unzip cache"`
+	// KeyFile holds the keys of encrypted volumes, one "<key id> <hex key>" per line, the last key encrypts
+	KeyFile string `json:"keyFile" html:"Key file"`
+}
+
+// driverCfg holds the settings of Cfg which the storage service reads for every driver
+type driverCfg struct {
+	Driver            string    `json:"driver" html:"Driver"`
+	Rebuild           bool      `json:"rebuild" html:"Rebuild"`
+	Fixity            FixityCfg `json:"fixity" html:"Fixity"`
+	RebuildWorkers    int       `json:"rebuildWorkers" html:"Rebuild workers"`
+	RebuildCheckpoint string    `json:"rebuildCheckpoint" html:"Rebuild checkpoint"`
 }
 
 type Handle interface {
 	Init(*Cfg) error
 	Start() error
 	Stop() error
-	Rebuild() (int, error)
+	Rebuild(*RebuildJob) (int, error)
 	Store(string, io.Reader, *Options) (string, *[]byte, error)
 	Load(string, io.Writer, *Options) (string, *[]byte, int64, error)
+	Open(string, *Options) (io.ReadSeekCloser, *ObjectInfo, error)
 	Delete(string, *Options) error
 }
 
@@ -70,16 +135,66 @@ func Init(c *Cfg, router *mux.Router) error {
 	}
 
 	router.PathPrefix("/" + TYPE + "/").Handler(http.StripPrefix("/"+TYPE+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		uid := r.URL.Path
+		var err error
+
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/"+VERSIONS):
+			err = versionsHandler(rw, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/"+RESTORE):
+			err = restoreHandler(rw, r)
+		case r.Method == http.MethodPost:
+			err = storeHandler(rw, r)
+		case r.Method == http.MethodDelete:
+			err = deleteHandler(rw, r)
+		default:
+			err = loadHandler(rw, r)
+		}
 
-		common.Error(Exec(func(storage Handle) error {
-			_, _, _, err := storage.Load(uid, rw, nil)
-			if common.Error(err) {
-				return err
-			}
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
 
-			return nil
-		}))
+	router.PathPrefix("/" + TYPE + "-" + FIXITY + "/").Handler(http.StripPrefix("/"+TYPE+"-"+FIXITY+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := fixityHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
+
+	router.PathPrefix("/" + TYPE + "-" + REPAIR + "/").Handler(http.StripPrefix("/"+TYPE+"-"+REPAIR+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := repairHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
+
+	router.PathPrefix("/" + TYPE + "-" + REBUILD + "/").Handler(http.StripPrefix("/"+TYPE+"-"+REBUILD+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := rebuildHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
+
+	router.PathPrefix("/" + TYPE + "-" + RETENTION + "/").Handler(http.StripPrefix("/"+TYPE+"-"+RETENTION+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := retentionHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
+
+	router.PathPrefix("/" + TYPE + "-" + TRASH + "/").Handler(http.StripPrefix("/"+TYPE+"-"+TRASH+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := trashHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
+	})))
+
+	router.PathPrefix("/" + TYPE + "-" + EXPORT + "/").Handler(http.StripPrefix("/"+TYPE+"-"+EXPORT+"/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		err := exportHandler(rw, r)
+		if common.Error(err) {
+			httpError(rw, err)
+		}
 	})))
 
 	router.PathPrefix("/" + TYPE + "-pixeldata/").Handler(http.StripPrefix("/"+TYPE+"-pixeldata/", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
@@ -159,26 +274,32 @@ func Init(c *Cfg, router *mux.Router) error {
 	common.Info("Service storage started")
 
 	if cfg.Rebuild {
-		start := time.Now()
+		common.Error(Exec(func(storage Handle) error {
+			_, err := Rebuild(storage)
 
-		common.Info("Rebuild started ...")
+			return err
+		}))
+	}
 
+	if cfg.Repair {
 		common.Error(Exec(func(storage Handle) error {
-			c, err := storage.Rebuild()
-			if common.Error(err) {
-				return err
-			}
-
-			common.Info("Rebuild successfully completed. time needed %v, %d buckets", time.Since(start), c)
+			_, err := Repair(storage)
 
-			return nil
+			return err
 		}))
 	}
 
+	startFixity(&cfg.Fixity)
+	startTrash(&cfg.Trash)
+
 	return nil
 }
 
 func Close() {
+	stopFixity()
+	stopTrash()
+	cancelRebuild()
+
 	if pool == nil {
 		return
 	}
@@ -208,6 +329,36 @@ func Exec(fn func(handle Handle) error) error {
 	return fn(handle)
 }
 
+// openFile opens a stored file with its record file for random access, formatted tells if the volume encrypts
+// or compresses
+func openFile(volume string, uid string, path string, recordPath string, formatted bool, keys *Keyring) (io.ReadSeekCloser, *ObjectInfo, error) {
+	fi, err := os.Stat(path)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, nil, &ErrObjectNotFound{volume, uid}
+	}
+
+	r, err := readRecordFile(recordPath, formatted)
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume, uid)
+	}
+
+	file, err := os.Open(path)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	reader, size, err := plainFile(file, fi.Size(), r.format, keys, plainFileKey(path, fi))
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume, uid)
+	}
+
+	return reader, &ObjectInfo{Path: path, Size: size, ModTime: fi.ModTime(), Digest: r.digest}, nil
+}
+
 func getFromList(l list.List, index int) interface{} {
 	e := l.Front()
 
@@ -218,23 +369,43 @@ func getFromList(l list.List, index int) interface{} {
 	return e.Value
 }
 
+// isRegularFile checks if path exists and is neither a directory nor a symbolic link
+func isRegularFile(path string) bool {
+	return common.FileExists(path) && common.IsFile(path)
+}
+
+// Factory creates an uninitialized storage handle of a driver
+type Factory func() (Handle, error)
+
+var drivers = registry.New[Factory]()
+
+func init() {
+	Register(TYPE_FS, func() (Handle, error) { return NewFs() }, fsCfg{})
+	Register(TYPE_SHA, func() (Handle, error) { return NewSha() }, shaCfg{})
+	Register(TYPE_S3, func() (Handle, error) { return NewS3() }, s3Cfg{})
+	Register(TYPE_MEMORY, func() (Handle, error) { return NewMemory() }, memoryCfg{})
+}
+
+// Register makes a storage driver available by name, config is the configuration struct the driver reads.
+// It panics if the name is already registered
+func Register(name string, factory Factory, config interface{}) {
+	common.Panic(drivers.Register(name, factory, config))
+}
+
+// Drivers lists the registered storage drivers with their configuration schema
+func Drivers() []registry.Driver {
+	return drivers.Drivers()
+}
+
 func create(cfg *Cfg) (Handle, error) {
-	var storage Handle
-	var err error
+	factory, err := drivers.Factory(cfg.Driver)
+	if common.Error(err) {
+		return nil, err
+	}
 
-	switch cfg.Driver {
-	case TYPE_FS:
-		storage, err = NewFs()
-		if common.Error(err) {
-			return nil, err
-		}
-	case TYPE_SHA:
-		storage, err = NewSha()
-		if common.Error(err) {
-			return nil, err
-		}
-	default:
-		return nil, &errors.ErrUnknownDriver{Driver: cfg.Driver}
+	storage, err := factory()
+	if common.Error(err) {
+		return nil, err
 	}
 
 	err = storage.Init(cfg)
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/mpetavy/tresor/service/registry"
+	"github.com/stretchr/testify/require"
+)
+
+// requireSchemaOf checks that every field of schema is a field of cfg with the same name
+func requireSchemaOf(t *testing.T, cfg []registry.Field, schema []registry.Field, driver string) {
+	names := make(map[string]registry.Field)
+	for _, field := range cfg {
+		names[field.Name] = field
+	}
+
+	for _, field := range schema {
+		c, ok := names[field.Name]
+		require.True(t, ok, "%s: unknown field %s", driver, field.Name)
+
+		if len(field.Fields) > 0 {
+			requireSchemaOf(t, c.Fields, field.Fields, driver)
+		} else {
+			require.Equal(t, c.Type, field.Type, "%s: type of field %s", driver, field.Name)
+		}
+	}
+}
+
+func TestDrivers(t *testing.T) {
+	cfg := registry.Schema(Cfg{})
+
+	schemas := make(map[string][]registry.Field)
+
+	for _, driver := range Drivers() {
+		requireSchemaOf(t, cfg, driver.Schema, driver.Name)
+
+		schemas[driver.Name] = driver.Schema
+	}
+
+	volumeFields := func(driver string) []string {
+		var names []string
+
+		for _, field := range schemas[driver] {
+			if field.Name == "volumes" {
+				for _, f := range field.Fields {
+					names = append(names, f.Name)
+				}
+			}
+		}
+
+		return names
+	}
+
+	require.Contains(t, volumeFields(TYPE_S3), "endpoint")
+	require.NotContains(t, volumeFields(TYPE_SHA), "endpoint")
+	require.Contains(t, volumeFields(TYPE_SHA), "zip")
+	require.NotContains(t, volumeFields(TYPE_FS), "zip")
+	require.Contains(t, volumeFields(TYPE_FS), "watch")
+	require.Equal(t, []string{"name", "hash", "readOnly"}, volumeFields(TYPE_MEMORY))
+}
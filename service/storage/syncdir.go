@@ -0,0 +1,22 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+
+	"github.com/mpetavy/common"
+)
+
+// syncDir flushes the entries of the directory so a rename inside it survives a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		common.DebugError(dir.Close())
+	}()
+
+	return dir.Sync()
+}
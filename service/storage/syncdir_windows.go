@@ -0,0 +1,6 @@
+package storage
+
+// syncDir does nothing since directories cannot be flushed on Windows, renames are journaled by NTFS
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	// TEMP_INFIX marks the temp files objects are written to before they are renamed into place
+	TEMP_INFIX = ".tresor-tmp-"
+	// TEMP_STALE is the age after which a temp file is considered left over by a crash
+	TEMP_STALE = time.Hour
+)
+
+var (
+	// cleanedTemps holds the volume paths whose temp files are cleaned already, shared by all handles of the pool
+	cleanedTemps   = make(map[string]bool)
+	cleanedTempsMu sync.Mutex
+)
+
+func isTemp(path string) bool {
+	return strings.Contains(filepath.Base(path), TEMP_INFIX)
+}
+
+// createTemp creates a temp file next to path which is renamed to path once it is complete
+func createTemp(path string) (*os.File, error) {
+	return createTempIn(filepath.Dir(path), path)
+}
+
+// createTempIn creates a temp file in dir which is renamed to path once it is complete, dir must be on the
+// file system of path
+func createTempIn(dir string, path string) (*os.File, error) {
+	for _, d := range []string{dir, filepath.Dir(path)} {
+		err := os.MkdirAll(d, common.DefaultDirMode)
+		if common.Error(err) {
+			return nil, err
+		}
+	}
+
+	temp, err := os.CreateTemp(dir, filepath.Base(path)+TEMP_INFIX)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return temp, nil
+}
+
+// commitTemp flushes the temp file to disk, renames it to path and flushes the directory entry
+func commitTemp(temp *os.File, path string) error {
+	err := temp.Sync()
+	if common.Error(err) {
+		return err
+	}
+
+	err = temp.Close()
+	if common.Error(err) {
+		return err
+	}
+
+	err = os.Rename(temp.Name(), path)
+	if common.Error(err) {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// discardTemp removes the temp file unless it has been renamed into place
+func discardTemp(temp *os.File) {
+	common.DebugError(temp.Close())
+
+	if isRegularFile(temp.Name()) {
+		common.DebugError(os.Remove(temp.Name()))
+	}
+}
+
+// writeFileAtomic replaces the file at path with data so that readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := createTemp(path)
+	if common.Error(err) {
+		return err
+	}
+	defer discardTemp(temp)
+
+	_, err = temp.Write(data)
+	if common.Error(err) {
+		return err
+	}
+
+	return commitTemp(temp, path)
+}
+
+// cleanTemp removes the temp files which writes interrupted by a crash left behind in the volume
+func cleanTemp(path string) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !isTemp(p) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil || time.Since(fi.ModTime()) < TEMP_STALE {
+			return nil
+		}
+
+		common.Warn("remove stale temp file: %s", p)
+
+		return os.Remove(p)
+	})
+}
+
+// cleanTempOnce cleans the temp files of the volume at path once per process
+func cleanTempOnce(path string) error {
+	cleanedTempsMu.Lock()
+	defer cleanedTempsMu.Unlock()
+
+	if cleanedTemps[path] {
+		return nil
+	}
+
+	err := cleanTemp(path)
+	if common.Error(err) {
+		return err
+	}
+
+	cleanedTemps[path] = true
+
+	return nil
+}
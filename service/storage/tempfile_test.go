@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func listFiles(t *testing.T, path string) []string {
+	var names []string
+
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+
+		return err
+	})
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+func TestCrashSafeWrite(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	sha.AddVolume(v)
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("page 1")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	broken := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection lost")))
+
+	page := NewShaUID(uid.Id, uid.Version, PAGE+".2")
+
+	_, _, err = sha.Store(page.String(), broken, nil)
+	require.NotNil(t, err)
+
+	for _, name := range listFiles(t, path) {
+		require.False(t, strings.Contains(name, TEMP_INFIX), "temp file removed")
+		require.NotEqual(t, PAGE+".2", name, "no partial object")
+	}
+
+	_, _, err = sha.Store(page.String(), bytes.NewReader([]byte("page 2")), nil)
+	require.Nil(t, err, "store after failed store")
+
+	_, _, err = sha.Store(page.String(), bytes.NewReader([]byte{}), nil)
+	_, ok := err.(*ErrObjectAlreadyExists)
+	require.True(t, ok, "existing object rejected")
+
+	p, err := locate(v, page)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	stale := p + TEMP_INFIX + "1"
+	fresh := p + TEMP_INFIX + "2"
+
+	for _, name := range []string{stale, fresh} {
+		err = os.WriteFile(name, []byte("left over"), common.DefaultFileMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Chtimes(stale, time.Now().Add(-2*TEMP_STALE), time.Now().Add(-2*TEMP_STALE))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	err = cleanTemp(path)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.False(t, common.FileExists(stale), "stale temp file removed")
+	require.True(t, common.FileExists(fresh), "temp file of running write kept")
+
+	for i := 0; i < 2; i++ {
+		err = os.WriteFile(stale, []byte("left over"), common.DefaultFileMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = os.Chtimes(stale, time.Now().Add(-2*TEMP_STALE), time.Now().Add(-2*TEMP_STALE))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Start()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		common.Error(sha.Stop())
+
+		require.Equal(t, i == 1, common.FileExists(stale), "volume is cleaned on the first start of the process only")
+	}
+}
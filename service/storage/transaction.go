@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/cache"
+	"github.com/mpetavy/tresor/service/cluster"
+)
+
+const (
+	// STAGING_DIR holds the pages of open transactions inside META_DIR
+	STAGING_DIR = "staging"
+	// STAGING_STALE is the age after which a staging area is considered left over by a crash
+	STAGING_STALE = time.Hour * 24
+)
+
+// Transaction stages the pages of a bucket on a volume and publishes them as one new version on commit
+type Transaction struct {
+	sha     *Sha
+	uid     *ShaUID
+	options *Options
+	volume  *ShaVolume
+	path    string
+	names   []string
+	size    int64
+	closed  bool
+}
+
+// Begin starts a transaction which stores a new version of the id of the uid or a new id if the uid is empty
+func (sha *Sha) Begin(suid string, options *Options) (*Transaction, error) {
+	uid := NewShaUID(0, 0, "")
+
+	if suid != "" {
+		var err error
+
+		uid, err = ParseShaUID(suid)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		uid = NewShaUID(uid.Id, 0, "")
+	}
+
+	return &Transaction{sha: sha, uid: uid, options: options}, nil
+}
+
+// stage selects the volume on the first page and creates the staging area on it
+func (tx *Transaction) stage(source io.Reader) (io.Reader, error) {
+	var volume *ShaVolume
+	var err error
+
+	if tx.uid.Id != 0 {
+		volume, _, err = tx.sha.find(tx.uid, tx.options)
+	} else {
+		volume, source, err = tx.sha.selectVolume(tx.options, source)
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	volume = tx.sha.primary(volume)
+
+	if volume.ReadOnly {
+		return nil, &ErrVolumeReadOnly{volume.Name}
+	}
+
+	dir := metaPath(volume.Path, STAGING_DIR)
+
+	err = os.MkdirAll(dir, common.DefaultDirMode)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	tx.path, err = os.MkdirTemp(dir, "tx-")
+	if common.Error(err) {
+		return nil, err
+	}
+
+	tx.volume = volume
+
+	return source, nil
+}
+
+// container is the staged zip container of zip volumes
+func (tx *Transaction) container() string {
+	return filepath.Join(tx.path, "container"+ZIP_EXT)
+}
+
+// Add stages the next page of the transaction and returns its digest
+func (tx *Transaction) Add(source io.Reader) (*[]byte, error) {
+	return tx.add(PAGE+"."+strconv.Itoa(len(tx.names)+1), source)
+}
+
+// add stages source as the page name
+func (tx *Transaction) add(name string, source io.Reader) (*[]byte, error) {
+	if tx.closed {
+		return nil, &ErrTransactionClosed{tx.uid.String()}
+	}
+
+	if tx.volume == nil {
+		var err error
+
+		source, err = tx.stage(source)
+		if common.Error(err) {
+			return nil, err
+		}
+	}
+
+	var digest *Digest
+	var n int64
+	var err error
+
+	if tx.volume.Zip {
+		n = -diskUsage(tx.container(), "")
+
+		digest, err = rewriteZip(tx.volume, tx.container(), "", name, source)
+
+		n += diskUsage(tx.container(), "")
+	} else {
+		digest, _, err = writeObject(tx.volume, filepath.Join(tx.path, name), source)
+
+		n = objectUsage(filepath.Join(tx.path, name))
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	addUsage(tx.volume.Path, n)
+
+	tx.names = append(tx.names, name)
+	tx.size += n
+
+	return &digest.Value, nil
+}
+
+// Commit publishes all staged pages as new version with a single rename and returns the uid of the
+// version and the uids of its pages
+func (tx *Transaction) Commit() (string, []string, error) {
+	if tx.closed {
+		return "", nil, &ErrTransactionClosed{tx.uid.String()}
+	}
+
+	if len(tx.names) == 0 {
+		common.Error(tx.Abort())
+
+		return "", nil, &ErrInvalidUID{tx.uid.String()}
+	}
+
+	tx.closed = true
+
+	defer func() {
+		common.DebugError(os.RemoveAll(tx.path))
+	}()
+
+	sha := tx.sha
+	volume := tx.volume
+	uid := NewShaUID(tx.uid.Id, 0, "")
+
+	if uid.Id == 0 {
+		var err error
+
+		uid.Id, err = sha.nextUID()
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		uid.Version = 1
+	}
+
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+	if uid.Version == 0 {
+		_, path, err := sha.find(uid, nil)
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		v, err := sha.currentVersion(nil, path)
+		if common.Error(err) {
+			return "", nil, err
+		}
+
+		uid.Version = v + 1
+	}
+
+	err := func() error {
+		cluster.Lock(cluster.ByStorageVolume(volume.Name))
+		defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+		target, err := createShaPath(volume.Path, uid, volume.Flat, volume.Zip)
+		if common.Error(err) {
+			return err
+		}
+
+		if common.FileExists(target) {
+			return &ErrObjectAlreadyExists{volume.Name, uid.String()}
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), common.DefaultDirMode)
+		if common.Error(err) {
+			return err
+		}
+
+		staged := tx.path
+		if volume.Zip {
+			staged = tx.container()
+		}
+
+		err = os.Rename(staged, target)
+		if common.Error(err) {
+			return err
+		}
+
+		if volume.Zip {
+			unzips.invalidate(target)
+		}
+
+		return nil
+	}()
+	if common.Error(err) {
+		addUsage(volume.Path, -tx.size)
+
+		return "", nil, err
+	}
+
+	objects := make([]string, 0, len(tx.names))
+
+	for _, name := range tx.names {
+		object := NewShaUID(uid.Id, uid.Version, name)
+
+		err := sha.replicate(volume, object)
+		if common.Error(err) {
+			common.Error(sha.deleteReplicated(volume, uid))
+
+			return "", nil, err
+		}
+
+		objects = append(objects, object.String())
+	}
+
+	cache.Put(SHA_VOLUME, strconv.Itoa(uid.Id), volume.Name)
+
+	return uid.String(), objects, nil
+}
+
+// Abort discards all staged pages. Aborting a committed or aborted transaction does nothing.
+func (tx *Transaction) Abort() error {
+	if tx.closed {
+		return nil
+	}
+
+	tx.closed = true
+
+	if tx.path == "" {
+		return nil
+	}
+
+	addUsage(tx.volume.Path, -tx.size)
+
+	return os.RemoveAll(tx.path)
+}
+
+// cleanStaging removes the staging areas which transactions interrupted by a crash left behind
+func cleanStaging(volumes []*ShaVolume) error {
+	for _, volume := range volumes {
+		dir := metaPath(volume.Path, STAGING_DIR)
+
+		files, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		for _, file := range files {
+			fi, err := file.Info()
+			if err != nil || time.Since(fi.ModTime()) < STAGING_STALE {
+				continue
+			}
+
+			common.Warn("remove stale staging area: %s", filepath.Join(dir, file.Name()))
+
+			err = os.RemoveAll(filepath.Join(dir, file.Name()))
+			if common.Error(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
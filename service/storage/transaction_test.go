@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	for _, zip := range []bool{false, true} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+
+		tx, err := sha.Begin("", &Options{VolumeName: "test"})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		for i := 1; i <= 3; i++ {
+			_, err := tx.Add(bytes.NewReader([]byte("page " + strconv.Itoa(i))))
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+		}
+
+		id, err := scanShaId(path, 3)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 0, id, "staged pages are not visible")
+
+		suid, objects, err := tx.Commit()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 3, len(objects))
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 1, uid.Version)
+
+		buf := bytes.Buffer{}
+
+		_, _, _, err = sha.Load(objects[2], &buf, &Options{Verify: true})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, "page 3", buf.String())
+
+		tx, err = sha.Begin(suid, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		_, err = tx.Add(bytes.NewReader([]byte("aborted")))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Nil(t, tx.Abort())
+
+		_, err = tx.Add(bytes.NewReader([]byte("closed")))
+		_, ok := err.(*ErrTransactionClosed)
+		require.True(t, ok, "aborted transaction is closed")
+
+		version, err := sha.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 1, version, "aborted version is not visible")
+
+		staged, err := os.ReadDir(metaPath(path, STAGING_DIR))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 0, len(staged), "staging area removed")
+
+		tx, err = sha.Begin(suid, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		_, err = tx.Add(bytes.NewReader([]byte("second")))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		_, objects, err = tx.Commit()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, []string{NewShaUID(uid.Id, 2, PAGE+".1").String()}, objects, "new version of existing id")
+	}
+}
@@ -0,0 +1,629 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/cache"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/cluster"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	TRASH = "trash"
+	// TRASH_DIR holds the deleted objects inside META_DIR until they are purged
+	TRASH_DIR      = "trash"
+	TRASH_MANIFEST = "trash.json"
+	// TRASH_ENTRY holds a single object deleted from a zip container
+	TRASH_ENTRY = "entry.zip"
+	// TRASH_FILES holds the files and directories moved out of the volume
+	TRASH_FILES = "files"
+	// TRASH_GRACE is the default time deleted objects are kept before they are purged
+	TRASH_GRACE = time.Hour * 24 * 7
+	// TRASH_INTERVAL is the default time between two scheduled purges
+	TRASH_INTERVAL = time.Hour
+)
+
+type TrashCfg struct {
+	// Grace in days deleted objects are kept, 0 uses the default of 7 days, a negative value deletes immediately
+	Grace int `json:"grace" html:"Grace"`
+	// Interval in minutes between two scheduled purges, 0 uses the default of 60 minutes
+	Interval int `json:"interval" html:"Interval"`
+}
+
+// TrashEntry describes what a single delete moved into the trash of a volume
+type TrashEntry struct {
+	Name      string    `json:"name"`
+	Volume    string    `json:"volume"`
+	Uid       string    `json:"uid"`
+	DeletedAt time.Time `json:"deletedAt"`
+	// Buckets are the uids of the versions affected by the delete
+	Buckets []string `json:"buckets"`
+	// Paths are the files and directories moved into the trash relative to the volume
+	Paths []string `json:"paths"`
+	// Container is the zip container relative to the volume a single object was deleted from
+	Container string `json:"container,omitempty"`
+}
+
+var (
+	trashStop chan struct{}
+)
+
+func (c *TrashCfg) grace() time.Duration {
+	switch {
+	case c.Grace < 0:
+		return 0
+	case c.Grace == 0:
+		return TRASH_GRACE
+	default:
+		return time.Duration(c.Grace) * time.Hour * 24
+	}
+}
+
+func trashPath(volume *ShaVolume, name string) string {
+	return metaPath(volume.Path, filepath.Join(TRASH_DIR, name))
+}
+
+func saveTrashEntry(volume *ShaVolume, entry *TrashEntry) error {
+	ba, err := json.Marshal(entry)
+	if common.Error(err) {
+		return err
+	}
+
+	path := trashPath(volume, entry.Name)
+
+	err = os.MkdirAll(path, common.DefaultDirMode)
+	if common.Error(err) {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(path, TRASH_MANIFEST), ba)
+}
+
+func loadTrashEntry(volume *ShaVolume, name string) (*TrashEntry, error) {
+	ba, err := os.ReadFile(filepath.Join(trashPath(volume, name), TRASH_MANIFEST))
+	if os.IsNotExist(err) {
+		return nil, &ErrObjectNotFound{volume.Name, name}
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	entry := &TrashEntry{}
+
+	err = json.Unmarshal(ba, entry)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// loadTrash returns the entries of the trash of a volume
+func loadTrash(volume *ShaVolume) ([]*TrashEntry, error) {
+	files, err := os.ReadDir(metaPath(volume.Path, TRASH_DIR))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if common.Error(err) {
+		return nil, err
+	}
+
+	var entries []*TrashEntry
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		entry, err := loadTrashEntry(volume, file.Name())
+		if err != nil {
+			common.Warn("invalid trash entry %s on volume %s: %v", file.Name(), volume.Name, err)
+
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// moveInto renames the path below root to the same relative path below dir
+func moveInto(root string, path string, dir string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if common.Error(err) {
+		return "", err
+	}
+
+	dest := filepath.Join(dir, rel)
+
+	err = os.MkdirAll(filepath.Dir(dest), common.DefaultDirMode)
+	if common.Error(err) {
+		return "", err
+	}
+
+	err = os.Rename(path, dest)
+	if common.Error(err) {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// trashObject moves the object or the version of an uid on a single volume into its trash
+func (sha *Sha) trashObject(volume *ShaVolume, uid *ShaUID, entry TrashEntry) error {
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
+
+	cluster.Lock(cluster.ByStorageVolume(volume.Name))
+	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+	entry.Volume = volume.Name
+
+	var paths []string
+
+	file := false
+
+	if volume.Zip {
+		container, err := createShaPath(volume.Path, uid.withoutObject(), volume.Flat, true)
+		if common.Error(err) {
+			return err
+		}
+
+		if isRegularFile(container) {
+			if uid.Object != "" {
+				rel, err := filepath.Rel(volume.Path, container)
+				if common.Error(err) {
+					return err
+				}
+
+				entry.Container = filepath.ToSlash(rel)
+
+				err = saveTrashEntry(volume, &entry)
+				if common.Error(err) {
+					return err
+				}
+
+				err = copyZipEntry(container, filepath.Join(trashPath(volume, entry.Name), TRASH_ENTRY), uid.Object)
+				if _, ok := err.(*ErrObjectNotFound); ok {
+					common.Error(os.RemoveAll(trashPath(volume, entry.Name)))
+
+					return &ErrObjectNotFound{volume.Name, uid.String()}
+				}
+				if common.Error(err) {
+					return err
+				}
+
+				err = sha.deleteZip(volume, uid, container)
+				if common.Error(err) {
+					return err
+				}
+
+				// the entry stays in the volume until it is purged
+				addUsage(volume.Path, diskUsage(trashPath(volume, entry.Name), TRASH_MANIFEST))
+
+				return nil
+			}
+
+			paths, err = zipContainers(volume, uid, container)
+			if common.Error(err) {
+				return err
+			}
+		}
+	}
+
+	if paths == nil {
+		path, err := createShaPath(volume.Path, uid, volume.Flat, false)
+		if common.Error(err) {
+			return err
+		}
+
+		if !common.FileExists(path) {
+			return &ErrObjectNotFound{volume.Name, uid.String()}
+		}
+
+		paths = []string{path}
+		file = isRegularFile(path)
+
+		if isRegularFile(path + DIGEST_SUFFIX) {
+			paths = append(paths, path+DIGEST_SUFFIX)
+		}
+	}
+
+	err := saveTrashEntry(volume, &entry)
+	if common.Error(err) {
+		return err
+	}
+
+	dir := filepath.Join(trashPath(volume, entry.Name), TRASH_FILES)
+
+	for _, path := range paths {
+		if !common.FileExists(path) {
+			continue
+		}
+
+		rel, err := moveInto(volume.Path, path, dir)
+		if common.Error(err) {
+			return err
+		}
+
+		entry.Paths = append(entry.Paths, rel)
+
+		unzips.invalidate(path)
+	}
+
+	err = saveTrashEntry(volume, &entry)
+	if common.Error(err) {
+		return err
+	}
+
+	if !file {
+		removeEmptyDirs(volume.Path, paths[0])
+	}
+
+	return nil
+}
+
+// trash moves the uid from the primary and all its replicas into their trash
+func (sha *Sha) trash(primary *ShaVolume, uid *ShaUID, versions []*ShaUID) error {
+	entry := TrashEntry{
+		Name:      fmt.Sprintf("%d-%d", uid.Id, time.Now().UnixNano()),
+		Uid:       uid.String(),
+		DeletedAt: time.Now(),
+	}
+
+	for _, version := range versions {
+		entry.Buckets = append(entry.Buckets, version.String())
+	}
+
+	return sha.removeReplicated(primary, uid, func(volume *ShaVolume) error {
+		return sha.trashObject(volume, uid, entry)
+	})
+}
+
+// restoreEntry moves the content of a trash entry back into the volume and removes the entry
+func (sha *Sha) restoreEntry(volume *ShaVolume, entry *TrashEntry) error {
+	if volume.ReadOnly {
+		return &ErrVolumeReadOnly{volume.Name}
+	}
+
+	cluster.Lock(cluster.ByStorageVolume(volume.Name))
+	defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+	path := trashPath(volume, entry.Name)
+
+	if entry.Container != "" {
+		container := filepath.Join(volume.Path, filepath.FromSlash(entry.Container))
+
+		uid, err := ParseShaUID(entry.Uid)
+		if common.Error(err) {
+			return err
+		}
+
+		n := diskUsage(container, "") + diskUsage(filepath.Join(path, TRASH_ENTRY), "")
+
+		err = copyZipEntry(filepath.Join(path, TRASH_ENTRY), container, uid.Object)
+		if _, ok := err.(*ErrObjectAlreadyExists); ok {
+			return &ErrObjectAlreadyExists{volume.Name, entry.Uid}
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		addUsage(volume.Path, diskUsage(container, "")-n)
+
+		unzips.invalidate(container)
+	}
+
+	for _, rel := range entry.Paths {
+		if common.FileExists(filepath.Join(volume.Path, filepath.FromSlash(rel))) {
+			return &ErrObjectAlreadyExists{volume.Name, entry.Uid}
+		}
+	}
+
+	files := filepath.Join(path, TRASH_FILES)
+
+	for _, rel := range entry.Paths {
+		src := filepath.Join(files, filepath.FromSlash(rel))
+		if !common.FileExists(src) {
+			continue
+		}
+
+		_, err := moveInto(files, src, volume.Path)
+		if common.Error(err) {
+			return err
+		}
+	}
+
+	return os.RemoveAll(path)
+}
+
+// Trash returns the entries in the trash of the primary volumes ordered by their deletion time
+func (sha *Sha) Trash() ([]*TrashEntry, error) {
+	var entries []*TrashEntry
+
+	for _, volume := range sha.storeVolumes() {
+		if sha.isReplica(volume) {
+			continue
+		}
+
+		l, err := loadTrash(volume)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		entries = append(entries, l...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.Before(entries[j].DeletedAt)
+	})
+
+	return entries, nil
+}
+
+// Undelete moves the objects of a trash entry back to the primary volume and its replicas
+func (sha *Sha) Undelete(name string) (*TrashEntry, error) {
+	for _, volume := range sha.storeVolumes() {
+		if sha.isReplica(volume) {
+			continue
+		}
+
+		entry, err := loadTrashEntry(volume, name)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			continue
+		}
+		if common.Error(err) {
+			return nil, err
+		}
+
+		uid, err := ParseShaUID(entry.Uid)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		cluster.Lock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+		defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(uid.Id)))
+
+		err = sha.removeReplicated(volume, uid, func(volume *ShaVolume) error {
+			replica, err := loadTrashEntry(volume, name)
+			if err != nil {
+				return err
+			}
+
+			return sha.restoreEntry(volume, replica)
+		})
+		if common.Error(err) {
+			return nil, err
+		}
+
+		cache.Remove(SHA_VOLUME, strconv.Itoa(uid.Id))
+
+		return entry, nil
+	}
+
+	return nil, &ErrObjectNotFound{"??", name}
+}
+
+// Purge finally removes the trash entries of all volumes which are older than the grace period and
+// returns those of the primary volumes
+func (sha *Sha) Purge() ([]*TrashEntry, error) {
+	var purged []*TrashEntry
+
+	for _, volume := range sha.storeVolumes() {
+		if volume.ReadOnly {
+			continue
+		}
+
+		entries, err := loadTrash(volume)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if time.Since(entry.DeletedAt) < sha.grace {
+				continue
+			}
+
+			err := func() error {
+				cluster.Lock(cluster.ByStorageVolume(volume.Name))
+				defer cluster.Unlock(cluster.ByStorageVolume(volume.Name))
+
+				n := diskUsage(trashPath(volume, entry.Name), TRASH_MANIFEST)
+
+				err := os.RemoveAll(trashPath(volume, entry.Name))
+				if common.Error(err) {
+					return err
+				}
+
+				addUsage(volume.Path, -n)
+
+				return nil
+			}()
+			if common.Error(err) {
+				return nil, err
+			}
+
+			if !sha.isReplica(volume) {
+				purged = append(purged, entry)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// markDeleted records the deletion time on the bucket of a version moved into the trash or clears it on restore
+func markDeleted(uid string, deleted bool) error {
+	return database.Exec(func(db database.Handle) error {
+		bucket := models.NewBucket()
+
+		err := db.LoadBucket("uid", uid, &bucket, nil)
+		if _, ok := err.(*database.ErrNotFound); ok {
+			return nil
+		}
+		if common.Error(err) {
+			return err
+		}
+
+		bucket.DeletedAt = common.Eval(deleted, time.Now(), time.Time{})
+
+		return db.SaveBucket(&bucket, nil)
+	})
+}
+
+// restoreTrash restores a trash entry and rebuilds the buckets of its versions which are no longer deleted
+func restoreTrash(sha *Sha, name string) (*TrashEntry, error) {
+	entry, err := sha.Undelete(name)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	for _, bucketUid := range entry.Buckets {
+		uid, err := ParseShaUID(bucketUid)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		err = sha.rebuildBucket(uid)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		err = markDeleted(bucketUid, false)
+		if common.Error(err) {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// purgeTrash purges the trash and removes the buckets of the versions which were deleted as a whole
+func purgeTrash(sha *Sha) ([]*TrashEntry, error) {
+	purged, err := sha.Purge()
+	if common.Error(err) {
+		return nil, err
+	}
+
+	for _, entry := range purged {
+		uid, err := ParseShaUID(entry.Uid)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		if uid.Object != "" {
+			continue
+		}
+
+		for _, bucketUid := range entry.Buckets {
+			err := removeBucket(bucketUid, "")
+			if _, ok := err.(*database.ErrNotFound); !ok && common.Error(err) {
+				return nil, err
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+func startTrash(cfg *TrashCfg) {
+	interval := common.Eval(cfg.Interval > 0, time.Duration(cfg.Interval)*time.Minute, TRASH_INTERVAL)
+
+	trashStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				common.Error(Exec(func(handle Handle) error {
+					sha, ok := handle.(*Sha)
+					if !ok {
+						return nil
+					}
+
+					_, err := purgeTrash(sha)
+
+					return err
+				}))
+			}
+		}
+	}(trashStop)
+}
+
+func stopTrash() {
+	if trashStop != nil {
+		close(trashStop)
+		trashStop = nil
+	}
+}
+
+// trashHandler lists the trash with GET and restores an entry with POST
+func trashHandler(rw http.ResponseWriter, r *http.Request) error {
+	name := r.URL.Path
+
+	var result interface{}
+
+	err := Exec(func(handle Handle) error {
+		sha, ok := handle.(*Sha)
+		if !ok {
+			return &ErrNotSupported{Driver: cfg.Driver, Operation: TRASH}
+		}
+
+		switch {
+		case r.Method == http.MethodGet && name == "":
+			entries, err := sha.Trash()
+			if common.Error(err) {
+				return err
+			}
+
+			result = entries
+
+			return nil
+		case r.Method == http.MethodPost && name != "":
+			entry, err := restoreTrash(sha, name)
+			if common.Error(err) {
+				return err
+			}
+
+			result = entry
+
+			return nil
+		case r.Method == http.MethodDelete && name == "":
+			entries, err := purgeTrash(sha)
+			if common.Error(err) {
+				return err
+			}
+
+			result = entries
+
+			return nil
+		default:
+			return &ErrNotSupported{Driver: cfg.Driver, Operation: r.Method + " " + TRASH}
+		}
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	cache.RemovePrefix(database.QUERY)
+
+	return writeJson(rw, http.StatusOK, result)
+}
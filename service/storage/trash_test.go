@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrash(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	for _, zip := range []bool{false, true} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+
+		suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("page 1")), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		uid, err := ParseShaUID(suid)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		page2 := NewShaUID(uid.Id, uid.Version, PAGE+".2")
+
+		_, _, err = sha.Store(page2.String(), bytes.NewReader([]byte("page 2")), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		exists := func(uid *ShaUID) bool {
+			_, _, err := sha.find(uid, nil)
+
+			return err == nil
+		}
+
+		restore := func() *TrashEntry {
+			entries, err := sha.Trash()
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, 1, len(entries))
+
+			entry, err := sha.Undelete(entries[0].Name)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			return entry
+		}
+
+		err = sha.Delete(page2.String(), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.False(t, exists(page2), "zip %v: deleted object is gone", zip)
+
+		entry := restore()
+
+		require.Equal(t, []string{uid.withoutObject().String()}, entry.Buckets)
+
+		buf := bytes.Buffer{}
+
+		_, _, _, err = sha.Load(page2.String(), &buf, &Options{Verify: true})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, "page 2", buf.String(), "zip %v: object restored", zip)
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.False(t, exists(uid.withoutObject()), "zip %v: deleted version is gone", zip)
+
+		restore()
+
+		require.True(t, exists(page2), "zip %v: version restored", zip)
+
+		err = sha.Delete(uid.withoutObject().String(), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		purged, err := sha.Purge()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 0, len(purged), "zip %v: entry kept during grace period", zip)
+
+		sha.grace = time.Nanosecond
+
+		purged, err = sha.Purge()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 1, len(purged), "zip %v: entry purged after grace period", zip)
+		require.False(t, common.FileExists(trashPath(v, purged[0].Name)))
+
+		sha.grace = 0
+
+		suid, _, err = sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("page 1")), nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		err = sha.Delete(suid, nil)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		entries, err := sha.Trash()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 0, len(entries), "zip %v: no trash without grace period", zip)
+	}
+}
+
+func TestTrashBucket(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	server, stop := serveStorage(t, &Cfg{Driver: TYPE_SHA, Volumes: []VolumeCfg{{Name: "test", Path: path}}})
+	defer stop()
+
+	loadBucket := func(uid string) models.Bucket {
+		bucket := models.NewBucket()
+
+		err := database.Exec(func(db database.Handle) error {
+			return db.LoadBucket("uid", uid, &bucket, nil)
+		})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		return bucket
+	}
+
+	resp, body := doRequest(t, http.MethodPost, server.URL+"/"+TYPE+"/", "hello", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode, body)
+
+	result := StoreResult{}
+
+	err = json.Unmarshal([]byte(body), &result)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	uid, err := ParseShaUID(result.Uid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	resp, body = doRequest(t, http.MethodDelete, server.URL+"/"+TYPE+"/"+strconv.Itoa(uid.Id), "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, body)
+
+	require.False(t, loadBucket(result.Uid).DeletedAt.IsZero(), "bucket marked deleted")
+
+	resp, _ = doRequest(t, http.MethodGet, server.URL+"/"+TYPE+"-"+EXPORT+"/"+result.Uid, "", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "deleted bucket is not exported")
+
+	status, err := Fixity(0)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 0, status.Buckets, "deleted bucket is not checked")
+	require.Equal(t, 0, status.Missing)
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/"+TYPE+"-"+TRASH+"/", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+	var entries []TrashEntry
+
+	err = json.Unmarshal([]byte(body), &entries)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Len(t, entries, 1)
+
+	resp, body = doRequest(t, http.MethodPost, server.URL+"/"+TYPE+"-"+TRASH+"/"+entries[0].Name, "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+	bucket := loadBucket(result.Uid)
+
+	require.True(t, bucket.DeletedAt.IsZero(), "restored bucket is no longer deleted")
+	require.Equal(t, []string{result.Objects[0].Digest}, bucket.FileHashes)
+
+	resp, body = doRequest(t, http.MethodGet, server.URL+"/"+TYPE+"/"+url.PathEscape(result.Objects[0].Uid), "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, "hello", body)
+
+	status, err = Fixity(0)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, status.Buckets)
+	require.Equal(t, 0, status.Missing)
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"archive/zip"
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mpetavy/common"
+)
+
+const (
+	// UNZIP_CACHE_SIZE is the default limit in MB of extracted zip entries kept on disk
+	UNZIP_CACHE_SIZE = 512
+)
+
+type unzipEntry struct {
+	key  string
+	path string
+	size int64
+}
+
+// unzipCache keeps the zip entries which had to be extracted for random access, shared by all Sha handles.
+// The least recently used entries are evicted as soon as the size limit is exceeded.
+type unzipCache struct {
+	mu      sync.Mutex
+	dir     string
+	limit   int64
+	size    int64
+	users   int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type sectionFile struct {
+	*io.SectionReader
+	file *os.File
+}
+
+var (
+	unzips = &unzipCache{limit: UNZIP_CACHE_SIZE * 1024 * 1024, lru: list.New(), entries: make(map[string]*list.Element)}
+)
+
+func (f *sectionFile) Close() error {
+	return f.file.Close()
+}
+
+func (c *unzipCache) acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users++
+}
+
+// release removes the cache directory as soon as the last Sha handle is stopped
+func (c *unzipCache) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.users--
+
+	if c.users > 0 || c.dir == "" {
+		return
+	}
+
+	common.Error(os.RemoveAll(c.dir))
+
+	c.dir = ""
+	c.size = 0
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *unzipCache) setLimit(mb int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mb > 0 {
+		c.limit = int64(mb) * 1024 * 1024
+	}
+
+	c.evict()
+}
+
+func (c *unzipCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*unzipEntry)
+
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+
+	common.DebugError(os.Remove(entry.path))
+}
+
+func (c *unzipCache) evict() {
+	for c.size > c.limit && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// open opens the extracted content cached under key and extracts it from source if it is not yet cached.
+// Keys start with the path of the file the content is extracted from. The file is opened before it can
+// be evicted so a concurrent eviction never invalidates it.
+func (c *unzipCache) open(key string, source func() (io.ReadCloser, error)) (*os.File, error) {
+	c.mu.Lock()
+
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		file, err := os.Open(e.Value.(*unzipEntry).path)
+
+		c.mu.Unlock()
+
+		return file, err
+	}
+
+	if c.dir == "" {
+		dir, err := common.CreateTempDir()
+		if common.Error(err) {
+			c.mu.Unlock()
+
+			return nil, err
+		}
+
+		c.dir = dir
+	}
+
+	dir := c.dir
+
+	c.mu.Unlock()
+
+	reader, err := source()
+	if common.Error(err) {
+		return nil, err
+	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
+
+	dest, err := os.CreateTemp(dir, "entry-")
+	if common.Error(err) {
+		return nil, err
+	}
+
+	n, err := io.Copy(dest, reader)
+
+	common.DebugError(dest.Close())
+
+	if common.Error(err) {
+		common.DebugError(os.Remove(dest.Name()))
+
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		common.DebugError(os.Remove(dest.Name()))
+
+		c.lru.MoveToFront(e)
+
+		return os.Open(e.Value.(*unzipEntry).path)
+	}
+
+	file, err := os.Open(dest.Name())
+	if common.Error(err) {
+		return nil, err
+	}
+
+	c.entries[key] = c.lru.PushFront(&unzipEntry{key: key, path: dest.Name(), size: n})
+	c.size += n
+
+	c.evict()
+
+	return file, nil
+}
+
+// invalidate removes all cached entries of a file which has been rewritten or removed
+func (c *unzipCache) invalidate(container string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, container+"|") {
+			c.remove(e)
+		}
+	}
+}
+
+// zipEntry returns the entry name of the container, the manifest is no entry of its own
+func zipEntry(r *zip.ReadCloser, name string) *zip.File {
+	if name == ZIP_MANIFEST {
+		return nil
+	}
+
+	for _, f := range r.File {
+		if filepath.ToSlash(f.Name) == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// readZipManifest returns the records of all entries of the container
+func readZipManifest(r *zip.ReadCloser) (zipRecords, error) {
+	var manifest *zip.File
+
+	for _, f := range r.File {
+		if filepath.ToSlash(f.Name) == ZIP_MANIFEST {
+			manifest = f
+		}
+	}
+
+	if manifest == nil {
+		return make(zipRecords), nil
+	}
+
+	reader, err := manifest.Open()
+	if common.Error(err) {
+		return nil, err
+	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
+
+	ba, err := io.ReadAll(reader)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return parseZipManifest(string(ba)), nil
+}
+
+func zipHasEntry(container string, name string) (bool, error) {
+	r, err := zip.OpenReader(container)
+	if common.Error(err) {
+		return false, err
+	}
+	defer func() {
+		common.DebugError(r.Close())
+	}()
+
+	return zipEntry(r, name) != nil, nil
+}
+
+// loadZipEntry streams a single entry out of the container without extracting it to disk
+func loadZipEntry(volume *ShaVolume, uid *ShaUID, container string, dest io.Writer, verify bool) (*Digest, int64, error) {
+	r, err := zip.OpenReader(container)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+	defer func() {
+		common.DebugError(r.Close())
+	}()
+
+	f := zipEntry(r, uid.Object)
+	if f == nil {
+		return nil, -1, &ErrObjectNotFound{volume.Name, uid.String()}
+	}
+
+	source, err := f.Open()
+	if common.Error(err) {
+		return nil, -1, err
+	}
+	defer func() {
+		common.DebugError(source.Close())
+	}()
+
+	records, err := readZipManifest(r)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	expected, err := records.get(uid.Object, volume.formatted())
+	if common.Error(err) {
+		return nil, -1, err
+	}
+
+	reader, err := plainReader(source, expected.format, volume.keys)
+	if common.Error(err) {
+		return nil, -1, err
+	}
+	defer func() {
+		common.DebugError(reader.Close())
+	}()
+
+	return copyDigest(dest, reader, volume.Hash, expected.digest, verify)
+}
+
+// openZipEntry reads stored entries directly out of the container, compressed entries through the extraction cache
+func openZipEntry(volume *ShaVolume, uid *ShaUID, container string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	r, err := zip.OpenReader(container)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+	defer func() {
+		common.DebugError(r.Close())
+	}()
+
+	f := zipEntry(r, uid.Object)
+	if f == nil {
+		return nil, nil, &ErrObjectNotFound{volume.Name, uid.String()}
+	}
+
+	path, err := createShaPath(volume.Path, uid, volume.Flat, true)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	records, err := readZipManifest(r)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	rec, err := records.get(uid.Object, volume.formatted())
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume.Name, uid.String())
+	}
+
+	info := &ObjectInfo{Path: path, Size: int64(f.UncompressedSize64), ModTime: f.Modified, Digest: rec.digest}
+	key := container + "|" + f.Name + "|" + strconv.FormatUint(uint64(f.CRC32), 16)
+
+	if f.Method == zip.Store {
+		offset, err := f.DataOffset()
+		if common.Error(err) {
+			return nil, nil, err
+		}
+
+		file, err := os.Open(container)
+		if common.Error(err) {
+			return nil, nil, err
+		}
+
+		return plainEntry(volume, uid, &sectionFile{SectionReader: io.NewSectionReader(file, offset, info.Size), file: file}, rec.format, info, key)
+	}
+
+	file, err := unzips.open(key, f.Open)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	return plainEntry(volume, uid, file, rec.format, info, key)
+}
+
+// plainEntry wraps an opened entry stored in format for random access to its original content
+func plainEntry(volume *ShaVolume, uid *ShaUID, file io.ReadSeekCloser, format Format, info *ObjectInfo, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	reader, size, err := plainFile(file, info.Size, format, volume.keys, key+"|plain")
+	if common.Error(err) {
+		return nil, nil, objectError(err, volume.Name, uid.String())
+	}
+
+	info.Size = size
+
+	return reader, info, nil
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/service/cluster"
+)
+
+const (
+	VERSIONS = "versions"
+	RESTORE  = "restore"
+)
+
+type VersionPage struct {
+	Uid    string `json:"uid"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+type VersionInfo struct {
+	Uid       string        `json:"uid"`
+	Version   int           `json:"version"`
+	Size      int64         `json:"size"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Pages     []VersionPage `json:"pages"`
+}
+
+// latest resolves version 0 of an uid to the latest version of its id
+func (sha *Sha) latest(uid *ShaUID) error {
+	if uid.Version != 0 {
+		return nil
+	}
+
+	v, err := sha.CurrentVersion(NewShaUID(uid.Id, 0, ""))
+	if common.Error(err) {
+		return err
+	}
+
+	uid.Version = v
+
+	return nil
+}
+
+// resolveObject turns a Sha uid which addresses a version as a whole into the uid of its first page and
+// resolves version 0 to the latest version
+func resolveObject(handle Handle, suid string) (string, error) {
+	sha, ok := handle.(*Sha)
+	if !ok {
+		return suid, nil
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	if uid.Object == "" {
+		uid.Object = PAGE + ".1"
+	}
+
+	err = sha.latest(uid)
+	if common.Error(err) {
+		return "", err
+	}
+
+	return uid.String(), nil
+}
+
+// sortPages orders page names by their page number
+func sortPages(names []string) {
+	number := func(name string) int {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, PAGE+"."))
+		if err != nil {
+			return -1
+		}
+
+		return n
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		ni, nj := number(names[i]), number(names[j])
+		if ni != nj {
+			return ni < nj
+		}
+
+		return names[i] < names[j]
+	})
+}
+
+// pages returns the sorted names of the objects of a version
+func (sha *Sha) pages(uid *ShaUID) ([]string, error) {
+	volume, _, err := sha.find(uid.withoutObject(), nil)
+	if common.Error(err) {
+		return nil, err
+	}
+
+	names, err := listObjects(volume, uid.withoutObject())
+	if common.Error(err) {
+		return nil, err
+	}
+
+	sortPages(names)
+
+	return names, nil
+}
+
+// Versions lists all versions of an id which still exist together with their pages
+func (sha *Sha) Versions(id int) ([]VersionInfo, error) {
+	cluster.Lock(cluster.ByStorageUid(strconv.Itoa(id)))
+	defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(id)))
+
+	current, err := sha.CurrentVersion(NewShaUID(id, 0, ""))
+	if common.Error(err) {
+		return nil, err
+	}
+
+	var versions []VersionInfo
+
+	for version := 1; version <= current; version++ {
+		uid := NewShaUID(id, version, "")
+
+		names, err := sha.pages(uid)
+		if _, ok := err.(*ErrObjectNotFound); ok {
+			continue
+		}
+		if common.Error(err) {
+			return nil, err
+		}
+
+		info := VersionInfo{Uid: uid.String(), Version: version}
+
+		for _, name := range names {
+			page := NewShaUID(id, version, name)
+
+			reader, oi, err := sha.open(page, nil)
+			if common.Error(err) {
+				return nil, err
+			}
+
+			common.DebugError(reader.Close())
+
+			digest := ""
+			if oi.Digest != nil {
+				digest = hex.EncodeToString(oi.Digest.Value)
+			}
+
+			info.Pages = append(info.Pages, VersionPage{Uid: page.String(), Name: name, Size: oi.Size, Digest: digest})
+			info.Size += oi.Size
+
+			if info.CreatedAt.IsZero() || oi.ModTime.Before(info.CreatedAt) {
+				info.CreatedAt = oi.ModTime
+			}
+		}
+
+		versions = append(versions, info)
+	}
+
+	return versions, nil
+}
+
+// Restore stores all pages of an old version as a new version and returns the stored objects. The pages are
+// staged in a transaction, so the new version is published complete or not at all.
+func (sha *Sha) Restore(id int, version int) ([]StoredObject, error) {
+	names, err := func() ([]string, error) {
+		cluster.Lock(cluster.ByStorageUid(strconv.Itoa(id)))
+		defer cluster.Unlock(cluster.ByStorageUid(strconv.Itoa(id)))
+
+		return sha.pages(NewShaUID(id, version, ""))
+	}()
+	if common.Error(err) {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, &ErrObjectNotFound{Uid: NewShaUID(id, version, "").String()}
+	}
+
+	tx, err := sha.Begin(NewShaUID(id, 0, "").String(), nil)
+	if common.Error(err) {
+		return nil, err
+	}
+	defer func() {
+		common.Error(tx.Abort())
+	}()
+
+	var objects []StoredObject
+
+	for _, name := range names {
+		reader, _, err := sha.Open(NewShaUID(id, version, name).String(), nil)
+		if common.Error(err) {
+			return nil, err
+		}
+
+		counter := &countingReader{reader: reader}
+
+		h, err := tx.add(name, counter)
+
+		common.DebugError(reader.Close())
+
+		if common.Error(err) {
+			return nil, err
+		}
+
+		objects = append(objects, StoredObject{Digest: hex.EncodeToString(*h), Size: counter.n})
+	}
+
+	_, uids, err := tx.Commit()
+	if common.Error(err) {
+		return nil, err
+	}
+
+	for i, uid := range uids {
+		objects[i].Uid = uid
+	}
+
+	return objects, nil
+}
+
+// versionUID parses the id of a versions or restore request. Only Sha storages know versions.
+func versionUID(handle Handle, suid string, operation string) (*Sha, *ShaUID, error) {
+	sha, ok := handle.(*Sha)
+	if !ok {
+		return nil, nil, &ErrNotSupported{Driver: cfg.Driver, Operation: operation}
+	}
+
+	uid, err := ParseShaUID(suid)
+	if common.Error(err) {
+		return nil, nil, err
+	}
+
+	if uid.Object != "" {
+		return nil, nil, &ErrInvalidUID{suid}
+	}
+
+	return sha, uid, nil
+}
+
+// versionsHandler lists all versions of an id
+func versionsHandler(rw http.ResponseWriter, r *http.Request) error {
+	suid := strings.TrimSuffix(r.URL.Path, "/"+VERSIONS)
+
+	var versions []VersionInfo
+
+	err := Exec(func(handle Handle) error {
+		sha, uid, err := versionUID(handle, suid, VERSIONS)
+		if common.Error(err) {
+			return err
+		}
+
+		if uid.Version != 0 {
+			return &ErrInvalidUID{suid}
+		}
+
+		versions, err = sha.Versions(uid.Id)
+
+		return err
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeJson(rw, http.StatusOK, versions)
+}
+
+// restoreHandler stores an old version as the new latest version and indexes it
+func restoreHandler(rw http.ResponseWriter, r *http.Request) error {
+	suid := strings.TrimSuffix(r.URL.Path, "/"+RESTORE)
+
+	result := StoreResult{}
+
+	err := Exec(func(handle Handle) error {
+		sha, uid, err := versionUID(handle, suid, RESTORE)
+		if common.Error(err) {
+			return err
+		}
+
+		if uid.Version == 0 {
+			return &ErrInvalidUID{suid}
+		}
+
+		result.Objects, err = sha.Restore(uid.Id, uid.Version)
+		if common.Error(err) {
+			return err
+		}
+
+		var objects []string
+		for _, object := range result.Objects {
+			objects = append(objects, object.Uid)
+		}
+
+		result.Uid, _, err = bucketRef(handle, objects[0])
+		if common.Error(err) {
+			return err
+		}
+
+		_, err = saveBucket(handle, result.Uid, objects)
+
+		return err
+	})
+	if common.Error(err) {
+		return err
+	}
+
+	return writeJson(rw, http.StatusCreated, &result)
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mpetavy/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersions(t *testing.T) {
+	unzips.acquire()
+	defer unzips.release()
+
+	for _, zip := range []bool{false, true} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		sha, err := NewSha()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		v, err := NewShaVolume("test", path, false, zip)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		sha.AddVolume(v)
+
+		store := func(suid string, content string) *ShaUID {
+			suid, _, err := sha.Store(suid, bytes.NewReader([]byte(content)), nil)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			uid, err := ParseShaUID(suid)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			return uid
+		}
+
+		first := store(NewShaUID(0, 0, PAGE+".1").String(), "first page 1")
+		store(NewShaUID(first.Id, first.Version, PAGE+".2").String(), "first page 2")
+
+		second := store(NewShaUID(first.Id, 0, PAGE+".1").String(), "second")
+
+		require.Equal(t, 2, second.Version)
+
+		load := func(suid string) string {
+			buf := bytes.Buffer{}
+
+			_, _, _, err := sha.Load(suid, &buf, nil)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+
+			return buf.String()
+		}
+
+		require.Equal(t, "second", load(strconv.Itoa(first.Id)+"|"+PAGE+".1"), "version 0 resolves to latest")
+		require.Equal(t, "first page 1", load(NewShaUID(first.Id, 1, PAGE+".1").String()))
+
+		versions, err := sha.Versions(first.Id)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 2, len(versions))
+		require.Equal(t, []string{PAGE + ".1", PAGE + ".2"}, []string{versions[0].Pages[0].Name, versions[0].Pages[1].Name})
+		require.Equal(t, int64(len("first page 1")+len("first page 2")), versions[0].Size)
+		require.Equal(t, 1, len(versions[1].Pages))
+		require.NotEmpty(t, versions[1].Pages[0].Digest)
+		require.False(t, versions[1].CreatedAt.IsZero())
+
+		objects, err := sha.Restore(first.Id, 1)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 2, len(objects))
+		require.Equal(t, NewShaUID(first.Id, 3, PAGE+".2").String(), objects[1].Uid, "restored as new version")
+		require.Equal(t, "first page 2", load(strconv.Itoa(first.Id)+"|"+PAGE+".2"))
+
+		versions, err = sha.Versions(first.Id)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Equal(t, 3, len(versions))
+		require.Equal(t, versions[0].Pages[0].Digest, versions[2].Pages[0].Digest)
+	}
+}
+
+func TestRestoreFailure(t *testing.T) {
+	path, err := common.CreateTempDir()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+	defer func() {
+		common.Error(os.RemoveAll(path))
+	}()
+
+	sha, err := NewSha()
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v, err := NewShaVolume("test", path, false, false)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	v.Compression = COMPRESSION_ZSTD
+
+	sha.AddVolume(v)
+
+	suid, _, err := sha.Store(NewShaUID(0, 0, PAGE+".1").String(), bytes.NewReader([]byte("page 1")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	first, err := ParseShaUID(suid)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	second := NewShaUID(first.Id, first.Version, PAGE+".2")
+
+	_, _, err = sha.Store(second.String(), bytes.NewReader([]byte("page 2")), nil)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	p, err := locate(v, second)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	// the second page can no longer be read, so the restore fails after the first page
+	err = os.Remove(p + DIGEST_SUFFIX)
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	_, err = sha.Restore(first.Id, 1)
+	require.Error(t, err)
+
+	version, err := sha.CurrentVersion(NewShaUID(first.Id, 0, ""))
+	if common.Error(err) {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, 1, version, "no partial version published")
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+)
+
+const (
+	WATCH_NOTIFY = "notify"
+	WATCH_POLL   = "poll"
+	// WATCH_SETTLE is the time a file must stay unchanged before it is ingested
+	WATCH_SETTLE = time.Second * 2
+	// WATCH_INTERVAL is the default time between two scans of a polled volume
+	WATCH_INTERVAL = time.Minute
+)
+
+var (
+	// watchers holds the running watcher per volume path, shared by all Fs handles
+	watchers   = make(map[string]*fsWatcher)
+	watchersMu sync.Mutex
+)
+
+// fsWatcher ingests the files which are added, changed or removed in a volume outside of tresor
+type fsWatcher struct {
+	fs      *Fs
+	volume  *FsVolume
+	refs    int
+	settle  time.Duration
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pending map[string]time.Time
+	apply   func(uid *FsUID, removed bool) error
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func validateWatch(volume string, mode string) error {
+	switch mode {
+	case "", WATCH_NOTIFY, WATCH_POLL:
+		return nil
+	default:
+		return &ErrInvalidWatchMode{Volume: volume, Mode: mode}
+	}
+}
+
+func newFsWatcher(fs *Fs, volume *FsVolume) *fsWatcher {
+	w := &fsWatcher{
+		fs:      fs,
+		volume:  volume,
+		settle:  WATCH_SETTLE,
+		stop:    make(chan struct{}),
+		pending: make(map[string]time.Time),
+	}
+
+	w.apply = w.index
+
+	return w
+}
+
+// startWatch starts the watcher of the volume or shares the one which is already running
+func startWatch(fs *Fs, volume *FsVolume) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+
+	if w, ok := watchers[volume.Path]; ok {
+		w.refs++
+
+		return
+	}
+
+	w := newFsWatcher(fs, volume)
+	w.refs = 1
+	w.start()
+
+	watchers[volume.Path] = w
+}
+
+// stopWatch stops the watcher of the volume once no Fs handle uses it anymore
+func stopWatch(volume *FsVolume) {
+	watchersMu.Lock()
+	defer watchersMu.Unlock()
+
+	w, ok := watchers[volume.Path]
+	if !ok {
+		return
+	}
+
+	w.refs--
+	if w.refs > 0 {
+		return
+	}
+
+	delete(watchers, volume.Path)
+
+	w.close()
+}
+
+func (w *fsWatcher) start() {
+	w.wg.Add(2)
+
+	go w.watch()
+	go w.flush()
+}
+
+func (w *fsWatcher) close() {
+	close(w.stop)
+
+	w.wg.Wait()
+}
+
+// watch reports changes through file system notifications and falls back to polling if they are unavailable
+func (w *fsWatcher) watch() {
+	defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+	defer w.wg.Done()
+
+	if w.volume.Watch == WATCH_NOTIFY {
+		err := w.notify()
+		if err == nil {
+			return
+		}
+
+		common.Warn("file system notifications unavailable for volume %s, fall back to polling: %v", w.volume.Name, err)
+	}
+
+	w.poll()
+}
+
+// watched excludes the administrative, digest and temp files of the volume
+func watched(rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	return rel != "." && rel != META_DIR && !strings.HasPrefix(rel, META_DIR+"/") && !isDigestSidecar(rel) && !isTemp(rel)
+}
+
+// changed marks the file at path to be ingested once it settled
+func (w *fsWatcher) changed(path string) {
+	rel, err := filepath.Rel(w.volume.Path, path)
+	if err != nil || !watched(rel) {
+		return
+	}
+
+	w.mu.Lock()
+	w.pending[rel] = time.Now()
+	w.mu.Unlock()
+}
+
+// removedDir marks the indexed files below the directory at path, which was moved out of the volume or
+// deleted, to be removed. Pending files below it are removed as well since ingest no longer finds them.
+func (w *fsWatcher) removedDir(path string) {
+	rel, err := filepath.Rel(w.volume.Path, path)
+	if err != nil || !watched(rel) {
+		return
+	}
+
+	prefix := rel + string(filepath.Separator)
+
+	err = database.Exec(func(db database.Handle) error {
+		return db.ListBucket(func(bucket *models.Bucket) error {
+			if strings.HasPrefix(bucket.Uid, prefix) {
+				w.changed(filepath.Join(w.volume.Path, bucket.Uid))
+			}
+
+			return nil
+		}, nil)
+	})
+	common.Error(err)
+}
+
+// flush ingests the pending files which did not change for the settle time
+func (w *fsWatcher) flush() {
+	defer common.UnregisterGoRoutine(common.RegisterGoRoutine(1))
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.settle / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var ready []string
+
+		w.mu.Lock()
+		for rel, t := range w.pending {
+			if time.Since(t) >= w.settle {
+				ready = append(ready, rel)
+				delete(w.pending, rel)
+			}
+		}
+		w.mu.Unlock()
+
+		sort.Strings(ready)
+
+		for _, rel := range ready {
+			if stopped(w.stop) {
+				return
+			}
+
+			w.ingest(rel)
+		}
+	}
+}
+
+// ingest indexes a new or changed file or removes the bucket of a deleted file. Files which are still
+// written are postponed.
+func (w *fsWatcher) ingest(rel string) {
+	path := filepath.Join(w.volume.Path, rel)
+	uid := NewFsUID(filepath.ToSlash(rel))
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		common.Error(w.apply(uid, true))
+
+		return
+	}
+	if common.Error(err) || fi.IsDir() {
+		return
+	}
+
+	if time.Since(fi.ModTime()) < w.settle {
+		w.changed(path)
+
+		return
+	}
+
+	common.Error(w.apply(uid, false))
+}
+
+// index saves the bucket of a file through the rebuild path or deletes it
+func (w *fsWatcher) index(uid *FsUID, removed bool) error {
+	if !removed {
+		return w.fs.rebuildBucket(uid)
+	}
+
+	err := removeBucket(uid.String(), "")
+	if _, ok := err.(*database.ErrNotFound); ok {
+		return nil
+	}
+
+	return err
+}
+
+// scan returns the state of all watched files of the volume
+func (w *fsWatcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+
+	err := filepath.WalkDir(w.volume.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(w.volume.Path, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if rel == META_DIR {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !watched(rel) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		files[rel] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+
+		return nil
+	})
+	if common.Error(err) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// poll compares the files of the volume with the previous scan in the configured interval
+func (w *fsWatcher) poll() {
+	interval := common.Eval(w.volume.WatchInterval > 0, w.volume.WatchInterval, WATCH_INTERVAL)
+
+	snapshot, err := w.scan()
+	if common.Error(err) {
+		snapshot = make(map[string]fileState)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := w.scan()
+		if common.Error(err) {
+			continue
+		}
+
+		for rel, state := range current {
+			if old, ok := snapshot[rel]; !ok || old != state {
+				w.changed(filepath.Join(w.volume.Path, rel))
+			}
+		}
+
+		for rel := range snapshot {
+			if _, ok := current[rel]; !ok {
+				w.changed(filepath.Join(w.volume.Path, rel))
+			}
+		}
+
+		snapshot = current
+	}
+}
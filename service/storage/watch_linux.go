@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/mpetavy/common"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+)
+
+// notify reports changes through inotify until the watcher is stopped. Directories created later are
+// watched as well and the files found in them reported.
+func (w *fsWatcher) notify() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		common.DebugError(unix.Close(fd))
+	}()
+
+	dirs := make(map[int]string)
+
+	add := func(root string, report bool) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !d.IsDir() {
+				if report {
+					w.changed(path)
+				}
+
+				return nil
+			}
+
+			if d.Name() == META_DIR {
+				return filepath.SkipDir
+			}
+
+			wd, err := unix.InotifyAddWatch(fd, path, inotifyMask)
+			if err != nil {
+				return err
+			}
+
+			dirs[wd] = path
+
+			return nil
+		})
+	}
+
+	err = add(w.volume.Path, false)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+
+	for !stopped(w.stop) {
+		n, err := unix.Poll(fds, 500)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		n, err = unix.Read(fd, buf)
+		if err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(event.Len)]), "\x00")
+
+			offset = start + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				common.Warn("file system notifications of volume %s overflowed, rescan", w.volume.Name)
+
+				common.Error(add(w.volume.Path, true))
+
+				continue
+			}
+
+			dir, ok := dirs[int(event.Wd)]
+			if !ok {
+				continue
+			}
+
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(dirs, int(event.Wd))
+
+				continue
+			}
+
+			path := filepath.Join(dir, name)
+
+			if event.Mask&unix.IN_ISDIR != 0 {
+				switch {
+				case event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+					common.Error(add(path, true))
+				case event.Mask&(unix.IN_MOVED_FROM|unix.IN_DELETE) != 0:
+					for wd, d := range dirs {
+						if d == path || strings.HasPrefix(d, path+string(filepath.Separator)) {
+							// a deleted directory has already lost its watch
+							_, err := unix.InotifyRmWatch(fd, uint32(wd))
+							common.DebugError(err)
+
+							delete(dirs, wd)
+						}
+					}
+
+					w.removedDir(path)
+				}
+
+				continue
+			}
+
+			w.changed(path)
+		}
+	}
+
+	return nil
+}
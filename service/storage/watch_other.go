@@ -0,0 +1,8 @@
+//go:build !linux
+
+package storage
+
+// notify is only available with inotify on Linux, other platforms poll
+func (w *fsWatcher) notify() error {
+	return &ErrNotSupported{Driver: TYPE_FS, Operation: WATCH_NOTIFY}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mpetavy/common"
+	"github.com/mpetavy/tresor/models"
+	"github.com/mpetavy/tresor/service/database"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	for _, mode := range []string{WATCH_NOTIFY, WATCH_POLL} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		volume, err := NewFsVolume("test", path)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		volume.Watch = mode
+		volume.WatchInterval = time.Millisecond * 100
+
+		mu := sync.Mutex{}
+		events := make(map[string]bool)
+
+		w := newFsWatcher(nil, volume)
+		w.settle = time.Millisecond * 200
+		w.apply = func(uid *FsUID, removed bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events[uid.String()] = removed
+
+			return nil
+		}
+
+		w.start()
+
+		err = os.MkdirAll(filepath.Join(path, "inbox", META_DIR), common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * 200)
+
+		for _, name := range []string{"inbox/a.txt", "inbox/a.txt" + DIGEST_SUFFIX, "inbox/b" + TEMP_INFIX + "1"} {
+			err = os.WriteFile(filepath.Join(path, name), []byte("dropped"), common.DefaultFileMode)
+			if common.Error(err) {
+				t.Fatal(err)
+			}
+		}
+
+		ingested := func(name string, removed bool) bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			r, ok := events[name]
+
+			return ok && r == removed
+		}
+
+		require.Eventually(t, func() bool { return ingested("inbox/a.txt", false) }, time.Second*5, time.Millisecond*50, "%s ingests new file", mode)
+
+		err = os.Remove(filepath.Join(path, "inbox/a.txt"))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Eventually(t, func() bool { return ingested("inbox/a.txt", true) }, time.Second*5, time.Millisecond*50, "%s removes deleted file", mode)
+
+		w.close()
+
+		require.Equal(t, 1, len(events), "%s ignores digest and temp files", mode)
+	}
+}
+
+func TestWatchMovedDir(t *testing.T) {
+	stopServices := startMemoryServices(t)
+	defer stopServices()
+
+	for _, mode := range []string{WATCH_NOTIFY, WATCH_POLL} {
+		path, err := common.CreateTempDir()
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+		defer func() {
+			common.Error(os.RemoveAll(path))
+		}()
+
+		volumePath := filepath.Join(path, "volume")
+
+		err = os.MkdirAll(filepath.Join(volumePath, "inbox", "sub"), common.DefaultDirMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		indexed := filepath.Join("inbox", "sub", "a.txt")
+
+		err = os.WriteFile(filepath.Join(volumePath, indexed), []byte("indexed"), common.DefaultFileMode)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		bucket := models.NewBucket()
+		bucket.Uid = indexed
+
+		err = database.Exec(func(db database.Handle) error {
+			return db.SaveBucket(&bucket, nil)
+		})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		volume, err := NewFsVolume("test", volumePath)
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		volume.Watch = mode
+		volume.WatchInterval = time.Millisecond * 100
+
+		mu := sync.Mutex{}
+		events := make(map[string]bool)
+
+		w := newFsWatcher(nil, volume)
+		w.settle = time.Millisecond * 200
+		w.apply = func(uid *FsUID, removed bool) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			events[uid.String()] = removed
+
+			return nil
+		}
+
+		w.start()
+
+		time.Sleep(time.Millisecond * 200)
+
+		err = os.Rename(filepath.Join(volumePath, "inbox"), filepath.Join(path, "outside"))
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+
+			removed, ok := events[indexed]
+
+			return ok && removed
+		}, time.Second*5, time.Millisecond*50, "%s removes the files of a moved out directory", mode)
+
+		w.close()
+
+		err = database.Exec(func(db database.Handle) error {
+			return db.DeleteBucket("uid", indexed, 0, nil)
+		})
+		if common.Error(err) {
+			t.Fatal(err)
+		}
+	}
+}